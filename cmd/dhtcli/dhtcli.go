@@ -1,19 +1,126 @@
 package main
 
 import (
+	"errors"
+	"github.com/jeanralphaviles/dhtcli/internal/codec"
+	"github.com/jeanralphaviles/dhtcli/internal/command"
 	"github.com/jeanralphaviles/dhtcli/internal/dht"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	"github.com/jeanralphaviles/dhtcli/internal/key"
 	"github.com/jeanralphaviles/dhtcli/internal/query"
+	"github.com/jeanralphaviles/dhtcli/internal/serve"
+	"github.com/jeanralphaviles/dhtcli/internal/torrent"
+	pkgdht "github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/jeanralphaviles/dhtcli/pkg/queryprocessor"
 	"log"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 )
 
+// exitKRPCError is the exit status when a queried node replies with an error,
+// to tell it apart from other failures such as timeouts.
+const exitKRPCError = 3
+
+// dhtFlags are shared by every dht subcommand.
+//
+// Flags aren't inherited from parent commands: https://github.com/urfave/cli/issues/795.
+var dhtFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "bootstrap, b",
+		Value: "dht.libtorrent.org:25401",
+		Usage: "Bootstrap DHT node",
+	},
+	cli.StringFlag{
+		Name:  "bootstrap6",
+		Value: "dht.libtorrent.org:25401",
+		Usage: "Bootstrap DHT node for IPv6 lookups",
+	},
+	cli.StringFlag{
+		Name:  "family, f",
+		Value: "4",
+		Usage: "Address family of the DHT to search: 4, 6 or both, as described in BEP 32",
+	},
+	cli.IntFlag{
+		Name:  "table_size, k",
+		Value: 8,
+		Usage: "Number of nodes per routing table bucket and tracked by lookups: referenced as K value in BEP 5.",
+	},
+	cli.IntFlag{
+		Name:  "alpha, a",
+		Value: queryprocessor.DefaultAlpha,
+		Usage: "Number of queries a lookup keeps in flight at once: referenced as alpha in the Kademlia paper.",
+	},
+	cli.StringFlag{
+		Name:  "secure",
+		Value: "off",
+		Usage: "Treatment of nodes whose ids aren't derived from their IP addresses, as described in BEP 42: off, prefer or require",
+	},
+	cli.StringFlag{
+		Name:  "state",
+		Value: dht.DefaultStatePath(),
+		Usage: "File our node id and routing table are loaded from and saved to between runs, none if empty",
+	},
+}
+
+// batchFlags are shared by every command supporting --batch.
+var batchFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "batch",
+		Usage: "Read arguments from stdin, one set per line, and print a result for each",
+	},
+	cli.IntFlag{
+		Name:  "concurrency, j",
+		Value: command.DefaultConcurrency,
+		Usage: "Number of lines of --batch to work on at once",
+	},
+}
+
+// torrentFlag is shared by every command taking an info hash that can be
+// computed from a .torrent file instead.
+var torrentFlag = cli.StringFlag{
+	Name:  "torrent",
+	Usage: "Use the info hash of this .torrent file, - for stdin, and print its name, size and files alongside the result",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "dhtcli"
 	app.Usage = "Query and interact with the BitTorrent Distributed Hash Table."
 	app.Version = "0.0.5"
+	app.Flags = []cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: pkgdht.DefaultTimeout,
+			Usage: "How long to wait for a node to respond, retries included, before giving up on it",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: pkgdht.DefaultRetries,
+			Usage: "How many times to retry a query within --timeout, doubling the wait each time, before giving up on a node",
+		},
+		cli.DurationFlag{
+			Name:  "deadline",
+			Usage: "How long the whole command may run before it stops and prints what it found so far, unlimited if unset",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: format.Pretty,
+			Usage: "Output format: pretty, json, ndjson, table, bencode or raw, a hex dump of the bencoded datagram",
+		},
+		cli.StringFlag{
+			Name:  "pcap",
+			Usage: "File every datagram sent and received is written to in pcap format, for Wireshark",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := format.Check(c.GlobalString("format")); err != nil {
+			return err
+		}
+		return command.OpenCapture(c)
+	}
+	app.After = command.CloseCapture
 	app.Commands = []cli.Command{
 		cli.Command{
 			Name:  "query",
@@ -24,6 +131,7 @@ func main() {
 					Usage:     "Issue a DHT 'ping' to the given node",
 					ArgsUsage: "host:port",
 					Action:    query.Ping,
+					Flags:     batchFlags,
 					Description: "The most basic query is ping.\n\n" +
 						"   A server should respond with a single key \"id\", " +
 						"containing the queried node's ID.",
@@ -31,18 +139,26 @@ func main() {
 				cli.Command{
 					Name:      "find_node",
 					Usage:     "Issue a DHT 'find_node' request to the given node",
-					ArgsUsage: "host:port node_id",
+					ArgsUsage: "host:port (node_id | --torrent file)",
 					Description: "Find node is used to find the contact information " +
 						"for a node given its ID.\n\n" +
 						"   When a node receives a find node query, it should respond " +
 						"with a key \"nodes\" containing information for the target " +
-						"node, or the closest K nodes to the target.",
+						"node, or the closest K nodes to the target.\n\n" +
+						"   With --torrent, the target is the torrent's info hash.",
 					Action: query.FindNode,
+					Flags: append([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "want, w",
+							Usage: "Address families of nodes to return, n4 and/or n6 as described in BEP 32",
+						},
+						torrentFlag,
+					}, batchFlags...),
 				},
 				cli.Command{
 					Name:      "get_peers",
 					Usage:     "Issue a DHT 'get_peers' request to the given node",
-					ArgsUsage: "host:port info_hash",
+					ArgsUsage: "host:port (info_hash | --torrent file)",
 					Description: "Get peers associated with a torrent info_hash from a " +
 						"DHT node.\n\n" +
 						"   If the queried node has peers for the info_hash, they are " +
@@ -53,13 +169,38 @@ func main() {
 						"info_hash.\n" +
 						"   In either case, a \"token\" key is also included in the " +
 						"return value. This token value is required for a future " +
-						"announce_peer query.",
+						"announce_peer query.\n\n" +
+						"   info_hash may be 40 hex or 32 base32 characters, or a magnet " +
+						"link, whose \"x.pe\" peers are added to \"values\". With " +
+						"--torrent, it is computed from the .torrent file. BitTorrent " +
+						"v2 info hashes, 64 hex characters or \"urn:btmh:\" magnet " +
+						"links, are truncated to 20 bytes as described in BEP 52; " +
+						"hybrid torrents are looked up by their v1 info hash.\n\n" +
+						"   With --scrape, the node is also asked for bloom filters of " +
+						"the seeds and peers it stores in keys \"BFsd\" and \"BFpe\", " +
+						"as described in BEP 33, each with an estimate of the number " +
+						"of addresses in it.",
 					Action: query.GetPeers,
+					Flags: append([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "want, w",
+							Usage: "Address families of nodes to return, n4 and/or n6 as described in BEP 32",
+						},
+						cli.BoolFlag{
+							Name:  "scrape",
+							Usage: "Ask for bloom filters of seeds and peers as described in BEP 33",
+						},
+						cli.BoolFlag{
+							Name:  "noseed",
+							Usage: "Ask the node not to return seeds, requires --scrape",
+						},
+						torrentFlag,
+					}, batchFlags...),
 				},
 				cli.Command{
 					Name:      "announce_peer",
 					Usage:     "Issue a DHT 'announce_peer' request to the given node",
-					ArgsUsage: "host:port info_hash",
+					ArgsUsage: "host:port (info_hash | --torrent file)",
 					Description: "Announce ourselves to a DHT node as a peer for the " +
 						"torrent with the given info_hash.\n\n" +
 						"   This request requires a token received from the node in a " +
@@ -71,7 +212,7 @@ func main() {
 						"set to 0, the announce_peer request will contain the " +
 						"\"implied_port\" setting. This setting will derive the port " +
 						"value automatically as described in BEP 5.",
-					Flags: []cli.Flag{
+					Flags: append([]cli.Flag{
 						cli.StringFlag{
 							Name:  "token, t",
 							Usage: "Response token from previous get_peers request to this node",
@@ -81,9 +222,95 @@ func main() {
 							Usage: "Port value of announced peer",
 							Value: 0,
 						},
-					},
+						torrentFlag,
+					}, batchFlags...),
 					Action: query.AnnouncePeer,
 				},
+				cli.Command{
+					Name:      "get",
+					Usage:     "Issue a DHT 'get' request for a stored item to the given node",
+					ArgsUsage: "host:port target",
+					Description: "Get an item stored in the DHT under target, as described " +
+						"in BEP 44.\n\n" +
+						"   The target of an immutable item is the SHA-1 hash of its " +
+						"bencoded value. If the queried node has the item, it is " +
+						"returned in a key \"v\". Otherwise, a key \"nodes\" is returned " +
+						"containing the K closest nodes to the target.\n" +
+						"   In either case, a \"token\" key is also included in the " +
+						"return value. This token value is required for a future put " +
+						"query.",
+					Action: query.Get,
+					Flags:  batchFlags,
+				},
+				cli.Command{
+					Name:      "put",
+					Usage:     "Issue a DHT 'put' request storing an immutable item on the given node",
+					ArgsUsage: "host:port value",
+					Description: "Store an immutable item on a DHT node, as described in " +
+						"BEP 44. The item is stored under the SHA-1 hash of its bencoded " +
+						"value, which is logged.\n\n" +
+						"   value is stored as a byte string unless --bencoded is set, in " +
+						"which case it is decoded as bencode, e.g. \"li1ei2ee\". Values " +
+						"may be at most 1000 bytes bencoded.\n\n" +
+						"   This request requires a token received from the node in a " +
+						"previous get request. If --token is not specified, one will be " +
+						"obtained by issuing a get request to the node.",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "token, t",
+							Usage: "Response token from previous get request to this node",
+						},
+						cli.BoolFlag{
+							Name:  "bencoded, e",
+							Usage: "Decode value as bencode instead of storing it as a byte string",
+						},
+					}, batchFlags...),
+					Action: query.Put,
+				},
+				cli.Command{
+					Name:      "sample_infohashes",
+					Usage:     "Issue a DHT 'sample_infohashes' request to the given node",
+					ArgsUsage: "host:port [target]",
+					Description: "Sample the info hashes a DHT node stores peers for, as " +
+						"described in BEP 51.\n\n" +
+						"   The node returns a random subset of them concatenated in a key " +
+						"\"samples\", how many it stores in a key \"num\", and how many " +
+						"seconds to wait before querying it again in a key \"interval\". A " +
+						"key \"nodes\" contains the K closest nodes to target, random if " +
+						"unset.",
+					Action: query.SampleInfohashes,
+					Flags: append([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "want, w",
+							Usage: "Address families of nodes to return, n4 and/or n6 as described in BEP 32",
+						},
+					}, batchFlags...),
+				},
+				cli.Command{
+					Name:      "raw",
+					Usage:     "Issue an arbitrary query to the given node",
+					ArgsUsage: "host:port method [arguments]",
+					Description: "Issue a query calling any method, with an arguments " +
+						"dictionary given as a JSON object, to test extensions and " +
+						"misbehaving nodes. The full response is printed, even if it is " +
+						"an error.\n\n" +
+						"   Strings in arguments are sent as byte strings. Those prefixed " +
+						"with \"hex:\" or \"b64:\" are decoded from hexadecimal or " +
+						"base64 first, and \"str:\" escapes strings starting with a " +
+						"prefix. Numbers must be integers. The \"id\" argument is set " +
+						"to our node id unless given, e.g.:\n\n" +
+						"   dhtcli query raw host:port get_peers '{\"info_hash\": " +
+						"\"hex:F09C8D0884590088F4004E010A928F8B6178C2FD\"}'\n\n" +
+						"   --dry-run prints the bencoded query instead of sending it, " +
+						"as a hex dump with --format raw. It can't be used with --batch.",
+					Action: query.Raw,
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "Print the bencoded query instead of sending it",
+						},
+					}, batchFlags...),
+				},
 			},
 		},
 		cli.Command{
@@ -93,30 +320,296 @@ func main() {
 				cli.Command{
 					Name:      "find_node",
 					Usage:     "Issue a DHT 'find_node' request for the given node ID",
-					ArgsUsage: "node_id",
+					ArgsUsage: "node_id | --torrent file",
 					Description: "Find node is used to find the contact information " +
 						"for a node given its ID.\n\n" +
 						"   Response will contain a key \"nodes\" containing information " +
-						"for the target node and/or the closest K nodes to the target.",
+						"for the target node and/or the closest K nodes to the target.\n\n" +
+						"   With --torrent, the target is the torrent's info hash.",
 					Action: dht.FindNode,
-					// Flags aren't inherited from parent commands: https://github.com/urfave/cli/issues/795.
-					Flags: []cli.Flag{
+					Flags:  append(append([]cli.Flag{torrentFlag}, batchFlags...), dhtFlags...),
+				},
+				cli.Command{
+					Name:      "get_peers",
+					Usage:     "Search the DHT for peers of the torrent with the given info_hash",
+					ArgsUsage: "info_hash | --torrent file",
+					Description: "Get peers walks the DHT toward the info_hash, asking " +
+						"every node on the way for peers.\n\n" +
+						"   Response will contain a key \"values\" with every peer found, " +
+						"deduplicated, and a key \"nodes\" with each node that responded, " +
+						"closest to the info_hash first, along with the token it returned " +
+						"for a future announce_peer query.\n\n" +
+						"   info_hash may be 40 hex or 32 base32 characters, or a magnet " +
+						"link, whose \"x.pe\" peers are added to \"values\". With " +
+						"--torrent, it is computed from the .torrent file.\n\n" +
+						"   BitTorrent v2 info hashes, 64 hex characters or \"urn:btmh:\" " +
+						"magnet links, are truncated to 20 bytes as described in BEP 52. " +
+						"Hybrid torrents are looked up by both their v1 and v2 info " +
+						"hashes; each peer in \"values\" lists the \"info_hashes\" it " +
+						"was found for, and \"nodes\" holds the nodes of each lookup.\n\n" +
+						"   With --probe, each peer is connected to over TCP and sent a " +
+						"BitTorrent handshake, as described in BEP 3, to weed out stale " +
+						"peers and those of other torrents. Peers in \"values\" become " +
+						"objects with their \"address\" and a \"probe\" key holding " +
+						"the \"peer_id\" they replied with, whether they support " +
+						"\"extensions\" as described in BEP 10, and, from their " +
+						"bitfield, whether their \"status\" is seeder or leecher, or " +
+						"an \"error\" if they couldn't be probed.",
+					Action: dht.GetPeers,
+					Flags: append(append([]cli.Flag{
+						torrentFlag,
+						cli.BoolFlag{
+							Name:  "probe",
+							Usage: "Connect to each peer found to check it has the torrent and tell seeders from leechers",
+						},
+						cli.DurationFlag{
+							Name:  "probe_timeout",
+							Value: 5 * time.Second,
+							Usage: "How long to wait for each peer to answer --probe",
+						},
+					}, batchFlags...), dhtFlags...),
+				},
+				cli.Command{
+					Name:      "scrape",
+					Usage:     "Estimate the number of seeders and leechers of the torrent with the given info_hash",
+					ArgsUsage: "info_hash",
+					Description: "Scrape walks the DHT toward the info_hash like get_peers, " +
+						"asking every node on the way for bloom filters of the seeds and " +
+						"peers it stores, as described in BEP 33.\n\n" +
+						"   The filters of all nodes are merged so that peers known to " +
+						"several nodes are counted once. Response will contain the " +
+						"estimated number of \"seeders\" and \"leechers\", and the number " +
+						"of \"nodes\" that returned filters.",
+					Action: dht.Scrape,
+					Flags:  dhtFlags,
+				},
+				cli.Command{
+					Name:      "announce_peer",
+					Usage:     "Announce ourselves as a peer of the torrent with the given info_hash",
+					ArgsUsage: "info_hash | --torrent file",
+					Description: "Announce peer runs a get_peers lookup for the info_hash " +
+						"and then issues an announce_peer request, with the token each " +
+						"returned, to the K closest nodes that responded.\n\n" +
+						"   Response will contain a key \"accepted\" with the nodes that " +
+						"accepted the announce and a key \"rejected\" with the nodes " +
+						"that didn't, and why.\n\n" +
+						"   --port specifies the port of the announced peer. If port is " +
+						"set to 0, the announce_peer requests will contain the " +
+						"\"implied_port\" setting.",
+					Action: dht.AnnouncePeer,
+					Flags: append([]cli.Flag{
+						cli.IntFlag{
+							Name:  "port, p",
+							Usage: "Port value of announced peer",
+							Value: 0,
+						},
+						torrentFlag,
+					}, dhtFlags...),
+				},
+				cli.Command{
+					Name:      "get",
+					Usage:     "Search the DHT for the item stored under the given target",
+					ArgsUsage: "target | --pubkey key [--salt salt]",
+					Description: "Get walks the DHT toward the target, asking every node " +
+						"on the way for the item stored under it, as described in BEP " +
+						"44.\n\n" +
+						"   With --pubkey, the mutable item signed by the key with --salt " +
+						"is searched for instead, and the validly signed version with the " +
+						"highest sequence number found is returned.\n\n" +
+						"   Response will contain a key \"item\" with the item found, and " +
+						"a key \"nodes\" with each node that responded, closest to the " +
+						"target first, along with the token it returned for a future put " +
+						"query.",
+					Action: dht.Get,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "pubkey",
+							Usage: "Hexadecimal ed25519 public key of a mutable item",
+						},
 						cli.StringFlag{
-							Name:  "bootstrap, b",
-							Value: "dht.libtorrent.org:25401",
-							Usage: "Bootstrap DHT node",
+							Name:  "salt, s",
+							Usage: "Salt of a mutable item",
+						},
+					}, dhtFlags...),
+				},
+				cli.Command{
+					Name:      "put",
+					Usage:     "Store an item in the DHT",
+					ArgsUsage: "value",
+					Description: "Put runs a get lookup for the item's target and then " +
+						"issues a put request, with the token each node returned, to the " +
+						"K closest nodes that responded.\n\n" +
+						"   value is stored as a byte string unless --bencoded is set, in " +
+						"which case it is decoded as bencode. Immutable items are stored " +
+						"under the SHA-1 hash of their bencoded value.\n\n" +
+						"   With --mutable, the item is signed with the ed25519 private key " +
+						"in --key, see 'dhtcli key', and stored under the SHA-1 hash of the " +
+						"public key and --salt. It is stored with the sequence number " +
+						"following that of the newest version found, and nodes are asked " +
+						"to reject it if that version changes in the meantime. --seq and " +
+						"--cas set the sequence number and compare-and-swap value " +
+						"explicitly.\n\n" +
+						"   Response will contain the \"target\" the item is stored under, " +
+						"a key \"accepted\" with the nodes that stored it and a key " +
+						"\"rejected\" with the nodes that didn't, and why.",
+					Action: dht.Put,
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{
+							Name:  "bencoded, e",
+							Usage: "Decode value as bencode instead of storing it as a byte string",
 						},
+						cli.BoolFlag{
+							Name:  "mutable, m",
+							Usage: "Store a mutable item signed with --key",
+						},
+						cli.StringFlag{
+							Name:  "key",
+							Usage: "File containing the ed25519 private key to sign a mutable item with",
+						},
+						cli.StringFlag{
+							Name:  "salt, s",
+							Usage: "Salt of a mutable item",
+						},
+						cli.Int64Flag{
+							Name:  "seq",
+							Usage: "Sequence number of a mutable item, one more than the current one if unset",
+						},
+						cli.Int64Flag{
+							Name:  "cas",
+							Usage: "Only store a mutable item on nodes whose current sequence number is cas, requires --seq",
+						},
+					}, dhtFlags...),
+				},
+				cli.Command{
+					Name:  "sample",
+					Usage: "Discover info hashes stored in the DHT",
+					Description: "Sample walks the DHT with sample_infohashes requests, as " +
+						"described in BEP 51, querying every node heard of with a random " +
+						"target so that the whole keyspace is covered.\n\n" +
+						"   Each info hash is printed with the node that returned it as " +
+						"soon as it is discovered, as a line of JSON unless --format " +
+						"requires the whole walk to finish first. Nodes holding more info " +
+						"hashes than they return are queried again once the interval they " +
+						"ask for has elapsed. The walk ends once --limit info hashes are " +
+						"found or no nodes are left to query.",
+					Action: dht.Sample,
+					Flags: append([]cli.Flag{
 						cli.IntFlag{
-							Name:  "table_size, k",
-							Value: 8,
-							Usage: "Maximum number of nodes to keep in routing table: referenced as K value in BEP 5.",
+							Name:  "limit, l",
+							Usage: "Stop after discovering this many info hashes, 0 for no limit",
 						},
-					},
+					}, dhtFlags...),
+				},
+			},
+		},
+		cli.Command{
+			Name:  "key",
+			Usage: "Manage ed25519 keys for signing mutable DHT items.",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "generate",
+					Usage:     "Generate a keypair and write the private key to a file",
+					ArgsUsage: "file",
+					Description: "Generate creates an ed25519 keypair for signing mutable " +
+						"items, as described in BEP 44, writes the private key PEM " +
+						"encoded to file and prints the public key.\n\n" +
+						"   Existing files are never overwritten: mutable items can only be " +
+						"updated with the key they were signed with.",
+					Action: key.Generate,
+				},
+				cli.Command{
+					Name:      "show",
+					Usage:     "Print the public key of a private key file",
+					ArgsUsage: "file",
+					Action:    key.Show,
+				},
+			},
+		},
+		cli.Command{
+			Name:      "hash",
+			Usage:     "Print the info hash, name, size and files of a .torrent file.",
+			ArgsUsage: "file",
+			Description: "Hash computes the info hash of a torrent, the SHA-1 hash of " +
+				"its bencoded info dictionary exactly as it appears in the .torrent " +
+				"file, as described in BEP 3. The file is read from stdin if it " +
+				"is -.\n\n" +
+				"   The query and dht find_node, get_peers and announce_peer " +
+				"commands compute it themselves when given --torrent.",
+			Action: torrent.Hash,
+		},
+		cli.Command{
+			Name:      "decode",
+			Usage:     "Print a bencoded KRPC message, such as a captured datagram.",
+			ArgsUsage: "[datagram]",
+			Description: "Decode reads a bencoded KRPC message and prints it the way " +
+				"responses to queries are printed, with keys such as \"nodes\", " +
+				"\"nodes6\", \"values\" and \"samples\" expanded.\n\n" +
+				"   The message is read from the datagram argument, --file or stdin, " +
+				"in that order, as raw bytes, hex or base64.",
+			Action: codec.Decode,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, i",
+					Usage: "File to read the message from",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "encode",
+			Usage:     "Build a bencoded KRPC message from JSON.",
+			ArgsUsage: "[json]",
+			Description: "Encode reads a message in the JSON format messages are " +
+				"printed in and writes it bencoded, as it would be sent on the " +
+				"wire, or as a hex dump with --format raw.\n\n" +
+				"   Expanded keys such as \"nodes\" and \"values\" are encoded back " +
+				"into their compact form. Other strings are decoded from hex if 0x " +
+				"prefixed and taken literally otherwise.\n\n" +
+				"   The message is read from the json argument, --file or stdin, in " +
+				"that order.",
+			Action: codec.Encode,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, i",
+					Usage: "File to read the message from",
+				},
+			},
+		},
+		cli.Command{
+			Name:  "serve",
+			Usage: "Run a DHT node that answers queries from other nodes.",
+			Description: "Serve listens on a UDP port and answers 'ping', 'find_node', " +
+				"'get_peers' and 'announce_peer' queries as described in BEP 5, " +
+				"'get' and 'put' queries as described in BEP 44, and " +
+				"'sample_infohashes' queries as described in BEP 51.\n\n" +
+				"   Nodes that query us are added to our routing table, and peers " +
+				"announced to us are returned in response to later get_peers " +
+				"queries. Set --bootstrap to \"\" to run an isolated node.",
+			Action: serve.Serve,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "address, a",
+					Value: "",
+					Usage: "Address to listen on, all interfaces if unset",
+				},
+				cli.IntFlag{
+					Name:  "port, p",
+					Value: 6881,
+					Usage: "UDP port to listen on",
+				},
+				cli.StringFlag{
+					Name:  "bootstrap, b",
+					Value: "dht.libtorrent.org:25401",
+					Usage: "Bootstrap DHT node",
 				},
 			},
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		var kerr *pkgdht.KRPCError
+		if errors.As(err, &kerr) {
+			os.Exit(exitKRPCError)
+		}
+		os.Exit(1)
 	}
 }
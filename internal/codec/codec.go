@@ -0,0 +1,87 @@
+// Package codec contains handlers for the dhtcli decode and encode commands.
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/urfave/cli"
+	"io"
+	"os"
+	"strings"
+)
+
+// Decode prints a bencoded KRPC message, given raw or as hex or base64, the
+// way responses to queries are printed.
+func Decode(c *cli.Context) error {
+	b, err := input(c)
+	if err != nil {
+		return err
+	}
+	m, err := dht.DecodeMessage(b)
+	if err != nil {
+		d, ok := decodeText(string(b))
+		if !ok {
+			return err
+		}
+		if m, err = dht.DecodeMessage(d); err != nil {
+			return err
+		}
+	}
+	return format.Print(c, m)
+}
+
+// Encode prints the bencoded KRPC message described by JSON in the format
+// responses to queries are printed in.
+func Encode(c *cli.Context) error {
+	b, err := input(c)
+	if err != nil {
+		return err
+	}
+	m, err := dht.ParseMessage(b)
+	if err != nil {
+		return err
+	}
+	return format.PrintDatagram(c, m)
+}
+
+// input returns the command's argument, the contents of --file, or stdin if
+// neither is given.
+func input(c *cli.Context) ([]byte, error) {
+	file := c.String("file")
+	switch {
+	case c.NArg() > 1 || c.NArg() == 1 && file != "":
+		command := c.Command
+		return nil, fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	case c.NArg() == 1 && c.Args().Get(0) != "-":
+		return []byte(c.Args().Get(0)), nil
+	case file != "":
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading input: %v", err)
+		}
+		return b, nil
+	}
+	b, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("error reading input: %v", err)
+	}
+	return b, nil
+}
+
+// decodeText decodes hex, optionally 0x prefixed and split by whitespace, or
+// base64.
+func decodeText(s string) ([]byte, bool) {
+	s = strings.Join(strings.Fields(s), "")
+	if b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")); err == nil {
+		return b, true
+	}
+	for _, e := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := e.DecodeString(s); err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
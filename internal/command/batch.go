@@ -0,0 +1,134 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	"github.com/urfave/cli"
+)
+
+// DefaultConcurrency is how many lines --batch works on at once unless
+// --concurrency is set.
+const DefaultConcurrency = 8
+
+// record is what Batch prints for each line of input.
+type record struct {
+	Input  string      `json:"input"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Batch calls do with the fields of each non-empty line of stdin, up to
+// --concurrency lines at once, and prints each result in the format selected
+// by --format, tagged with the line it is for, in the order they complete.
+//
+// Lines are split on whitespace into at most n fields, the last of which
+// keeps any whitespace in the rest of the line. do must return a nil
+// interface, not a nil pointer, if it has no result. Stdin stops being read
+// once ctx is done, even mid-line. An error is returned if do failed for any
+// line.
+func Batch(ctx context.Context, c *cli.Context, n int, do func(ctx context.Context, args []string) (interface{}, error)) error {
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1, got %d", concurrency)
+	}
+	// Reads from stdin can't be interrupted, so they are left behind in their
+	// own goroutine once ctx is done.
+	input := make(chan string)
+	var readErr error
+	go func() {
+		defer close(input)
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			select {
+			case input <- s.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr = s.Err()
+	}()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	lines, failed := 0, 0
+	out := format.NewStream(c)
+	sem := make(chan struct{}, concurrency)
+	done := false
+	for !done {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-input:
+			done = !ok
+		case <-ctx.Done():
+			done = true
+		}
+		if line = strings.TrimSpace(line); done || line == "" {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			done = true
+			continue
+		}
+		lines++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			v, err := do(ctx, fields(line, n))
+			rec := &record{Input: line, Result: v}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			}
+			if err := out.Add(rec); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stopped reading input: %v", err)
+	}
+	if readErr != nil {
+		return fmt.Errorf("error reading input: %v", readErr)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d lines failed", failed, lines)
+	}
+	return nil
+}
+
+// fields splits s on whitespace into at most n fields, the last of which
+// keeps any whitespace in the rest of s.
+func fields(s string, n int) []string {
+	var f []string
+	for len(f) < n-1 {
+		s = strings.TrimLeft(s, " \t")
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			break
+		}
+		f = append(f, s[:i])
+		s = s[i:]
+	}
+	if s = strings.TrimSpace(s); s != "" {
+		f = append(f, s)
+	}
+	return f
+}
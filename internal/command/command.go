@@ -0,0 +1,128 @@
+// Package command contains helpers shared by dhtcli command handlers.
+package command
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/urfave/cli"
+)
+
+// captureKey is the key of the open --pcap file in the app's metadata.
+const captureKey = "capture"
+
+// capture is a --pcap file being written to.
+type capture struct {
+	f *os.File
+	c *dht.Capture
+}
+
+// Context returns a context that is cancelled on interrupt or once the global
+// --deadline elapses, if set.
+//
+// After the first interrupt, a second one kills the process as usual.
+func Context(c *cli.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	cancel := stop
+	if d := c.GlobalDuration("deadline"); d > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeout(ctx, d)
+		cancel = func() {
+			cancelDeadline()
+			stop()
+		}
+	}
+	return ctx, cancel
+}
+
+// NewDHT returns a DHT with the timeouts set by the global --timeout and
+// --retries flags, recording its traffic to --pcap if set.
+func NewDHT(c *cli.Context) (*dht.DHT, error) {
+	d, err := dht.New()
+	if err != nil {
+		return nil, err
+	}
+	// The CLI doesn't answer queries, so nodes shouldn't refer others to it.
+	d.ReadOnly = true
+	d.Timeout = c.GlobalDuration("timeout")
+	d.Retries = c.GlobalInt("retries")
+	if p, ok := c.App.Metadata[captureKey].(*capture); ok {
+		d.SetCapture(p.c)
+	}
+	return d, nil
+}
+
+// OpenCapture creates the global --pcap file, if set, for DHTs returned by
+// NewDHT to record their traffic to.
+func OpenCapture(c *cli.Context) error {
+	path := c.GlobalString("pcap")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating pcap file: %v", err)
+	}
+	dc, err := dht.NewCapture(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.App.Metadata[captureKey] = &capture{f, dc}
+	return nil
+}
+
+// CloseCapture closes the --pcap file opened by OpenCapture, if any.
+func CloseCapture(c *cli.Context) error {
+	p, ok := c.App.Metadata[captureKey].(*capture)
+	if !ok {
+		return nil
+	}
+	delete(c.App.Metadata, captureKey)
+	if err := p.f.Close(); err != nil {
+		return fmt.Errorf("error writing pcap file: %v", err)
+	}
+	return nil
+}
+
+// MagnetPeers returns the peers listed in the "x.pe" parameters of infoHash if
+// it is a magnet link, logging those whose addresses can't be resolved.
+func MagnetPeers(infoHash string) []dht.Peer {
+	if !dht.IsMagnet(infoHash) {
+		return nil
+	}
+	m, err := dht.ParseMagnet(infoHash)
+	if err != nil {
+		return nil
+	}
+	var peers []dht.Peer
+	for _, pe := range m.Peers {
+		addr, err := net.ResolveUDPAddr("udp", pe)
+		if err != nil {
+			log.Printf("Skipping magnet link peer %v: %v", pe, err)
+			continue
+		}
+		peers = append(peers, dht.Peer{UDPAddr: *addr})
+	}
+	return peers
+}
+
+// SkipV2 logs that only the v1 info hash of infoHash is used if it names a
+// hybrid torrent, which has a truncated v2 info hash as well.
+func SkipV2(infoHash string) {
+	hashes, err := dht.InfoHashes(infoHash)
+	if err != nil || len(hashes) < 2 {
+		return
+	}
+	log.Printf("Using v1 info hash 0x%x of hybrid torrent, skipping v2 info hash 0x%x.", hashes[0], hashes[1])
+}
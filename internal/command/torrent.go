@@ -0,0 +1,52 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/urfave/cli"
+)
+
+// TorrentResult is the result of a command run for the info hash of a
+// --torrent file, printed alongside the torrent's metainfo.
+type TorrentResult struct {
+	Torrent *dht.Torrent `json:"torrent"`
+	Result  interface{}  `json:"result"`
+}
+
+// LoadTorrent reads and parses the .torrent file at path, or stdin if path is
+// "-".
+func LoadTorrent(path string) (*dht.Torrent, error) {
+	var b []byte
+	var err error
+	if path == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading torrent: %v", err)
+	}
+	return dht.ParseTorrent(b)
+}
+
+// Torrent returns the metainfo of the command's --torrent file, or nil if it
+// isn't set.
+func Torrent(c *cli.Context) (*dht.Torrent, error) {
+	path := c.String("torrent")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadTorrent(path)
+}
+
+// WithTorrent returns v alongside the metainfo of t, or v itself if t is nil.
+// It keeps a nil interface nil.
+func WithTorrent(t *dht.Torrent, v interface{}) interface{} {
+	if t == nil || v == nil {
+		return v
+	}
+	return &TorrentResult{t, v}
+}
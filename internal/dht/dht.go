@@ -2,39 +2,446 @@
 package dht
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"github.com/jeanralphaviles/dhtcli/internal/command"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	keys "github.com/jeanralphaviles/dhtcli/internal/key"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
 	"github.com/jeanralphaviles/dhtcli/pkg/queryprocessor"
 	"github.com/urfave/cli"
+	"log"
 	"net"
+	"sync"
 )
 
 // FindNode searches the BitTorrent DHT for the contact information of a target node.
 func FindNode(c *cli.Context) error {
+	return lookup(c, func(ctx context.Context, q *queryprocessor.QueryProcessor, target string) (interface{}, error) {
+		resp, err := q.FindNodeContext(ctx, target)
+		if resp == nil {
+			return nil, err
+		}
+		return resp, err
+	})
+}
+
+// GetPeers searches the BitTorrent DHT for peers of a torrent.
+//
+// Hybrid torrents, as defined in BEP 52, are looked up by both their v1 and
+// truncated v2 info hashes at once, and the peers found for each are merged.
+// With --probe, each peer found is then probed over the peer wire protocol.
+func GetPeers(c *cli.Context) error {
+	if t := c.Duration("probe_timeout"); c.Bool("probe") && t <= 0 {
+		return fmt.Errorf("--probe_timeout must be positive, got %v", t)
+	}
+	return lookup(c, func(ctx context.Context, q *queryprocessor.QueryProcessor, infoHash string) (interface{}, error) {
+		hashes, err := dht.InfoHashes(infoHash)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]*queryprocessor.PeersResult, len(hashes))
+		errs := make([]error, len(hashes))
+		var wg sync.WaitGroup
+		for i, h := range hashes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], errs[i] = q.GetPeersContext(ctx, fmt.Sprintf("%x", h))
+			}()
+		}
+		wg.Wait()
+		var found []*queryprocessor.PeersResult
+		for i, r := range results {
+			if r != nil {
+				found = append(found, r)
+			} else if len(hashes) > 1 {
+				log.Printf("Error looking up info hash 0x%x: %v", hashes[i], errs[i])
+			}
+		}
+		err = errs[0]
+		if len(hashes) > 1 {
+			err = errors.Join(errs...)
+		}
+		if len(found) == 0 {
+			return nil, err
+		}
+		magnet := command.MagnetPeers(infoHash)
+		if len(hashes) == 1 {
+			r := found[0]
+			if len(magnet) > 0 {
+				n := r.AddPeers(magnet)
+				log.Printf("Added %d of %d peers from the magnet link.", n, len(magnet))
+			}
+			if c.Bool("probe") {
+				peerHashes := make([]string, len(r.Peers))
+				for i := range peerHashes {
+					peerHashes[i] = r.InfoHash
+				}
+				r.Probes = probePeers(ctx, c, r.Peers, peerHashes)
+			}
+			return r, err
+		}
+		r := queryprocessor.MergePeers(found...)
+		if len(magnet) > 0 {
+			n := r.AddPeers(magnet)
+			log.Printf("Added %d of %d peers from the magnet link.", n, len(magnet))
+		}
+		if c.Bool("probe") {
+			var peers []dht.Peer
+			var peerHashes []string
+			for _, p := range r.Peers() {
+				// Peers found for both info hashes are probed for the first,
+				// and those only in the magnet link for the v1 info hash.
+				h := hashes[0]
+				if len(p.InfoHashes) > 0 {
+					h = p.InfoHashes[0]
+				}
+				peers = append(peers, p.Peer)
+				peerHashes = append(peerHashes, h)
+			}
+			r.Probes = probePeers(ctx, c, peers, peerHashes)
+		}
+		return r, err
+	})
+}
+
+// lookup runs do for the command's target argument and prints its result,
+// which may be partial if do fails. do must return a nil interface, not a nil
+// pointer, if it has no result.
+//
+// With --torrent, the torrent's info hash is looked up instead and the result
+// is printed alongside its metainfo. With --batch, targets are instead read
+// from stdin, one per line, and looked up concurrently by a single
+// QueryProcessor.
+func lookup(c *cli.Context, do func(ctx context.Context, q *queryprocessor.QueryProcessor, target string) (interface{}, error)) error {
+	target, torrent, err := targetArg(c)
+	if err != nil {
+		return err
+	}
+	batch := c.Bool("batch")
+	if batch && torrent != nil {
+		return fmt.Errorf("--torrent can't be used with --batch")
+	}
+	if batch && c.NArg() != 0 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer closeQueryProcessor(c, q)
+	if batch {
+		return command.Batch(ctx, c, 1, func(ctx context.Context, args []string) (interface{}, error) {
+			return do(ctx, q, args[0])
+		})
+	}
+	resp, err := do(ctx, q, target)
+	if resp == nil {
+		return err
+	}
+	if perr := format.Print(c, command.WithTorrent(torrent, resp)); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// targetArg returns a magnet link to the command's --torrent file, along with
+// its metainfo, or else the command's only argument.
+func targetArg(c *cli.Context) (string, *dht.Torrent, error) {
+	torrent, err := command.Torrent(c)
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case torrent != nil && c.NArg() == 0:
+		return torrent.Magnet(), torrent, nil
+	case torrent == nil && (c.NArg() == 1 || c.Bool("batch")):
+		return c.Args().Get(0), nil, nil
+	}
+	command := c.Command
+	return "", nil, fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+}
+
+// Scrape estimates the number of seeders and leechers of a torrent from the
+// bloom filters returned by nodes in the BitTorrent DHT.
+func Scrape(c *cli.Context) error {
 	if c.NArg() != 1 {
 		command := c.Command
 		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
 	}
-	bootstrap, err := resolveBootstrap(c)
+	command.SkipV2(c.Args().Get(0))
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
 	if err != nil {
 		return err
 	}
-	q, err := queryprocessor.New(*bootstrap, c.Int("table_size"))
+	defer closeQueryProcessor(c, q)
+	resp, err := q.ScrapeContext(ctx, c.Args().Get(0))
+	if err != nil && resp == nil {
+		return err
+	}
+	if perr := format.Print(c, resp); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// AnnouncePeer announces ourselves as a peer of a torrent to the closest nodes in the BitTorrent DHT.
+func AnnouncePeer(c *cli.Context) error {
+	infoHash, torrent, err := targetArg(c)
 	if err != nil {
 		return err
 	}
-	target := c.Args().Get(0)
-	resp, err := q.FindNode(target)
+	command.SkipV2(infoHash)
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%v\n", resp)
+	defer closeQueryProcessor(c, q)
+	resp, err := q.AnnouncePeerContext(ctx, infoHash, c.Int("port"))
+	if err != nil && resp == nil {
+		return err
+	}
+	if perr := format.Print(c, command.WithTorrent(torrent, resp)); perr != nil {
+		return perr
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Accepted) == 0 {
+		return fmt.Errorf("no nodes accepted the announce")
+	}
 	return nil
 }
 
-func resolveBootstrap(c *cli.Context) (*net.UDPAddr, error) {
-	bootstrap, err := net.ResolveUDPAddr("udp", c.String("bootstrap"))
+// newQueryProcessor returns a QueryProcessor bootstrapped into the DHT of the
+// address families selected by --family, giving up on the bootstrap nodes once
+// ctx is done.
+func newQueryProcessor(ctx context.Context, c *cli.Context) (*queryprocessor.QueryProcessor, error) {
+	var bootstraps []*net.UDPAddr
+	var want []string
+	switch f := c.String("family"); f {
+	case "4", "6", "both":
+		if f != "6" {
+			b, err := resolveBootstrap(c.String("bootstrap"), "udp4")
+			if err != nil {
+				return nil, err
+			}
+			bootstraps = append(bootstraps, b)
+			want = append(want, dht.WantIPv4)
+		}
+		if f != "4" {
+			b, err := resolveBootstrap(c.String("bootstrap6"), "udp6")
+			if err != nil {
+				return nil, err
+			}
+			bootstraps = append(bootstraps, b)
+			want = append(want, dht.WantIPv6)
+		}
+	default:
+		return nil, fmt.Errorf("--family must be one of 4, 6 or both, got %q", f)
+	}
+	var security queryprocessor.Security
+	switch s := c.String("secure"); s {
+	case "off":
+		security = queryprocessor.SecurityOff
+	case "prefer":
+		security = queryprocessor.SecurityPrefer
+	case "require":
+		security = queryprocessor.SecurityRequire
+	default:
+		return nil, fmt.Errorf("--secure must be one of off, prefer or require, got %q", s)
+	}
+	if a := c.Int("alpha"); a < 1 {
+		return nil, fmt.Errorf("--alpha must be at least 1, got %d", a)
+	}
+	d, err := command.NewDHT(c)
+	if err != nil {
+		return nil, fmt.Errorf("error creating DHT object: %v", err)
+	}
+	q, err := loadState(c.String("state"), d, c.Int("table_size"))
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	if q == nil {
+		if q, err = queryprocessor.NewWithDHT(ctx, d, *bootstraps[0], c.Int("table_size")); err != nil {
+			return nil, err
+		}
+		bootstraps = bootstraps[1:]
+	}
+	for _, b := range bootstraps {
+		if err := q.AddBootstrapContext(ctx, *b); err != nil {
+			// Lookups can start from the saved routing table instead.
+			if q.Table().Len()+q.Table6().Len() > 0 {
+				log.Printf("Skipping bootstrap node: %v", err)
+				continue
+			}
+			q.Close()
+			return nil, err
+		}
+	}
+	q.SetWant(want)
+	q.SetSecurity(security)
+	q.SetAlpha(c.Int("alpha"))
+	return q, nil
+}
+
+func resolveBootstrap(addr, network string) (*net.UDPAddr, error) {
+	bootstrap, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("error resolving bootstrap node: %v", err)
 	}
 	return bootstrap, err
 }
+
+// Get searches the BitTorrent DHT for an item stored under a target, or for
+// the mutable item signed by --pubkey with --salt.
+func Get(c *cli.Context) error {
+	pubkey := c.String("pubkey")
+	if pubkey == "" && c.NArg() != 1 || pubkey != "" && c.NArg() != 0 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer closeQueryProcessor(c, q)
+	var resp *queryprocessor.ItemResult
+	if pubkey != "" {
+		k, err := dht.EncodePublicKey(pubkey)
+		if err != nil {
+			return err
+		}
+		resp, err = q.GetMutableContext(ctx, k, []byte(c.String("salt")))
+	} else {
+		resp, err = q.GetContext(ctx, c.Args().Get(0))
+	}
+	if err != nil && resp == nil {
+		return err
+	}
+	if perr := format.Print(c, resp); perr != nil {
+		return perr
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Item == nil {
+		return fmt.Errorf("no item found")
+	}
+	return nil
+}
+
+// Put stores an item on the closest nodes to its target in the BitTorrent DHT.
+//
+// With --mutable, the item is signed with the private key in --key. Unless
+// --seq is set, the sequence number following that of the item currently
+// stored is used.
+func Put(c *cli.Context) error {
+	if c.NArg() != 1 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	var item *dht.Item
+	var err error
+	if v := c.Args().Get(0); c.Bool("bencoded") {
+		item, err = dht.DecodeItem([]byte(v))
+	} else {
+		item, err = dht.NewItem(v)
+	}
+	if err != nil {
+		return err
+	}
+	mutable := c.Bool("mutable")
+	if !mutable && (c.IsSet("key") || c.IsSet("salt") || c.IsSet("seq") || c.IsSet("cas")) {
+		return fmt.Errorf("--key, --salt, --seq and --cas require --mutable")
+	}
+	if c.IsSet("cas") && !c.IsSet("seq") {
+		return fmt.Errorf("--cas requires --seq")
+	}
+	var key ed25519.PrivateKey
+	salt := []byte(c.String("salt"))
+	if mutable {
+		if key, err = keys.Load(c.String("key")); err != nil {
+			return err
+		}
+	}
+	if c.IsSet("seq") {
+		if item, err = dht.NewMutableItem(item.V, key, salt, c.Int64("seq")); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer closeQueryProcessor(c, q)
+	var resp *queryprocessor.PutResult
+	switch {
+	case c.IsSet("cas"):
+		resp, err = q.PutCASContext(ctx, item, c.Int64("cas"))
+	case mutable && !c.IsSet("seq"):
+		resp, err = q.PutMutableContext(ctx, item.V, key, salt)
+	default:
+		resp, err = q.PutContext(ctx, item)
+	}
+	if err != nil && resp == nil {
+		return err
+	}
+	if perr := format.Print(c, resp); perr != nil {
+		return perr
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Accepted) == 0 {
+		return fmt.Errorf("no nodes accepted the item")
+	}
+	return nil
+}
+
+// Sample walks the BitTorrent DHT with sample_infohashes queries, printing
+// each info hash discovered as soon as it is found if --format allows.
+func Sample(c *cli.Context) error {
+	if c.NArg() != 0 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	limit := c.Int("limit")
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	q, err := newQueryProcessor(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer closeQueryProcessor(c, q)
+	found := 0
+	s := format.NewStream(c)
+	err = q.SampleContext(ctx, func(r queryprocessor.SampleResult) bool {
+		if err := s.Add(&r); err != nil {
+			log.Print(err)
+			return true
+		}
+		found++
+		return limit <= 0 || found < limit
+	})
+	log.Printf("Found %d info hashes.", found)
+	if cerr := s.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
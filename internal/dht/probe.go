@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/jeanralphaviles/dhtcli/pkg/queryprocessor"
+	"github.com/urfave/cli"
+	"log"
+	"net"
+	"sync"
+)
+
+// probeConcurrency is how many peers --probe connects to at once.
+const probeConcurrency = 16
+
+// probePeers probes each of peers over the peer wire protocol for the info
+// hash, at the same index of infoHashes, it was found for, giving up on each
+// after --probe_timeout. The outcomes are keyed by peer address.
+func probePeers(ctx context.Context, c *cli.Context, peers []dht.Peer, infoHashes []string) map[string]queryprocessor.Probe {
+	timeout := c.Duration("probe_timeout")
+	probes := make(map[string]queryprocessor.Probe, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probeConcurrency)
+	for i, p := range peers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			addr := net.TCPAddr{IP: p.UDPAddr.IP, Port: p.UDPAddr.Port, Zone: p.UDPAddr.Zone}
+			// Each probe is a connection of its own, with its own peer id.
+			var info *dht.PeerInfo
+			id, err := dht.NewPeerID()
+			if err == nil {
+				info, err = dht.ProbePeer(ctx, addr, fmt.Sprintf("%x", infoHashes[i]), id, timeout)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			probes[p.UDPAddr.String()] = queryprocessor.Probe{Info: info, Err: err}
+		}()
+	}
+	wg.Wait()
+	seeders, leechers, unknown := 0, 0, 0
+	for _, p := range probes {
+		switch {
+		case p.Err != nil:
+		case p.Info.Status == dht.StatusSeeder:
+			seeders++
+		case p.Info.Status == dht.StatusLeecher:
+			leechers++
+		default:
+			unknown++
+		}
+	}
+	log.Printf("Probed %d peers: %d seeders, %d leechers, %d unknown and %d failed.", len(probes), seeders, leechers, unknown, len(probes)-seeders-leechers-unknown)
+	return probes
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/jeanralphaviles/dhtcli/pkg/queryprocessor"
+	"github.com/urfave/cli"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DefaultStatePath returns where --state is saved unless set otherwise, under
+// the user's cache directory, or "" if there is none.
+func DefaultStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dhtcli", "state.json")
+}
+
+// loadState returns a QueryProcessor issuing queries through d restored from
+// the state file at path, or nil if path is empty or there is no usable state
+// file there.
+func loadState(path string, d *dht.DHT, k int) (*queryprocessor.QueryProcessor, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+	s, err := queryprocessor.ParseState(b)
+	if err != nil {
+		// The state is only a head start, begin afresh instead.
+		log.Printf("Ignoring state file %v: %v", path, err)
+		return nil, nil
+	}
+	return queryprocessor.NewFromStateWithDHT(s, d, k)
+}
+
+// saveState writes the state of q to the state file at path, unless path is
+// empty.
+func saveState(path string, q *queryprocessor.QueryProcessor) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(q.State(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating state directory: %v", err)
+	}
+	// Write to a temporary file first so that concurrent runs never see a
+	// partially written state file.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	return nil
+}
+
+// closeQueryProcessor logs how the queries issued by q fared, saves its
+// state to --state and closes it.
+func closeQueryProcessor(c *cli.Context, q *queryprocessor.QueryProcessor) {
+	if s := q.Stats(); s.Queried > 0 {
+		log.Printf("Queried %d nodes: %d responded, %d replied with errors and %d timed out.", s.Queried, s.Responded, s.Errors, s.TimedOut)
+	}
+	if err := saveState(c.String("state"), q); err != nil {
+		log.Print(err)
+	}
+	q.Close()
+}
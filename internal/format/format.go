@@ -0,0 +1,389 @@
+// Package format prints command results in the format selected by the global
+// --format flag.
+package format
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/urfave/cli"
+	"github.com/zeebo/bencode"
+)
+
+// Output formats.
+const (
+	// Pretty is indented JSON.
+	Pretty = "pretty"
+	// JSON is compact JSON, with streamed results collected into an array.
+	JSON = "json"
+	// NDJSON is compact JSON, one result per line as it is found.
+	NDJSON = "ndjson"
+	// Table is aligned columns of nodes and peers, for humans.
+	Table = "table"
+	// Bencode is raw bencoded bytes. Messages are printed as the datagrams
+	// sent on the wire.
+	Bencode = "bencode"
+	// Raw is a hex dump of the bencoded bytes.
+	Raw = "raw"
+)
+
+// Check returns an error if f isn't a known format.
+func Check(f string) error {
+	switch f {
+	case Pretty, JSON, NDJSON, Table, Bencode, Raw:
+		return nil
+	}
+	return fmt.Errorf("--format must be one of pretty, json, ndjson, table, bencode or raw, got %q", f)
+}
+
+// Print writes v to stdout in the format selected by --format.
+func Print(c *cli.Context, v interface{}) error {
+	return write(os.Stdout, c.GlobalString("format"), v)
+}
+
+// PrintDatagram writes the bencoded bytes of m to stdout as they would be
+// sent on the wire, as a hex dump if --format is raw.
+func PrintDatagram(c *cli.Context, m *dht.Message) error {
+	f := Bencode
+	if c.GlobalString("format") == Raw {
+		f = Raw
+	}
+	return write(os.Stdout, f, m)
+}
+
+// write writes v to w in format f.
+func write(w io.Writer, f string, v interface{}) error {
+	switch f {
+	case Pretty, "":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling result: %v", err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case JSON, NDJSON:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error marshalling result: %v", err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case Table:
+		o, err := decode(v)
+		if err != nil {
+			return err
+		}
+		return writeTable(w, o)
+	case Bencode, Raw:
+		b, err := encode(v)
+		if err != nil {
+			return err
+		}
+		if f == Raw {
+			_, err = io.WriteString(w, hex.Dump(b))
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return Check(f)
+}
+
+// Stream prints a sequence of results, such as those of a walk, in the format
+// selected by --format.
+//
+// Results are printed as they are added in the pretty and ndjson formats,
+// one compact JSON document per line. Other formats can only be printed once
+// every result is known, so they are printed by Close.
+type Stream struct {
+	w       io.Writer
+	f       string
+	results []interface{}
+}
+
+// NewStream returns a Stream writing to stdout.
+func NewStream(c *cli.Context) *Stream {
+	return &Stream{w: os.Stdout, f: c.GlobalString("format")}
+}
+
+// Add prints v, or holds on to it until Close.
+func (s *Stream) Add(v interface{}) error {
+	switch s.f {
+	case Pretty, NDJSON, "":
+		return write(s.w, NDJSON, v)
+	}
+	s.results = append(s.results, v)
+	return nil
+}
+
+// Close prints the results held on to by Add.
+func (s *Stream) Close() error {
+	switch s.f {
+	case Pretty, NDJSON, "":
+		return nil
+	}
+	results := s.results
+	if results == nil {
+		results = []interface{}{}
+	}
+	return write(s.w, s.f, results)
+}
+
+// decode returns the JSON encoding of v decoded into ordered objects, arrays,
+// strings, json.Numbers, bools and nils.
+func decode(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling result: %v", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return decodeValue(d)
+}
+
+// object is a JSON object that remembers the order of its keys.
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func decodeValue(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding result: %v", err)
+	}
+	switch t {
+	case json.Delim('{'):
+		o := &object{values: make(map[string]interface{})}
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return nil, fmt.Errorf("error decoding result: %v", err)
+			}
+			v, err := decodeValue(d)
+			if err != nil {
+				return nil, err
+			}
+			o.keys = append(o.keys, k.(string))
+			o.values[k.(string)] = v
+		}
+		_, err := d.Token()
+		return o, err
+	case json.Delim('['):
+		a := []interface{}{}
+		for d.More() {
+			v, err := decodeValue(d)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		_, err := d.Token()
+		return a, err
+	}
+	return t, nil
+}
+
+// encode returns the bencoding of v. Messages are encoded as they are sent
+// on the wire, anything else as its JSON encoding would be, with byte strings
+// decoded back from the hex they are marshalled to.
+func encode(v interface{}) ([]byte, error) {
+	if m, ok := v.(*dht.Message); ok {
+		b, err := bencode.EncodeBytes(m)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding message: %v", err)
+		}
+		return b, nil
+	}
+	o, err := decode(v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bencode.EncodeBytes(bencodable(o))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding result: %v", err)
+	}
+	return b, nil
+}
+
+// bencodable translates a decoded JSON value into one that can be bencoded.
+// Bencode has no booleans, nulls or fractions, so those become integers and
+// strings. Strings of hex prefixed with "0x", as byte strings such as ids and
+// hashes are marshalled to JSON, become the bytes they encode.
+func bencodable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *object:
+		m := make(map[string]interface{}, len(v.keys))
+		for _, k := range v.keys {
+			if v.values[k] != nil {
+				m[k] = bencodable(v.values[k])
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i := range v {
+			l[i] = bencodable(v[i])
+		}
+		return l
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		return v.String()
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case nil:
+		return ""
+	case string:
+		if strings.HasPrefix(v, "0x") {
+			if b, err := hex.DecodeString(v[2:]); err == nil {
+				return string(b)
+			}
+		}
+	}
+	return v
+}
+
+// writeTable writes the scalar fields of a decoded JSON value as aligned key
+// value pairs, then each list in it as aligned columns.
+//
+// Nested objects are flattened, their keys joined with dots.
+func writeTable(w io.Writer, v interface{}) error {
+	var fields [][2]string
+	var lists []list
+	flatten("", v, &fields, &lists)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, f := range fields {
+		fmt.Fprintf(tw, "%s\t%s\n", f[0], f[1])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for i, l := range lists {
+		if i > 0 || len(fields) > 0 {
+			fmt.Fprintln(w)
+		}
+		if l.name != "" {
+			fmt.Fprintf(w, "%s (%d)\n", l.name, len(l.items))
+		}
+		columns := l.columns()
+		if len(columns) > 0 {
+			header := make([]string, len(columns))
+			for j, c := range columns {
+				header[j] = strings.ToUpper(c)
+			}
+			fmt.Fprintln(tw, strings.Join(header, "\t"))
+		}
+		for _, item := range l.items {
+			o, ok := item.(*object)
+			if !ok {
+				fmt.Fprintln(tw, cell(item))
+				continue
+			}
+			row := make([]string, len(columns))
+			for j, c := range columns {
+				row[j] = cell(o.values[c])
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list is a JSON array found while flattening a value for writeTable.
+type list struct {
+	name  string
+	items []interface{}
+}
+
+// columns returns the keys of the objects in the list, in the order they are
+// first seen.
+func (l list) columns() []string {
+	var columns []string
+	seen := make(map[string]bool)
+	for _, item := range l.items {
+		if o, ok := item.(*object); ok {
+			for _, k := range o.keys {
+				if !seen[k] {
+					seen[k] = true
+					columns = append(columns, k)
+				}
+			}
+		}
+	}
+	return columns
+}
+
+func flatten(prefix string, v interface{}, fields *[][2]string, lists *[]list) {
+	switch v := v.(type) {
+	case *object:
+		keys := v.keys
+		if keys == nil {
+			// Keep the output stable for objects built without order.
+			for k := range v.values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+		}
+		for _, k := range keys {
+			name := k
+			if prefix != "" {
+				name = prefix + "." + k
+			}
+			flatten(name, v.values[k], fields, lists)
+		}
+	case []interface{}:
+		*lists = append(*lists, list{prefix, v})
+	default:
+		*fields = append(*fields, [2]string{prefix, cell(v)})
+	}
+}
+
+// cell renders a decoded JSON value for a single table cell.
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		return v
+	case *object, []interface{}:
+		b, _ := json.Marshal(plain(v))
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// plain translates a decoded JSON value back into one encoding/json can
+// marshal.
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *object:
+		m := make(map[string]interface{}, len(v.keys))
+		for k, x := range v.values {
+			m[k] = plain(x)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i := range v {
+			l[i] = plain(v[i])
+		}
+		return l
+	}
+	return v
+}
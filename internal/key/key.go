@@ -0,0 +1,72 @@
+// Package key contains handlers for dhtcli key commands.
+package key
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/urfave/cli"
+	"os"
+)
+
+// Generate creates an ed25519 keypair for signing mutable items, writes the
+// private key to a file and prints the public key.
+func Generate(c *cli.Context) error {
+	if c.NArg() != 1 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	b, err := dht.MarshalKey(key)
+	if err != nil {
+		return err
+	}
+	// Never overwrite a key, items signed with it could no longer be updated.
+	f, err := os.OpenFile(c.Args().Get(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating key file: %v", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing key file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing key file: %v", err)
+	}
+	return printPublicKey(c, key)
+}
+
+// Show prints the public key of the private key in a file.
+func Show(c *cli.Context) error {
+	if c.NArg() != 1 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	key, err := Load(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return printPublicKey(c, key)
+}
+
+// Load reads an ed25519 private key from a file written by Generate.
+func Load(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %v", err)
+	}
+	return dht.ParseKey(b)
+}
+
+func printPublicKey(c *cli.Context, key ed25519.PrivateKey) error {
+	return format.Print(c, struct {
+		PublicKey string `json:"public_key"`
+	}{
+		fmt.Sprintf("0x%x", []byte(key.Public().(ed25519.PublicKey))),
+	})
+}
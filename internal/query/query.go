@@ -2,7 +2,11 @@
 package query
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
+	"github.com/jeanralphaviles/dhtcli/internal/command"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
 	"github.com/jeanralphaviles/dhtcli/pkg/dht"
 	"github.com/urfave/cli"
 	"log"
@@ -11,68 +15,44 @@ import (
 
 // Ping issues a "ping" query to a DHT node and prints its response.
 func Ping(c *cli.Context) error {
-	if c.NArg() != 1 {
-		command := c.Command
-		return fmt.Errorf("%v: %v", command.FullName(), c.Command.ArgsUsage)
-	}
-	server, err := net.ResolveUDPAddr("udp", c.Args().Get(0))
-	if err != nil {
-		return err
-	}
-	d, err := dht.New()
-	if err != nil {
-		return err
-	}
-	resp, err := d.Ping(*server)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%v\n", resp)
-	return nil
+	return run(c, 0, 0, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		return d.PingContext(ctx, server)
+	})
 }
 
 // FindNode issues a "find_node" query to a DHT node and prints its response.
 func FindNode(c *cli.Context) error {
-	if c.NArg() != 2 {
-		command := c.Command
-		return fmt.Errorf("%v: %v", command.FullName(), c.Command.ArgsUsage)
-	}
-	server, err := net.ResolveUDPAddr("udp", c.Args().Get(0))
-	if err != nil {
-		return err
-	}
-	d, err := dht.New()
-	if err != nil {
-		return err
-	}
-	resp, err := d.FindNode(*server, c.Args().Get(1))
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%v\n", resp)
-	return nil
+	return run(c, 1, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		return d.FindNodeContext(ctx, server, args[0])
+	})
 }
 
 // GetPeers issues a "get_peers" query to a DHT node and prints its response.
 func GetPeers(c *cli.Context) error {
-	if c.NArg() != 2 {
-		command := c.Command
-		return fmt.Errorf("%v: %v", command.FullName(), c.Command.ArgsUsage)
-	}
-	server, err := net.ResolveUDPAddr("udp", c.Args().Get(0))
-	if err != nil {
-		return err
-	}
-	d, err := dht.New()
-	if err != nil {
-		return err
-	}
-	resp, err := d.GetPeers(*server, c.Args().Get(1))
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%v\n", resp)
-	return nil
+	if c.Bool("noseed") && !c.Bool("scrape") {
+		return fmt.Errorf("--noseed requires --scrape")
+	}
+	return run(c, 1, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		command.SkipV2(args[0])
+		var resp *dht.Message
+		var err error
+		if c.Bool("scrape") {
+			resp, err = d.ScrapeContext(ctx, server, args[0], c.Bool("noseed"))
+		} else {
+			resp, err = d.GetPeersContext(ctx, server, args[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if peers := command.MagnetPeers(args[0]); len(peers) > 0 {
+			n, err := resp.AddValues(peers)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Added %d of %d peers from the magnet link.", n, len(peers))
+		}
+		return resp, nil
+	})
 }
 
 // AnnouncePeer issues an "announce_peer" request to a DHT node and prints its response.
@@ -81,40 +61,186 @@ func GetPeers(c *cli.Context) error {
 // token received from a previous "get_peers" request. If a token is not
 // specified, a GetPeers request will be issued to obtain one.
 func AnnouncePeer(c *cli.Context) error {
-	if c.NArg() != 2 {
-		command := c.Command
-		return fmt.Errorf("%v: %v", command.FullName(), c.Command.ArgsUsage)
-	}
-	server, err := net.ResolveUDPAddr("udp", c.Args().Get(0))
+	return run(c, 1, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		hash := args[0]
+		command.SkipV2(hash)
+		token := c.String("token")
+		if token == "" {
+			log.Print("--token not specified, issuing get_peers request first to obtain one.")
+			resp, err := d.GetPeersContext(ctx, server, hash)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			token, ok = resp.Response["token"].(string)
+			if !ok {
+				return nil, fmt.Errorf("token not present in response: %v", resp)
+			}
+			// d.AnnouncePeer expects token as a hex string.
+			token = fmt.Sprintf("%x", token)
+			log.Printf("Got token 0x%v.", token)
+		}
+		return d.AnnouncePeerContext(ctx, server, hash, token, c.Int("port"))
+	})
+}
+
+// Get issues a "get" query for a stored item to a DHT node and prints its response.
+func Get(c *cli.Context) error {
+	return run(c, 1, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		return d.GetContext(ctx, server, args[0])
+	})
+}
+
+// Put issues a "put" query storing an immutable item on a DHT node and prints its response.
+//
+// If a token is not specified, a Get request will be issued to obtain one.
+func Put(c *cli.Context) error {
+	return run(c, 1, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		var item *dht.Item
+		var err error
+		if v := args[0]; c.Bool("bencoded") {
+			item, err = dht.DecodeItem([]byte(v))
+		} else {
+			item, err = dht.NewItem(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		target, err := item.Target()
+		if err != nil {
+			return nil, err
+		}
+		token := c.String("token")
+		if token == "" {
+			log.Print("--token not specified, issuing get request first to obtain one.")
+			resp, err := d.GetContext(ctx, server, fmt.Sprintf("%x", target))
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			token, ok = resp.Response["token"].(string)
+			if !ok {
+				return nil, fmt.Errorf("token not present in response: %v", resp)
+			}
+			// d.Put expects token as a hex string.
+			token = fmt.Sprintf("%x", token)
+			log.Printf("Got token 0x%v.", token)
+		}
+		log.Printf("Storing item under target 0x%x.", target)
+		return d.PutContext(ctx, server, token, item)
+	})
+}
+
+// SampleInfohashes issues a "sample_infohashes" query to a DHT node and
+// prints its response. If no target is given, a random one is used.
+func SampleInfohashes(c *cli.Context) error {
+	return run(c, 0, 1, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		var target string
+		if len(args) > 0 {
+			target = args[0]
+		} else {
+			t := make([]byte, 20)
+			if _, err := rand.Read(t); err != nil {
+				return nil, err
+			}
+			target = fmt.Sprintf("%x", t)
+		}
+		return d.SampleInfohashesContext(ctx, server, target)
+	})
+}
+
+// Raw issues a query that dhtcli doesn't model, calling method with the
+// arguments given as a JSON object, to a DHT node and prints its response.
+//
+// With --dry-run, the bencoded query is printed instead of being sent, which
+// can't be interleaved with the results of --batch.
+func Raw(c *cli.Context) error {
+	dryRun := c.Bool("dry-run")
+	if dryRun && c.Bool("batch") {
+		return fmt.Errorf("--dry-run can't be used with --batch")
+	}
+	return run(c, 1, 2, func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error) {
+		a := map[string]interface{}{}
+		if len(args) > 1 {
+			var err error
+			if a, err = dht.ParseArguments([]byte(args[1])); err != nil {
+				return nil, err
+			}
+		}
+		req, err := d.NewQuery(args[0], a)
+		if err != nil {
+			return nil, err
+		}
+		if dryRun {
+			return nil, format.PrintDatagram(c, req)
+		}
+		return d.QueryContext(ctx, server, req)
+	})
+}
+
+// run issues a query with do to the DHT node whose host:port is the first of
+// the command's arguments, given the rest, of which there are between min and
+// max, and prints its response. A response do returns alongside an error,
+// such as an error reply, is printed as well.
+//
+// With --torrent, a magnet link to the torrent is given as the last argument
+// instead, and the response is printed alongside its metainfo. With --batch,
+// the arguments are instead read from stdin, one set per line, and the
+// queries are issued concurrently through a single DHT; the torrent can't
+// then be read from stdin too.
+func run(c *cli.Context, min, max int, do func(ctx context.Context, d *dht.DHT, server net.UDPAddr, args []string) (*dht.Message, error)) error {
+	batch := c.Bool("batch")
+	if batch && c.String("torrent") == "-" {
+		return fmt.Errorf("--torrent - can't be used with --batch")
+	}
+	torrent, err := command.Torrent(c)
 	if err != nil {
 		return err
 	}
-	hash := c.Args().Get(1)
-	d, err := dht.New()
+	if torrent != nil {
+		min, max = min-1, max-1
+	}
+	if batch && c.NArg() != 0 || !batch && (c.NArg() < min+1 || c.NArg() > max+1) {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), c.Command.ArgsUsage)
+	}
+	d, err := command.NewDHT(c)
 	if err != nil {
 		return err
 	}
-	token := c.String("token")
-	if token == "" {
-		log.Print("--token not specified, issuing get_peers request first to obtain one.")
-		resp, err := d.GetPeers(*server, hash)
+	defer d.Close()
+	d.Want = c.StringSlice("want")
+	ctx, cancel := command.Context(c)
+	defer cancel()
+	query := func(ctx context.Context, args []string) (*dht.Message, error) {
+		if len(args) < min+1 || len(args) > max+1 {
+			return nil, fmt.Errorf("expected %v", c.Command.ArgsUsage)
+		}
+		server, err := net.ResolveUDPAddr("udp", args[0])
 		if err != nil {
-			return err
+			return nil, err
 		}
-		var ok bool
-		token, ok = resp.Response["token"].(string)
-		if !ok {
-			return fmt.Errorf("token not present in response: %v", resp)
+		args = args[1:]
+		if torrent != nil {
+			args = append(args, torrent.Magnet())
 		}
-		// d.AnnouncePeer expects token as a hex string.
-		token = fmt.Sprintf("%x", token)
-		log.Printf("Got token 0x%v.", token)
-	}
-	port := c.Int("port")
-	resp, err := d.AnnouncePeer(*server, hash, token, port)
-	if err != nil {
+		return do(ctx, d, *server, args)
+	}
+	if batch {
+		return command.Batch(ctx, c, max+1, func(ctx context.Context, args []string) (interface{}, error) {
+			resp, err := query(ctx, args)
+			if resp == nil {
+				return nil, err
+			}
+			return command.WithTorrent(torrent, resp), err
+		})
+	}
+	resp, err := query(ctx, c.Args())
+	if resp == nil {
 		return err
 	}
-	fmt.Printf("%v\n", resp)
-	return nil
+	if perr := format.Print(c, command.WithTorrent(torrent, resp)); perr != nil {
+		return perr
+	}
+	return err
 }
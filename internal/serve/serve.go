@@ -0,0 +1,73 @@
+// Package serve contains the handler for the dhtcli serve command.
+package serve
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"github.com/jeanralphaviles/dhtcli/pkg/queryprocessor"
+	"github.com/urfave/cli"
+)
+
+// Serve runs a DHT node answering queries until interrupted.
+func Serve(c *cli.Context) error {
+	if c.NArg() != 0 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.String("address"), fmt.Sprint(c.Int("port"))))
+	if err != nil {
+		return fmt.Errorf("error resolving listen address: %v", err)
+	}
+	d, err := dht.Listen(*laddr)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	var bootstrap *net.UDPAddr
+	if b := c.String("bootstrap"); b != "" {
+		if bootstrap, err = net.ResolveUDPAddr("udp", b); err != nil {
+			return fmt.Errorf("error resolving bootstrap node: %v", err)
+		}
+		// Derive our node id from the external IP the bootstrap node sees, as
+		// defined in BEP 42, before the routing tables are built around it.
+		if resp, err := d.Ping(*bootstrap); err == nil {
+			if p, err := resp.ExternalAddr(); err == nil && p != nil {
+				if err := d.SetSecureID(p.UDPAddr.IP); err != nil {
+					log.Printf("Keeping random node id: %v", err)
+				}
+			}
+		}
+	}
+	rt, err := queryprocessor.NewRoutingTable(d.ID, dht.K)
+	if err != nil {
+		return err
+	}
+	rt6, err := queryprocessor.NewRoutingTable(d.ID, dht.K)
+	if err != nil {
+		return err
+	}
+	rt.SetPing(queryprocessor.Pinger(d))
+	rt6.SetPing(queryprocessor.Pinger(d))
+	s, err := dht.NewServer(d, rt, rt6)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving DHT node 0x%x on %v.", d.ID, d.LocalAddr())
+	if bootstrap != nil {
+		if err := s.Bootstrap(*bootstrap); err != nil {
+			// A node that can't reach the wider DHT is still useful locally.
+			log.Printf("Bootstrapping from %v failed: %v", bootstrap, err)
+		}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Print("Shutting down.")
+	return nil
+}
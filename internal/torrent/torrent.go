@@ -0,0 +1,22 @@
+// Package torrent contains the handler for the dhtcli hash command.
+package torrent
+
+import (
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/internal/command"
+	"github.com/jeanralphaviles/dhtcli/internal/format"
+	"github.com/urfave/cli"
+)
+
+// Hash prints the info hash, name, size and files of a .torrent file.
+func Hash(c *cli.Context) error {
+	if c.NArg() != 1 {
+		command := c.Command
+		return fmt.Errorf("%v: %v", command.FullName(), command.ArgsUsage)
+	}
+	t, err := command.LoadTorrent(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return format.Print(c, t)
+}
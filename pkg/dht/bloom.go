@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+)
+
+// bloomBits is the number of bits in a BloomFilter, referenced as m in BEP 33.
+const bloomBits = 256 * 8
+
+// BloomFilter is a 256 byte bloom filter of peer IP addresses returned in the
+// "BFsd" and "BFpe" keys of scrape get_peers responses, as defined in BEP 33.
+//
+// Filters from several nodes can be merged to estimate the number of distinct
+// seeds or peers of a torrent across the DHT.
+//
+// https://www.bittorrent.org/beps/bep_0033.html
+type BloomFilter [bloomBits / 8]byte
+
+// ParseBloomFilter returns the BloomFilter b encodes.
+func ParseBloomFilter(b []byte) (*BloomFilter, error) {
+	var f BloomFilter
+	if len(b) != len(f) {
+		return nil, fmt.Errorf("bloom filter must be %d bytes long, got %d", len(f), len(b))
+	}
+	copy(f[:], b)
+	return &f, nil
+}
+
+// Add inserts the IP address ip into the filter. IPv4 addresses are hashed in
+// their 4 byte form.
+func (f *BloomFilter) Add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.Sum(ip)
+	for _, i := range []int{int(h[0]) | int(h[1])<<8, int(h[2]) | int(h[3])<<8} {
+		i %= bloomBits
+		f[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Merge adds every address in o to the filter.
+func (f *BloomFilter) Merge(o *BloomFilter) {
+	for i := range f {
+		f[i] |= o[i]
+	}
+}
+
+// Estimate returns the estimated number of distinct addresses in the filter.
+func (f *BloomFilter) Estimate() float64 {
+	zeros := 0
+	for _, b := range f {
+		for i := 0; i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+	// A full filter would give an infinite estimate; report the largest
+	// finite one instead.
+	if zeros == 0 {
+		zeros = 1
+	}
+	return math.Log(float64(zeros)/bloomBits) / (2 * math.Log(1-1.0/bloomBits))
+}
+
+// MarshalJSON marshals a BloomFilter into JSON.
+func (f *BloomFilter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		struct {
+			Estimate int64  `json:"estimate"`
+			Bits     string `json:"bits"`
+		}{
+			int64(math.Round(f.Estimate())),
+			fmt.Sprintf("0x%x", f[:]),
+		})
+}
+
+// Scrape returns the bloom filters of seeds and peers in the "BFsd" and
+// "BFpe" keys of a scrape get_peers response, or nil if absent.
+func (m *Message) Scrape() (seeds, peers *BloomFilter, err error) {
+	for _, f := range []struct {
+		key string
+		dst **BloomFilter
+	}{{"BFsd", &seeds}, {"BFpe", &peers}} {
+		b, err := m.byteString(f.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if b == "" {
+			continue
+		}
+		if *f.dst, err = ParseBloomFilter([]byte(b)); err != nil {
+			return nil, nil, fmt.Errorf("error parsing %q: %v", f.key, err)
+		}
+	}
+	return seeds, peers, nil
+}
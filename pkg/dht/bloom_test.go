@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	// Test vector from BEP 33.
+	var f BloomFilter
+	for i := 0; i < 256; i++ {
+		f.Add(net.IPv4(192, 0, 2, byte(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		f.Add(ip)
+	}
+	want := "f6c3f5eaa07ffd91bde89f777f26fb2bff37bdb8fb2bbaa2fd3ddde7bacfff75" +
+		"ee7ccbaefe5eedb1fbfaff67f6abff5e43ddbca3fd9b9ffdf4ffd3e9dff12d1b" +
+		"df59db53dbe9fa5b7ff3b8fdfcde1afb8bedd7be2f3ee71ebbbfe93bcdeefe14" +
+		"8246c2bc5dbff7e7efdcf24fd8dc7adffd8fffdfddfff7a4bbeedf5cb95ce81f" +
+		"c7fcff1ff4ffffdfe5f7fdcbb7fd79b3fa1fc77bfe07fff905b7b7ffc7fefeff" +
+		"e0b8370bb0cd3f5b7f2bd93feb4386cfdd6f7fd5bfaf2e9ebffffeecd67adbf7" +
+		"c67f17efd5d75eba6ffeba7fff47a91eb1bfbb53e8abfb5762abe8ff237279bf" +
+		"efbfeef5ffc5febfdfe5adffadfee1fb737ffffbfd9f6aeffeee76b6fd8f72ef"
+	if got := hex.EncodeToString(f[:]); got != want {
+		t.Errorf("expected filter %v, got %v", want, got)
+	}
+	if got := f.Estimate(); math.Abs(got-1224.9308) > 0.001 {
+		t.Errorf("expected estimate of 1224.9308, got %v", got)
+	}
+}
+
+func TestBloomFilterMerge(t *testing.T) {
+	var a, b BloomFilter
+	a.Add(net.ParseIP("192.0.2.1"))
+	a.Add(net.ParseIP("192.0.2.2"))
+	b.Add(net.ParseIP("192.0.2.2"))
+	b.Add(net.ParseIP("192.0.2.3"))
+	a.Merge(&b)
+	// The address known to both filters is only counted once.
+	if got := math.Round(a.Estimate()); got != 3 {
+		t.Errorf("expected merged estimate of 3, got %v", got)
+	}
+	var empty BloomFilter
+	if got := empty.Estimate(); got != 0 {
+		t.Errorf("expected empty estimate of 0, got %v", got)
+	}
+	var full BloomFilter
+	for i := range full {
+		full[i] = 0xff
+	}
+	if got := full.Estimate(); math.IsInf(got, 0) || got <= 0 {
+		t.Errorf("expected finite estimate for a full filter, got %v", got)
+	}
+}
+
+func TestMessageScrape(t *testing.T) {
+	var f BloomFilter
+	f.Add(net.ParseIP("192.0.2.1"))
+	cases := []struct {
+		resp  map[string]interface{}
+		seeds bool
+		peers bool
+		fail  bool
+	}{
+		{map[string]interface{}{}, false, false, false},
+		{map[string]interface{}{"BFsd": string(f[:])}, true, false, false},
+		{map[string]interface{}{"BFsd": string(f[:]), "BFpe": string(f[:])}, true, true, false},
+		{map[string]interface{}{"BFpe": "abc"}, false, false, true},
+	}
+	for n, c := range cases {
+		seeds, peers, err := NewResponse("aa", c.resp).Scrape()
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected Scrape() to return error: %v, got %v", n, c.fail, err)
+			continue
+		}
+		if (seeds != nil) != c.seeds || (peers != nil) != c.peers {
+			t.Errorf("case %d: expected seeds: %v and peers: %v, got %v and %v", n, c.seeds, c.peers, seeds, peers)
+		}
+	}
+}
+
+func TestServerScrape(t *testing.T) {
+	_, client, server := newTestServer(t)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	resp, err := client.GetPeers(server, infoHash)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	if _, ok := resp.Response["BFsd"]; ok {
+		t.Errorf("expected no bloom filters without scrape, got %v", resp)
+	}
+	token := resp.Response["token"].(string)
+	h, _ := EncodeInfoHash(infoHash)
+	// Announce the client as a seed on one port and a leecher on another;
+	// each filter holds the client's address once.
+	for _, seed := range []int{1, 0} {
+		req, err := NewRequest(announcePeer, map[string]interface{}{
+			"id":        client.ID,
+			"info_hash": h,
+			"port":      6881 + seed,
+			"token":     token,
+			"seed":      seed,
+		})
+		if err != nil {
+			t.Fatalf("error creating announce_peer request: %v", err)
+		}
+		if resp, err := client.query(context.Background(), server, req); err != nil || resp.Mtype != "r" {
+			t.Fatalf("error announcing: %v %v", resp, err)
+		}
+	}
+
+	resp, err = client.Scrape(server, infoHash, false)
+	if err != nil {
+		t.Fatalf("error issuing Scrape: %v", err)
+	}
+	seeds, peers, err := resp.Scrape()
+	if err != nil {
+		t.Fatalf("error parsing bloom filters: %v", err)
+	}
+	if seeds == nil || math.Round(seeds.Estimate()) != 1 || peers == nil || math.Round(peers.Estimate()) != 1 {
+		t.Errorf("expected 1 seed and 1 peer, got %v", resp)
+	}
+	if values, _ := resp.Values(); len(values) != 2 {
+		t.Errorf("expected 2 peers, got %v", values)
+	}
+
+	resp, err = client.Scrape(server, infoHash, true)
+	if err != nil {
+		t.Fatalf("error issuing Scrape: %v", err)
+	}
+	if values, _ := resp.Values(); len(values) != 1 || values[0].UDPAddr.Port != 6881 {
+		t.Errorf("expected only the leecher with noseed, got %v", values)
+	}
+}
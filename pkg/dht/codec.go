@@ -0,0 +1,274 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+// DecodeMessage decodes a bencoded KRPC message, such as a captured datagram.
+func DecodeMessage(b []byte) (*Message, error) {
+	m := &Message{}
+	if err := bencode.DecodeBytes(b, m); err != nil {
+		return nil, fmt.Errorf("error decoding message: %v", err)
+	}
+	if m.Mtype == "" {
+		return nil, fmt.Errorf("error decoding message: no \"y\" key")
+	}
+	return m, nil
+}
+
+// ParseMessage returns the Message encoded in b by Message.MarshalJSON.
+//
+// Keys MarshalJSON expands, such as "nodes" and "values", are translated back
+// into their compact encodings. Other strings are decoded from hex if 0x
+// prefixed and taken literally otherwise, and numbers must be integers.
+func ParseMessage(b []byte) (*Message, error) {
+	var v struct {
+		T  string                 `json:"t"`
+		Y  string                 `json:"y"`
+		Q  string                 `json:"q"`
+		A  map[string]interface{} `json:"a"`
+		R  map[string]interface{} `json:"r"`
+		E  []interface{}          `json:"e"`
+		V  string                 `json:"v"`
+		IP string                 `json:"ip"`
+		RO int64                  `json:"ro"`
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error parsing message: %v", err)
+	}
+	if v.Y == "" {
+		return nil, fmt.Errorf("error parsing message: no \"y\" key")
+	}
+	m := &Message{Mtype: v.Y, Query: v.Q, ReadOnly: v.RO}
+	var err error
+	if m.TransactionID, err = parseHex(v.T); err != nil {
+		return nil, fmt.Errorf("error parsing message \"t\": %v", err)
+	}
+	if m.Version, err = parseHex(v.V); err != nil {
+		return nil, fmt.Errorf("error parsing message \"v\": %v", err)
+	}
+	if v.IP != "" {
+		if m.IP, err = parseIP(v.IP); err != nil {
+			return nil, fmt.Errorf("error parsing message \"ip\": %v", err)
+		}
+	}
+	if m.Arguments, err = parseDict(v.A); err != nil {
+		return nil, fmt.Errorf("error parsing message \"a\": %v", err)
+	}
+	if m.Response, err = parseDict(v.R); err != nil {
+		return nil, fmt.Errorf("error parsing message \"r\": %v", err)
+	}
+	if v.E != nil {
+		e, err := parseValue(v.E)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing message \"e\": %v", err)
+		}
+		m.Error = e.([]interface{})
+	}
+	return m, nil
+}
+
+// parseHex decodes a 0x prefixed hex string, as written by MarshalJSON.
+func parseHex(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(s, "0x") {
+		return "", fmt.Errorf("%q is not 0x prefixed hex", s)
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// parseIP returns the compact encoding of an IP:Port address, or the bytes of
+// a 0x prefixed hex string.
+func parseIP(s string) (string, error) {
+	if strings.HasPrefix(s, "0x") {
+		return parseHex(s)
+	}
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return "", err
+	}
+	return encodeCompactPeer(Peer{*addr})
+}
+
+// parseDict translates the arguments or response dictionary of a message
+// marshalled by MarshalJSON back into its bencodable form.
+func parseDict(src map[string]interface{}) (map[string]interface{}, error) {
+	if src == nil {
+		return nil, nil
+	}
+	dest := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		var err error
+		switch k {
+		case "nodes", "nodes6":
+			var nodes []Node
+			if nodes, err = parseNodesJSON(v); err == nil {
+				if k == "nodes" {
+					dest[k] = encodeCompactNodes(nodes)
+				} else {
+					dest[k] = encodeCompactNodes6(nodes)
+				}
+			}
+		case "values":
+			dest[k], err = parseValuesJSON(v)
+		case "samples":
+			dest[k], err = parseSamplesJSON(v)
+		case "BFsd", "BFpe":
+			f, ok := v.(map[string]interface{})
+			if !ok {
+				dest[k], err = parseValue(v)
+				break
+			}
+			bits, _ := f["bits"].(string)
+			var b string
+			if b, err = parseHex(bits); err == nil && len(b) != len(BloomFilter{}) {
+				err = fmt.Errorf("bloom filter must be %d bytes long", len(BloomFilter{}))
+			}
+			dest[k] = b
+		default:
+			dest[k], err = parseValue(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k, err)
+		}
+	}
+	return dest, nil
+}
+
+// parseNodesJSON parses a list of nodes marshalled by Node.MarshalJSON.
+func parseNodesJSON(v interface{}) ([]Node, error) {
+	if v == nil {
+		return nil, nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("nodes must be a list, got %T", v)
+	}
+	var nodes []Node
+	for _, e := range l {
+		n, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("node must be an object, got %T", e)
+		}
+		id, _ := n["id"].(string)
+		address, _ := n["address"].(string)
+		i, err := parseHex(id)
+		if err != nil {
+			return nil, fmt.Errorf("node id: %v", err)
+		}
+		if len(i) != 20 {
+			return nil, fmt.Errorf("node id %q needs to represent 20 bytes", id)
+		}
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("node address: %v", err)
+		}
+		nodes = append(nodes, Node{ID: []byte(i), Peer: &Peer{*addr}})
+	}
+	return nodes, nil
+}
+
+// parseValuesJSON returns the compact encodings of a list of peer addresses.
+func parseValuesJSON(v interface{}) ([]interface{}, error) {
+	values := []interface{}{}
+	if v == nil {
+		return values, nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("values must be a list, got %T", v)
+	}
+	for _, e := range l {
+		s, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("peer must be an IP:Port string, got %T", e)
+		}
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return nil, err
+		}
+		p, err := encodeCompactPeer(Peer{*addr})
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, p)
+	}
+	return values, nil
+}
+
+// parseSamplesJSON returns the concatenation of a list of 20 byte hex info
+// hashes.
+func parseSamplesJSON(v interface{}) (string, error) {
+	l, ok := v.([]interface{})
+	if !ok && v != nil {
+		return "", fmt.Errorf("samples must be a list, got %T", v)
+	}
+	var b strings.Builder
+	for _, e := range l {
+		s, _ := e.(string)
+		h, err := parseHex(s)
+		if err != nil {
+			return "", err
+		}
+		if len(h) != 20 {
+			return "", fmt.Errorf("sample %q needs to represent 20 bytes", s)
+		}
+		b.WriteString(h)
+	}
+	return b.String(), nil
+}
+
+// parseValue translates a decoded JSON value into a bencodable one: 0x
+// prefixed hex strings into the bytes they represent, other strings as they
+// are, and numbers into integers.
+func parseValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "0x") {
+			if b, err := hex.DecodeString(strings.TrimPrefix(v, "0x")); err == nil {
+				return string(b), nil
+			}
+		}
+		return v, nil
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return i, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if l[i], err = parseValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case map[string]interface{}:
+		d := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			var err error
+			if d[k], err = parseValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("%v can't be bencoded", v)
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	cases := []struct {
+		b    string
+		want *Message
+		err  bool
+	}{
+		{"d1:rd2:id2:abe1:t2:aa1:y1:re", NewResponse("aa", map[string]interface{}{"id": "ab"}), false},
+		{"d1:eli201e4:oopse1:t2:aa1:y1:ee", &Message{TransactionID: "aa", Mtype: "e", Error: []interface{}{int64(ErrorGeneric), "oops"}}, false},
+		{"d1:t2:aae", nil, true},
+		{"not bencode", nil, true},
+	}
+	for n, c := range cases {
+		got, err := DecodeMessage([]byte(c.b))
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error %v, got %v", n, c.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: expected %v, got %v", n, c.want, got)
+		}
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	var bloom BloomFilter
+	bloom[3] = 0x10
+	cases := []*Message{
+		NewResponse("\x01\x02", map[string]interface{}{
+			"id":     strings.Repeat("a", 20),
+			"nodes":  strings.Repeat("b", 20) + "\x7f\x00\x00\x01\x1a\xe1",
+			"nodes6": strings.Repeat("c", 20) + "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1",
+			"values": []interface{}{"\x0a\x00\x00\x01\x00\x16"},
+			"token":  "\xff\x00",
+			"BFsd":   string(bloom[:]),
+		}),
+		NewResponse("aa", map[string]interface{}{
+			"id":       strings.Repeat("a", 20),
+			"samples":  strings.Repeat("d", 40),
+			"num":      int64(2),
+			"interval": int64(60),
+			"v":        []interface{}{"text", int64(-1), map[string]interface{}{"k": "\x00"}},
+			"seq":      int64(4),
+		}),
+		NewError("aa", ErrorProtocol, "bad token"),
+		{
+			TransactionID: "tt",
+			Mtype:         "q",
+			Query:         "announce_peer",
+			Arguments: map[string]interface{}{
+				"id":           strings.Repeat("a", 20),
+				"port":         int64(6881),
+				"implied_port": int64(1),
+				"want":         []interface{}{"n4", "n6"},
+			},
+			Version: Version,
+			IP:      "\x7f\x00\x00\x01\x1a\xe1",
+		},
+	}
+	for n, c := range cases {
+		want, err := bencode.EncodeBytes(c)
+		if err != nil {
+			t.Fatalf("case %d: error encoding message: %v", n, err)
+		}
+		j, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("case %d: error marshalling message: %v", n, err)
+		}
+		m, err := ParseMessage(j)
+		if err != nil {
+			t.Errorf("case %d: error parsing %s: %v", n, j, err)
+			continue
+		}
+		got, err := bencode.EncodeBytes(m)
+		if err != nil {
+			t.Fatalf("case %d: error encoding parsed message: %v", n, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("case %d: expected %q, got %q", n, want, got)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	cases := []string{
+		`{"t": "0xaa"}`,
+		`{"t": "aa", "y": "r"}`,
+		`{"t": "0xaa", "y": "r", "r": {"nodes": [{"id": "0x00", "address": "127.0.0.1:1"}]}}`,
+		`{"t": "0xaa", "y": "r", "r": {"values": ["nowhere"]}}`,
+		`{"t": "0xaa", "y": "r", "r": {"samples": ["0x00"]}}`,
+		`{"t": "0xaa", "y": "r", "r": {"num": 1.5}}`,
+		`{"t": "0xaa", "y": "r", "r": {"x": true}}`,
+		`not json`,
+	}
+	for n, c := range cases {
+		if m, err := ParseMessage([]byte(c)); err == nil {
+			t.Errorf("case %d: expected error parsing %s, got %v", n, c, m)
+		}
+	}
+}
@@ -5,78 +5,378 @@ package dht
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zeebo/bencode"
 )
 
+// DefaultTimeout is how long a query waits for a response, retransmissions
+// included, unless DHT.Timeout is set. With DefaultRetries, the first wait
+// matches the initial TCP retransmission timeout of RFC 6298, a second.
+const DefaultTimeout = 3 * time.Second
+
+// Values of the "want" argument, as defined in BEP 32.
+const (
+	WantIPv4 = "n4"
+	WantIPv6 = "n6"
+)
+
 // DHT encapsulates a node in the DHT.
+//
+// A DHT owns a single UDP socket that is shared by every query it issues.
+// Outstanding queries are tracked by transaction id, so its methods may be
+// called concurrently from many goroutines.
 type DHT struct {
 	// DHT node id
 	ID string
+	// Address families of nodes requested in find_node and get_peers queries,
+	// WantIPv4 and/or WantIPv6 as defined in BEP 32. If empty, the "want"
+	// argument is omitted and nodes reply with the family of our own address.
+	Want []string
+	// How long a query waits for a response, retransmissions included, before
+	// giving up on a node. If zero, DefaultTimeout is used. Retransmissions to
+	// nodes whose round trip time is unknown are spread over it; once a node
+	// has responded, waits are derived from its round trip time.
+	Timeout time.Duration
+	// How many times a query is retransmitted within Timeout, waiting twice
+	// as long after each, before giving up on a node. Nodes that failed to
+	// respond to their last query aren't retried.
+	Retries int
+	// Whether queries are marked read-only, as defined in BEP 43, so that the
+	// nodes queried don't add us to their routing tables. Set it for DHTs
+	// that don't answer queries.
+	ReadOnly bool
+
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	rtt     map[string]*RTT
+	handler func(from net.UDPAddr, m *Message)
+	capture *Capture
+	closed  bool
+	done    chan struct{}
+}
+
+// transaction is an outstanding query awaiting a response.
+type transaction struct {
+	server net.UDPAddr
+	resp   chan *Message
 }
 
-// New returns a DHT initialized with a random node id.
+// New returns a DHT initialized with a random node id, listening on an
+// ephemeral UDP port.
 func New() (*DHT, error) {
+	return Listen(net.UDPAddr{})
+}
+
+// Listen returns a DHT initialized with a random node id, listening on laddr.
+func Listen(laddr net.UDPAddr) (*DHT, error) {
 	// Generate 20 byte node id.
 	id := make([]byte, 20)
 	if _, err := rand.Read(id); err != nil {
 		return nil, err
 	}
-	return &DHT{ID: string(id)}, nil
+	conn, err := net.ListenUDP("udp", &laddr)
+	if err != nil {
+		return nil, err
+	}
+	d := &DHT{
+		ID:      string(id),
+		conn:    conn,
+		Retries: DefaultRetries,
+		pending: make(map[string]*transaction),
+		rtt:     make(map[string]*RTT),
+		done:    make(chan struct{}),
+	}
+	go d.readLoop()
+	return d, nil
 }
 
-// query issues a request to a DHT node and returns its response.
-func (d *DHT) query(server net.UDPAddr, req *Message) (*Message, error) {
-	conn, err := net.DialUDP("udp", nil, &server)
+// LocalAddr returns the address of the DHT's UDP socket.
+func (d *DHT) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// SetCapture records every datagram the DHT sends and receives to c, or stops
+// recording if c is nil.
+func (d *DHT) SetCapture(c *Capture) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.capture = c
+}
+
+// record writes a datagram exchanged with peer, sent to it if sent is set, to
+// the capture, if any.
+func (d *DHT) record(peer net.UDPAddr, sent bool, b []byte) {
+	d.mu.Lock()
+	c := d.capture
+	d.mu.Unlock()
+	if c == nil {
+		return
+	}
+	src, dst := d.localAddr(peer), peer
+	if !sent {
+		src, dst = dst, src
+	}
+	if err := c.Write(src, dst, b); err != nil {
+		log.Print(err)
+	}
+}
+
+// localAddr returns the address of the DHT's UDP socket that datagrams to and
+// from peer use. If the socket listens on all interfaces, the address of the
+// interface routing to peer is looked up, without sending anything.
+func (d *DHT) localAddr(peer net.UDPAddr) net.UDPAddr {
+	a, ok := d.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return net.UDPAddr{}
+	}
+	if !a.IP.IsUnspecified() {
+		return *a
+	}
+	// Connecting a UDP socket only picks the route.
+	conn, err := net.DialUDP("udp", nil, &peer)
 	if err != nil {
-		return nil, err
+		return *a
 	}
 	defer conn.Close()
+	local := *a
+	local.IP = conn.LocalAddr().(*net.UDPAddr).IP
+	return local
+}
+
+// Close closes the DHT's socket. Outstanding queries fail immediately.
+func (d *DHT) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+	err := d.conn.Close()
+	<-d.done
+	return err
+}
+
+// readLoop reads datagrams from the socket and routes responses to the
+// goroutines waiting on them.
+func (d *DHT) readLoop() {
+	defer close(d.done)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("error reading from socket: %v", err)
+			continue
+		}
+		d.record(*from, false, buf[:n])
+		m := &Message{}
+		if err := bencode.DecodeBytes(buf[:n], m); err != nil {
+			// Not a KRPC message, nothing we can do with it.
+			continue
+		}
+		if d.deliver(*from, m) || m.Mtype != "q" {
+			continue
+		}
+		d.mu.Lock()
+		h := d.handler
+		d.mu.Unlock()
+		if h != nil {
+			h(*from, m)
+		}
+	}
+}
+
+// handle installs h as the handler for incoming queries. Queries received
+// without a handler are dropped.
+func (d *DHT) handle(h func(from net.UDPAddr, m *Message)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handler = h
+}
+
+// deliver hands m to the transaction it answers, if any.
+func (d *DHT) deliver(from net.UDPAddr, m *Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.pending[m.TransactionID]
+	if !ok || !sameAddr(t.server, from) {
+		return false
+	}
+	delete(d.pending, m.TransactionID)
+	t.resp <- m
+	return true
+}
+
+// sameAddr reports whether a and b refer to the same IP:Port.
+func sameAddr(a, b net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// register records req as outstanding, assigning it a transaction id that
+// isn't already in use.
+func (d *DHT) register(server net.UDPAddr, req *Message) (*transaction, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, fmt.Errorf("DHT is closed")
+	}
+	for {
+		if _, ok := d.pending[req.TransactionID]; !ok {
+			break
+		}
+		id := make([]byte, len(req.TransactionID))
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		req.TransactionID = string(id)
+	}
+	t := &transaction{server: server, resp: make(chan *Message, 1)}
+	d.pending[req.TransactionID] = t
+	return t, nil
+}
+
+// unregister forgets an outstanding transaction.
+func (d *DHT) unregister(id string, t *transaction) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[id] == t {
+		delete(d.pending, id)
+	}
+}
+
+// send encodes m and writes it to addr.
+func (d *DHT) send(addr net.UDPAddr, m *Message) error {
 	buf := bytes.NewBuffer([]byte{})
-	if err := bencode.NewEncoder(buf).Encode(req); err != nil {
-		return nil, fmt.Errorf("error encoding %#v: %v", req, err)
+	if err := bencode.NewEncoder(buf).Encode(m); err != nil {
+		return fmt.Errorf("error encoding %#v: %v", m, err)
 	}
-	if _, err := conn.Write(buf.Bytes()); err != nil {
+	if _, err := d.conn.WriteToUDP(buf.Bytes(), &addr); err != nil {
+		return err
+	}
+	d.record(addr, true, buf.Bytes())
+	return nil
+}
+
+// query issues a request to a DHT node and returns its response.
+//
+// The request is retransmitted with exponential backoff, starting from a
+// timeout derived from the node's round trip time, until d.Retries is
+// exhausted or d.Timeout passes, returning a *TimeoutError, or ctx is done.
+// If the node replies with an error, it is returned as a *KRPCError.
+func (d *DHT) query(ctx context.Context, server net.UDPAddr, req *Message) (*Message, error) {
+	resp, err := d.exchange(ctx, server, req)
+	if err != nil {
 		return nil, err
 	}
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	resp := &Message{}
-	if err := bencode.NewDecoder(conn).Decode(resp); err != nil {
-		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	if err := resp.KRPCError(); err != nil {
+		return nil, err
 	}
 	return resp, nil
 }
 
+// exchange is like query but returns error replies as they are.
+func (d *DHT) exchange(ctx context.Context, server net.UDPAddr, req *Message) (*Message, error) {
+	t, err := d.register(server, req)
+	if err != nil {
+		return nil, err
+	}
+	id := req.TransactionID
+	defer d.unregister(id, t)
+	if d.ReadOnly && req.Mtype == "q" {
+		req.ReadOnly = 1
+	}
+	rto, retries := d.schedule(server)
+	start := time.Now()
+	deadline := start.Add(d.timeout())
+	for attempt := 0; ; attempt++ {
+		if err := d.send(server, req); err != nil {
+			return nil, err
+		}
+		wait := rto << attempt
+		if wait > maxRTO || wait <= 0 {
+			wait = maxRTO
+		}
+		last := attempt >= retries
+		if left := time.Until(deadline); wait >= left {
+			wait, last = left, true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case resp := <-t.resp:
+			timer.Stop()
+			// Retransmissions share a transaction id, so a response to one
+			// can't be timed (Karn's algorithm).
+			var r time.Duration
+			if attempt == 0 {
+				r = time.Since(start)
+			}
+			d.observe(server, r, true)
+			return resp, nil
+		case <-timer.C:
+			if !last {
+				continue
+			}
+			d.observe(server, 0, false)
+			return nil, &TimeoutError{Server: server, Attempts: attempt + 1}
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("gave up waiting for response from %v: %v", &server, ctx.Err())
+		case <-d.done:
+			timer.Stop()
+			return nil, fmt.Errorf("DHT closed while waiting for response from %v", &server)
+		}
+	}
+}
+
 // Ping issues a "ping" query to a DHT node and returns its response.
 //
 // server is the IP:Port of the DHT node to ping.
 func (d *DHT) Ping(server net.UDPAddr) (*Message, error) {
+	return d.PingContext(context.Background(), server)
+}
+
+// PingContext is like Ping but gives up once ctx is done.
+func (d *DHT) PingContext(ctx context.Context, server net.UDPAddr) (*Message, error) {
 	args := map[string]interface{}{"id": d.ID}
 	req, err := NewRequest(ping, args)
 	if err != nil {
 		return nil, fmt.Errorf("error creating ping request: %v", err)
 	}
-	return d.query(server, req)
+	return d.query(ctx, server, req)
 }
 
-// EncodeInfoHash encodes a string of hexadecimal characters as a string of the literal bytes it represents.
+// EncodeInfoHash encodes an info hash as a string of the literal bytes it
+// represents. It may be written as 40 hexadecimal characters, 32 base32
+// characters, or as a magnet link to the torrent.
+//
+// BitTorrent v2 info hashes, 64 hexadecimal characters or "urn:btmh:" magnet
+// links, are truncated to 20 bytes as defined in BEP 52. Hybrid torrents are
+// encoded by their v1 info hash, see InfoHashes.
+//
+// https://www.bittorrent.org/beps/bep_0052.html
 func EncodeInfoHash(infoHash string) (string, error) {
-	infoHash = strings.TrimPrefix(infoHash, "0x")
-	infoHash = strings.TrimPrefix(infoHash, "0X")
-	h, err := hex.DecodeString(infoHash)
+	hashes, err := InfoHashes(infoHash)
 	if err != nil {
 		return "", err
 	}
-	if len(h) != 20 {
-		return "", fmt.Errorf("invalid infoHash %q: needs to represent 20 bytes", infoHash)
-	}
-	return string(h), nil
+	return hashes[0], nil
 }
 
 // FindNode issues a "find_node" query to a DHT node and returns its response.
@@ -84,16 +384,34 @@ func EncodeInfoHash(infoHash string) (string, error) {
 // server is the IP:Port of the DHT node to query.
 // target is the 20 byte hex string of the node being searched for.
 func (d *DHT) FindNode(server net.UDPAddr, target string) (*Message, error) {
+	return d.FindNodeContext(context.Background(), server, target)
+}
+
+// FindNodeContext is like FindNode but gives up once ctx is done.
+func (d *DHT) FindNodeContext(ctx context.Context, server net.UDPAddr, target string) (*Message, error) {
 	hash, err := EncodeInfoHash(target)
 	if err != nil {
 		return nil, err
 	}
 	args := map[string]interface{}{"id": d.ID, "target": hash}
+	d.addWant(args)
 	req, err := NewRequest(findNode, args)
 	if err != nil {
 		return nil, fmt.Errorf("error creating find_node request: %v", err)
 	}
-	return d.query(server, req)
+	return d.query(ctx, server, req)
+}
+
+// addWant adds the "want" argument to args if d.Want is set.
+func (d *DHT) addWant(args map[string]interface{}) {
+	if len(d.Want) == 0 {
+		return
+	}
+	var want []interface{}
+	for _, w := range d.Want {
+		want = append(want, w)
+	}
+	args["want"] = want
 }
 
 // GetPeers issues a "get_peers" query to a DHT node and returns its response.
@@ -101,16 +419,48 @@ func (d *DHT) FindNode(server net.UDPAddr, target string) (*Message, error) {
 // server is the IP:Port of the DHT node to query.
 // infoHash is the 20 byte hexadecimal hash of the torrent to get peers for.
 func (d *DHT) GetPeers(server net.UDPAddr, infoHash string) (*Message, error) {
+	return d.GetPeersContext(context.Background(), server, infoHash)
+}
+
+// GetPeersContext is like GetPeers but gives up once ctx is done.
+func (d *DHT) GetPeersContext(ctx context.Context, server net.UDPAddr, infoHash string) (*Message, error) {
+	return d.getPeers(ctx, server, infoHash, false, false)
+}
+
+// Scrape issues a "get_peers" query to a DHT node that also asks for bloom
+// filters of the seeds and peers it stores, and returns its response, as
+// defined in BEP 33. Message.Scrape parses the filters.
+//
+// server is the IP:Port of the DHT node to query.
+// infoHash is the 20 byte hexadecimal hash of the torrent to scrape.
+// noseed asks the node to leave seeds out of the peers it returns.
+func (d *DHT) Scrape(server net.UDPAddr, infoHash string, noseed bool) (*Message, error) {
+	return d.ScrapeContext(context.Background(), server, infoHash, noseed)
+}
+
+// ScrapeContext is like Scrape but gives up once ctx is done.
+func (d *DHT) ScrapeContext(ctx context.Context, server net.UDPAddr, infoHash string, noseed bool) (*Message, error) {
+	return d.getPeers(ctx, server, infoHash, true, noseed)
+}
+
+func (d *DHT) getPeers(ctx context.Context, server net.UDPAddr, infoHash string, scrape, noseed bool) (*Message, error) {
 	infoHash, err := EncodeInfoHash(infoHash)
 	if err != nil {
 		return nil, err
 	}
 	args := map[string]interface{}{"id": d.ID, "info_hash": infoHash}
+	if scrape {
+		args["scrape"] = 1
+	}
+	if noseed {
+		args["noseed"] = 1
+	}
+	d.addWant(args)
 	req, err := NewRequest(getPeers, args)
 	if err != nil {
 		return nil, fmt.Errorf("error creating get_peers request: %v", err)
 	}
-	return d.query(server, req)
+	return d.query(ctx, server, req)
 }
 
 // EncodeToken encodes a string of hexadecimal characters of a token as the literal bytes it represents.
@@ -131,6 +481,11 @@ func EncodeToken(token string) (string, error) {
 // token is the token received in a previous get_peers request to this server.
 // port is the intended UDP server port of this peer. If zero, the "implied_port" setting will be sent in the request.
 func (d *DHT) AnnouncePeer(server net.UDPAddr, infoHash string, token string, port int) (*Message, error) {
+	return d.AnnouncePeerContext(context.Background(), server, infoHash, token, port)
+}
+
+// AnnouncePeerContext is like AnnouncePeer but gives up once ctx is done.
+func (d *DHT) AnnouncePeerContext(ctx context.Context, server net.UDPAddr, infoHash string, token string, port int) (*Message, error) {
 	infoHash, err := EncodeInfoHash(infoHash)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding infoHash: %v", err)
@@ -154,5 +509,118 @@ func (d *DHT) AnnouncePeer(server net.UDPAddr, infoHash string, token string, po
 	if err != nil {
 		return nil, fmt.Errorf("error creating announce_peer request: %v", err)
 	}
-	return d.query(server, req)
+	return d.query(ctx, server, req)
+}
+
+// SampleInfohashes issues a "sample_infohashes" query to a DHT node and
+// returns its response, as defined in BEP 51. Samples parses the response.
+//
+// server is the IP:Port of the DHT node to query.
+// target is the 20 byte hexadecimal id the returned nodes should be closest to.
+func (d *DHT) SampleInfohashes(server net.UDPAddr, target string) (*Message, error) {
+	return d.SampleInfohashesContext(context.Background(), server, target)
+}
+
+// SampleInfohashesContext is like SampleInfohashes but gives up once ctx is done.
+func (d *DHT) SampleInfohashesContext(ctx context.Context, server net.UDPAddr, target string) (*Message, error) {
+	t, err := EncodeInfoHash(target)
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{"id": d.ID, "target": t}
+	d.addWant(args)
+	req, err := NewRequest(sampleInfohashes, args)
+	if err != nil {
+		return nil, fmt.Errorf("error creating sample_infohashes request: %v", err)
+	}
+	return d.query(ctx, server, req)
+}
+
+// Get issues a "get" query for a stored item to a DHT node and returns its
+// response, as defined in BEP 44.
+//
+// server is the IP:Port of the DHT node to query.
+// target is the 20 byte hexadecimal target of the item, the SHA-1 hash of its bencoded value.
+func (d *DHT) Get(server net.UDPAddr, target string) (*Message, error) {
+	return d.GetContext(context.Background(), server, target)
+}
+
+// GetContext is like Get but gives up once ctx is done.
+func (d *DHT) GetContext(ctx context.Context, server net.UDPAddr, target string) (*Message, error) {
+	t, err := EncodeInfoHash(target)
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{"id": d.ID, "target": t}
+	d.addWant(args)
+	req, err := NewRequest(get, args)
+	if err != nil {
+		return nil, fmt.Errorf("error creating get request: %v", err)
+	}
+	return d.query(ctx, server, req)
+}
+
+// Put issues a "put" query storing an item on a DHT node and returns its
+// response, as defined in BEP 44.
+//
+// server is the IP:Port of the DHT node to store the item on.
+// token is the token received in a previous get request to this server.
+// item is the item to store. Mutable items must already be signed.
+func (d *DHT) Put(server net.UDPAddr, token string, item *Item) (*Message, error) {
+	return d.PutContext(context.Background(), server, token, item)
+}
+
+// PutContext is like Put but gives up once ctx is done.
+func (d *DHT) PutContext(ctx context.Context, server net.UDPAddr, token string, item *Item) (*Message, error) {
+	return d.put(ctx, server, token, item, nil)
+}
+
+// PutCAS issues a "put" query storing a mutable item on a DHT node, only if
+// the sequence number of the item currently stored is cas, and returns its
+// response, as defined in BEP 44.
+//
+// server is the IP:Port of the DHT node to store the item on.
+// token is the token received in a previous get request to this server.
+// item is the signed mutable item to store.
+func (d *DHT) PutCAS(server net.UDPAddr, token string, item *Item, cas int64) (*Message, error) {
+	return d.PutCASContext(context.Background(), server, token, item, cas)
+}
+
+// PutCASContext is like PutCAS but gives up once ctx is done.
+func (d *DHT) PutCASContext(ctx context.Context, server net.UDPAddr, token string, item *Item, cas int64) (*Message, error) {
+	if !item.Mutable() {
+		return nil, fmt.Errorf("compare-and-swap requires a mutable item")
+	}
+	return d.put(ctx, server, token, item, &cas)
+}
+
+func (d *DHT) put(ctx context.Context, server net.UDPAddr, token string, item *Item, cas *int64) (*Message, error) {
+	token, err := EncodeToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding token: %v", err)
+	}
+	if _, err := item.encode(); err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{
+		"id":    d.ID,
+		"token": token,
+		"v":     item.V,
+	}
+	if item.Mutable() {
+		args["k"] = string(item.K)
+		args["seq"] = item.Seq
+		args["sig"] = string(item.Sig)
+		if len(item.Salt) > 0 {
+			args["salt"] = string(item.Salt)
+		}
+		if cas != nil {
+			args["cas"] = *cas
+		}
+	}
+	req, err := NewRequest(put, args)
+	if err != nil {
+		return nil, fmt.Errorf("error creating put request: %v", err)
+	}
+	return d.query(ctx, server, req)
 }
@@ -1,10 +1,16 @@
 package dht
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"log"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var addr *net.UDPAddr
@@ -61,6 +67,64 @@ func TestPing(t *testing.T) {
 	}
 }
 
+func TestConcurrentQueries(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := NewRequest(ping, map[string]interface{}{"id": d.ID})
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := d.query(context.Background(), *addr, req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// The echo server returns our own request, so every caller must
+			// receive the message carrying its transaction id.
+			if got.TransactionID != req.TransactionID {
+				t.Errorf("got response for transaction %x, want %x", got.TransactionID, req.TransactionID)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("error issuing concurrent query: %v", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) != 0 {
+		t.Errorf("expected no outstanding transactions, got %d", len(d.pending))
+	}
+}
+
+func TestClose(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing DHT: %v", err)
+	}
+	if _, err := d.Ping(*addr); err == nil {
+		t.Errorf("expected Ping on a closed DHT to error")
+	}
+	// Closing twice is harmless.
+	if err := d.Close(); err != nil {
+		t.Errorf("second Close() returned %v", err)
+	}
+}
+
 func TestFindNode(t *testing.T) {
 	d, err := New()
 	if err != nil {
@@ -83,6 +147,16 @@ func TestFindNode(t *testing.T) {
 		t.Errorf("expected %v, got %v", want, got)
 	}
 
+	d.Want = []string{WantIPv4, WantIPv6}
+	got, err = d.FindNode(*addr, "4142434445464748494A4B4C4D4E4F5051525354")
+	if err != nil {
+		t.Fatalf("error issuing FindNode: %v", err)
+	}
+	if want := []interface{}{"n4", "n6"}; !reflect.DeepEqual(got.Arguments["want"], want) {
+		t.Errorf("expected want argument %v, got %v", want, got.Arguments["want"])
+	}
+	d.Want = nil
+
 	errCases := []struct {
 		addr   *net.UDPAddr
 		target string
@@ -182,3 +256,159 @@ func TestAnnouncePeer(t *testing.T) {
 		}
 	}
 }
+
+func TestGet(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	got, err := d.Get(*addr, "4142434445464748494A4B4C4D4E4F5051525354")
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	want, err := NewRequest(get, map[string]interface{}{
+		"id":     d.ID,
+		"target": "ABCDEFGHIJKLMNOPQRST",
+	})
+	if err != nil {
+		t.Fatalf("error creating Get request: %v", err)
+	}
+	// Set transaction ids to be equal
+	want.TransactionID = got.TransactionID
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, err := d.Get(*addr, "ABCDEFG"); err == nil {
+		t.Errorf("expected d.Get(%v, %q) to error", addr, "ABCDEFG")
+	}
+}
+
+func TestPut(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	v := []interface{}{"Hello", int64(42), map[string]interface{}{"a": "b"}}
+	got, err := d.Put(*addr, "746F6B656E", &Item{V: v})
+	if err != nil {
+		t.Fatalf("error issuing Put: %v", err)
+	}
+	want, err := NewRequest(put, map[string]interface{}{
+		"id":    d.ID,
+		"token": "token",
+		"v":     v,
+	})
+	if err != nil {
+		t.Fatalf("error creating Put request: %v", err)
+	}
+	// Set transaction ids to be equal
+	want.TransactionID = got.TransactionID
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	mutable, err := NewMutableItem("Hello", key, []byte("salt"), 3)
+	if err != nil {
+		t.Fatalf("error creating mutable item: %v", err)
+	}
+	got, err = d.PutCAS(*addr, "746F6B656E", mutable, 2)
+	if err != nil {
+		t.Fatalf("error issuing PutCAS: %v", err)
+	}
+	want, err = NewRequest(put, map[string]interface{}{
+		"id":    d.ID,
+		"token": "token",
+		"v":     "Hello",
+		"k":     string(mutable.K),
+		"salt":  "salt",
+		"seq":   int64(3),
+		"sig":   string(mutable.Sig),
+		"cas":   int64(2),
+	})
+	if err != nil {
+		t.Fatalf("error creating Put request: %v", err)
+	}
+	want.TransactionID = got.TransactionID
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, err := d.PutCAS(*addr, "746F6B656E", &Item{V: "Hello"}, 2); err == nil {
+		t.Errorf("expected PutCAS of an immutable item to error")
+	}
+
+	errCases := []struct {
+		token string
+		item  *Item
+	}{
+		{"ABCDEFG", &Item{V: "Hello"}},
+		{"746F6B656E", &Item{}},
+		{"746F6B656E", &Item{V: strings.Repeat("a", MaxItemSize)}},
+	}
+	for n, c := range errCases {
+		if _, err := d.Put(*addr, c.token, c.item); err == nil {
+			t.Errorf("case %d: expected d.Put(%v, %q, %v) to error", n, addr, c.token, c.item)
+		}
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// A socket that never replies.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer silent.Close()
+	server := *silent.LocalAddr().(*net.UDPAddr)
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+
+	d.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	var terr *TimeoutError
+	if _, err := d.Ping(server); !errors.As(err, &terr) {
+		t.Errorf("expected Ping of a silent node to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Ping to time out after %v, took %v", d.Timeout, elapsed)
+	}
+
+	// Retransmissions don't extend the wait past d.Timeout, whether or not
+	// the node's round trip time is known.
+	d.Timeout = 300 * time.Millisecond
+	d.Retries = 3
+	for _, known := range []bool{false, true} {
+		if known {
+			d.observe(server, time.Second, true)
+		}
+		start = time.Now()
+		if _, err := d.Ping(server); !errors.As(err, &terr) {
+			t.Errorf("expected Ping of a silent node to time out, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > d.Timeout+100*time.Millisecond {
+			t.Errorf("expected Ping with %d retries to time out after %v, took %v", d.Retries, d.Timeout, elapsed)
+		}
+	}
+
+	d.Timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := d.PingContext(ctx, server); err == nil {
+		t.Errorf("expected PingContext to give up once its context is done")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected PingContext to give up with its context, took %v", elapsed)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) != 0 {
+		t.Errorf("expected no outstanding transactions, got %d", len(d.pending))
+	}
+}
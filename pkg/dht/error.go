@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+)
+
+// KRPC error codes as defined in BEP 5.
+const (
+	ErrorGeneric       = 201
+	ErrorServer        = 202
+	ErrorProtocol      = 203
+	ErrorMethodUnknown = 204
+)
+
+// KRPCError is the error a node replied to a query with, in the "e" key of a
+// message of type "e", as defined in BEP 5.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+// Error describes the error, naming the code if it is defined in BEP 5.
+func (e *KRPCError) Error() string {
+	var name string
+	switch e.Code {
+	case ErrorGeneric:
+		name = "generic error"
+	case ErrorServer:
+		name = "server error"
+	case ErrorProtocol:
+		name = "protocol error"
+	case ErrorMethodUnknown:
+		name = "method unknown"
+	default:
+		return fmt.Sprintf("node replied with error %d: %v", e.Code, e.Message)
+	}
+	return fmt.Sprintf("node replied with %v %d: %v", name, e.Code, e.Message)
+}
+
+// KRPCError returns the error in the "e" key of a message of type "e", or nil
+// if the message is of another type.
+//
+// A malformed "e" key is reported as a generic error.
+func (m *Message) KRPCError() *KRPCError {
+	if m.Mtype != "e" {
+		return nil
+	}
+	if len(m.Error) == 2 {
+		code, ok := m.Error[0].(int64)
+		msg, ok2 := m.Error[1].(string)
+		if ok && ok2 {
+			return &KRPCError{Code: int(code), Message: msg}
+		}
+	}
+	return &KRPCError{Code: ErrorGeneric, Message: fmt.Sprintf("malformed error %v", m.Error)}
+}
+
+// TimeoutError is returned when a node fails to respond to a query.
+type TimeoutError struct {
+	// Address of the node queried.
+	Server net.UDPAddr
+	// Number of times the query was sent.
+	Attempts int
+}
+
+// Error describes the error.
+func (e *TimeoutError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("timed out waiting for response from %v after %d attempts", &e.Server, e.Attempts)
+	}
+	return fmt.Sprintf("timed out waiting for response from %v", &e.Server)
+}
+
+// Timeout reports that the error is a timeout, as with net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestMessageKRPCError(t *testing.T) {
+	cases := []struct {
+		m    *Message
+		want *KRPCError
+		str  string
+	}{
+		{NewResponse("aa", map[string]interface{}{"id": "abcdefghij0123456789"}), nil, ""},
+		{&Message{Mtype: "e", Error: []interface{}{int64(ErrorProtocol), "bad token"}}, &KRPCError{ErrorProtocol, "bad token"}, "node replied with protocol error 203: bad token"},
+		{&Message{Mtype: "e", Error: []interface{}{int64(ErrorMethodUnknown), "method unknown"}}, &KRPCError{ErrorMethodUnknown, "method unknown"}, "node replied with method unknown 204: method unknown"},
+		{&Message{Mtype: "e", Error: []interface{}{int64(302), "sequence number less than current"}}, &KRPCError{302, "sequence number less than current"}, "node replied with error 302: sequence number less than current"},
+		{&Message{Mtype: "e", Error: []interface{}{"oops"}}, &KRPCError{ErrorGeneric, "malformed error [oops]"}, "node replied with generic error 201: malformed error [oops]"},
+	}
+	for n, c := range cases {
+		got := c.m.KRPCError()
+		if (got == nil) != (c.want == nil) || got != nil && *got != *c.want {
+			t.Errorf("case %d: expected %+v, got %+v", n, c.want, got)
+			continue
+		}
+		if got != nil && got.Error() != c.str {
+			t.Errorf("case %d: expected %q, got %q", n, c.str, got.Error())
+		}
+	}
+}
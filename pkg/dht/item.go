@@ -0,0 +1,277 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/zeebo/bencode"
+)
+
+// MaxItemSize is the largest bencoded value that may be stored in the DHT, as
+// defined in BEP 44.
+const MaxItemSize = 1000
+
+// MaxSaltSize is the longest salt a mutable item may have, as defined in BEP 44.
+const MaxSaltSize = 64
+
+// Item is a value stored in the DHT with "put" and retrieved with "get", as
+// defined in BEP 44.
+//
+// Immutable items are stored under the SHA-1 hash of their bencoded value.
+// Mutable items are signed with an ed25519 key and stored under the SHA-1
+// hash of the public key and salt, so they can be updated by the key's owner.
+//
+// https://www.bittorrent.org/beps/bep_0044.html
+type Item struct {
+	// V is the value of the item: any bencodable value, decoded values use
+	// string, int64, []interface{} and map[string]interface{}.
+	V interface{}
+
+	// K is the public key of a mutable item, nil for immutable items.
+	K ed25519.PublicKey
+	// Salt is appended to K to derive the target of a mutable item, allowing
+	// one key to sign many items.
+	Salt []byte
+	// Seq is the sequence number of a mutable item. Nodes only replace a
+	// stored item with one of a higher sequence number.
+	Seq int64
+	// Sig is the signature of Salt, Seq and V made with the private key of K.
+	Sig []byte
+}
+
+// NewItem returns an immutable Item holding v, checking that it is
+// bencodable and no larger than MaxItemSize once encoded.
+func NewItem(v interface{}) (*Item, error) {
+	i := &Item{V: v}
+	if _, err := i.encode(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// NewMutableItem returns a mutable Item holding v with sequence number seq,
+// signed with key. salt may be nil.
+func NewMutableItem(v interface{}, key ed25519.PrivateKey, salt []byte, seq int64) (*Item, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key: needs to be %d bytes", ed25519.PrivateKeySize)
+	}
+	i := &Item{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+	}
+	b, err := i.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	i.Sig = ed25519.Sign(key, b)
+	return i, nil
+}
+
+// DecodeItem returns the immutable Item whose bencoded value is b.
+func DecodeItem(b []byte) (*Item, error) {
+	var v interface{}
+	if err := bencode.DecodeBytes(b, &v); err != nil {
+		return nil, fmt.Errorf("error decoding bencoded value: %v", err)
+	}
+	return NewItem(v)
+}
+
+// Mutable reports whether the item is a mutable item.
+func (i *Item) Mutable() bool {
+	return i.K != nil
+}
+
+// encode returns the bencoding of the item's value.
+func (i *Item) encode() ([]byte, error) {
+	if i.V == nil {
+		return nil, fmt.Errorf("item has no value")
+	}
+	b, err := bencode.EncodeBytes(i.V)
+	if err != nil {
+		return nil, fmt.Errorf("error bencoding item value: %v", err)
+	}
+	if len(b) > MaxItemSize {
+		return nil, fmt.Errorf("item value is %d bytes bencoded, must be at most %d", len(b), MaxItemSize)
+	}
+	return b, nil
+}
+
+// signedBytes returns the buffer a mutable item's signature covers: the
+// bencoded "salt", "seq" and "v" keys and values, without the enclosing
+// dictionary, as defined in BEP 44.
+func (i *Item) signedBytes() ([]byte, error) {
+	if len(i.Salt) > MaxSaltSize {
+		return nil, fmt.Errorf("item salt is %d bytes, must be at most %d", len(i.Salt), MaxSaltSize)
+	}
+	v, err := i.encode()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if len(i.Salt) > 0 {
+		fmt.Fprintf(&b, "4:salt%d:%s", len(i.Salt), i.Salt)
+	}
+	fmt.Fprintf(&b, "3:seqi%de1:v", i.Seq)
+	b.Write(v)
+	return b.Bytes(), nil
+}
+
+// Target returns the 20 byte target the item is stored under: the SHA-1 hash
+// of its bencoded value if immutable, or of its public key and salt if
+// mutable.
+func (i *Item) Target() (string, error) {
+	if i.Mutable() {
+		if len(i.K) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("invalid ed25519 public key: needs to be %d bytes", ed25519.PublicKeySize)
+		}
+		h := sha1.Sum(append(append([]byte{}, i.K...), i.Salt...))
+		return string(h[:]), nil
+	}
+	b, err := i.encode()
+	if err != nil {
+		return "", err
+	}
+	h := sha1.Sum(b)
+	return string(h[:]), nil
+}
+
+// Verify checks that the item is stored under the 20 byte target and, if
+// mutable, that it is signed by the private key of K.
+//
+// Salts aren't returned by get queries, so Salt must be set to the salt
+// the item was looked up with before verifying a mutable item.
+func (i *Item) Verify(target string) error {
+	t, err := i.Target()
+	if err != nil {
+		return err
+	}
+	if t != target {
+		return fmt.Errorf("item target 0x%x does not match 0x%x", t, target)
+	}
+	if !i.Mutable() {
+		return nil
+	}
+	b, err := i.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(i.K, b, i.Sig) {
+		return fmt.Errorf("invalid signature on item 0x%x", t)
+	}
+	return nil
+}
+
+// MarshalJSON marshals an Item into JSON.
+func (i *Item) MarshalJSON() ([]byte, error) {
+	if !i.Mutable() {
+		return json.Marshal(
+			struct {
+				V interface{} `json:"v"`
+			}{
+				readableValue(i.V),
+			})
+	}
+	var salt string
+	if len(i.Salt) > 0 {
+		salt = fmt.Sprint(readableValue(string(i.Salt)))
+	}
+	return json.Marshal(
+		struct {
+			V    interface{} `json:"v"`
+			K    string      `json:"k"`
+			Salt string      `json:"salt,omitempty"`
+			Seq  int64       `json:"seq"`
+			Sig  string      `json:"sig"`
+		}{
+			readableValue(i.V),
+			fmt.Sprintf("0x%x", []byte(i.K)),
+			salt,
+			i.Seq,
+			fmt.Sprintf("0x%x", i.Sig),
+		})
+}
+
+// Item returns the item in the Message's Response, or nil if the response
+// has no "v" key.
+//
+// The item is checked to be no larger than MaxItemSize, but not verified;
+// see Item.Verify.
+func (m *Message) Item() (*Item, error) {
+	if _, ok := m.Response["v"]; !ok {
+		return nil, nil
+	}
+	i, err := itemFromDict(m.Response)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := i.encode(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// itemFromDict returns the item in the "v", "k", "salt", "seq" and "sig" keys
+// of a get response or put request.
+func itemFromDict(d map[string]interface{}) (*Item, error) {
+	v, ok := d["v"]
+	if !ok {
+		return nil, fmt.Errorf("item has no value")
+	}
+	i := &Item{V: v}
+	if _, ok := d["k"]; !ok {
+		return i, nil
+	}
+	k, ok := d["k"].(string)
+	if !ok || len(k) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid item public key: needs to be %d bytes", ed25519.PublicKeySize)
+	}
+	sig, ok := d["sig"].(string)
+	if !ok || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid item signature: needs to be %d bytes", ed25519.SignatureSize)
+	}
+	seq, ok := d["seq"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("invalid item sequence number %v", d["seq"])
+	}
+	i.K, i.Sig, i.Seq = ed25519.PublicKey(k), []byte(sig), seq
+	if salt, ok := d["salt"]; ok {
+		s, ok := salt.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid item salt %v", salt)
+		}
+		i.Salt = []byte(s)
+	}
+	return i, nil
+}
+
+// readableValue translates a decoded bencode value for printing as JSON. Byte
+// strings that aren't valid UTF-8 are translated to hex.
+func readableValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if utf8.ValidString(v) {
+			return v
+		}
+		return fmt.Sprintf("0x%x", v)
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = readableValue(e)
+		}
+		return l
+	case map[string]interface{}:
+		d := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			d[k] = readableValue(e)
+		}
+		return d
+	default:
+		return v
+	}
+}
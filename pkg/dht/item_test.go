@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestItemTarget(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want string
+		fail bool
+	}{
+		// Test vector from BEP 44.
+		{"Hello World!", "e5f96f6f38320f0f33959cb4d3d656452117aadb", false},
+		{nil, "", true},
+		{strings.Repeat("a", MaxItemSize-4), "", false},
+		{strings.Repeat("a", MaxItemSize-3), "", true},
+	}
+	for n, c := range cases {
+		i := &Item{V: c.v}
+		got, err := i.Target()
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected Target() to return error: %v, got %v", n, c.fail, err)
+			continue
+		}
+		if c.want != "" && got != mustEncodeInfoHash(t, c.want) {
+			t.Errorf("case %d: expected target %v, got %x", n, c.want, got)
+		}
+	}
+}
+
+func TestDecodeItem(t *testing.T) {
+	cases := []struct {
+		b    string
+		want interface{}
+		fail bool
+	}{
+		{"12:Hello World!", "Hello World!", false},
+		{"li1e3:abce", []interface{}{int64(1), "abc"}, false},
+		{"d1:ai1ee", map[string]interface{}{"a": int64(1)}, false},
+		{"12:Hello", nil, true},
+		{"", nil, true},
+	}
+	for n, c := range cases {
+		got, err := DecodeItem([]byte(c.b))
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected DecodeItem(%q) to return error: %v, got %v", n, c.b, c.fail, err)
+			continue
+		}
+		if !c.fail && !reflect.DeepEqual(got.V, c.want) {
+			t.Errorf("case %d: expected value %v, got %v", n, c.want, got.V)
+		}
+	}
+}
+
+func TestMessageItem(t *testing.T) {
+	cases := []struct {
+		response map[string]interface{}
+		want     *Item
+		fail     bool
+	}{
+		{map[string]interface{}{"id": "ABCDEFGHIJKLMNOPQRST"}, nil, false},
+		{map[string]interface{}{"v": "Hello World!"}, &Item{V: "Hello World!"}, false},
+		{map[string]interface{}{"v": strings.Repeat("a", MaxItemSize)}, nil, true},
+		{
+			map[string]interface{}{"v": "a", "k": strings.Repeat("k", 32), "seq": int64(3), "sig": strings.Repeat("s", 64)},
+			&Item{V: "a", K: []byte(strings.Repeat("k", 32)), Seq: 3, Sig: []byte(strings.Repeat("s", 64))},
+			false,
+		},
+		{map[string]interface{}{"v": "a", "k": "short", "seq": int64(3), "sig": strings.Repeat("s", 64)}, nil, true},
+		{map[string]interface{}{"v": "a", "k": strings.Repeat("k", 32), "sig": strings.Repeat("s", 64)}, nil, true},
+		{map[string]interface{}{"v": "a", "k": strings.Repeat("k", 32), "seq": int64(3)}, nil, true},
+	}
+	for n, c := range cases {
+		m := NewResponse("aa", c.response)
+		got, err := m.Item()
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected Item() to return error: %v, got %v", n, c.fail, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: expected %v, got %v", n, c.want, got)
+		}
+	}
+}
+
+func TestReadableValue(t *testing.T) {
+	v := []interface{}{"text", "\xff\x00", int64(1), map[string]interface{}{"k": "\xfe"}}
+	want := []interface{}{"text", "0xff00", int64(1), map[string]interface{}{"k": "0xfe"}}
+	if got := readableValue(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("readableValue(%q) = %v, want %v", v, got, want)
+	}
+}
+
+func mustEncodeInfoHash(t *testing.T, h string) string {
+	t.Helper()
+	e, err := EncodeInfoHash(h)
+	if err != nil {
+		t.Fatalf("error encoding %q: %v", h, err)
+	}
+	return e
+}
+
+func TestItemVerify(t *testing.T) {
+	// Test vectors from BEP 44.
+	k := mustDecodeHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	cases := []struct {
+		salt   string
+		sig    string
+		target string
+	}{
+		{"", "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01", "4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar", "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08", "411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+	for n, c := range cases {
+		i := &Item{V: "Hello World!", K: k, Salt: []byte(c.salt), Seq: 1, Sig: mustDecodeHex(t, c.sig)}
+		target := mustEncodeInfoHash(t, c.target)
+		if err := i.Verify(target); err != nil {
+			t.Errorf("case %d: expected item to verify, got %v", n, err)
+		}
+		i.Seq = 2
+		if err := i.Verify(target); err == nil {
+			t.Errorf("case %d: expected item with modified seq not to verify", n)
+		}
+		i.Seq, i.Salt = 1, []byte("other")
+		if err := i.Verify(target); err == nil {
+			t.Errorf("case %d: expected item with modified salt not to verify", n)
+		}
+	}
+}
+
+func TestNewMutableItem(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	i, err := NewMutableItem([]interface{}{"a", int64(1)}, key, []byte("salt"), 7)
+	if err != nil {
+		t.Fatalf("error creating mutable item: %v", err)
+	}
+	target, err := i.Target()
+	if err != nil {
+		t.Fatalf("error computing target: %v", err)
+	}
+	if err := i.Verify(target); err != nil {
+		t.Errorf("expected signed item to verify, got %v", err)
+	}
+	i.V = "b"
+	if err := i.Verify(target); err == nil {
+		t.Errorf("expected item with modified value not to verify")
+	}
+	if _, err := NewMutableItem("a", key, bytes.Repeat([]byte("s"), MaxSaltSize+1), 0); err == nil {
+		t.Errorf("expected item with oversized salt to error")
+	}
+	if _, err := NewMutableItem("a", key[:10], nil, 0); err == nil {
+		t.Errorf("expected item with invalid key to error")
+	}
+}
+
+func mustDecodeHex(t *testing.T, h string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		t.Fatalf("error decoding %q: %v", h, err)
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// itemTTL is how long a stored item is kept without being put again.
+//
+// BEP 44 recommends that items be republished every hour and expire after
+// two hours.
+const itemTTL = 2 * time.Hour
+
+// ItemStore holds the items put to a node, keyed by target.
+type ItemStore struct {
+	mu    sync.Mutex
+	items map[string]storedItem
+	now   func() time.Time
+}
+
+type storedItem struct {
+	item    *Item
+	updated time.Time
+}
+
+// NewItemStore returns an empty ItemStore.
+func NewItemStore() *ItemStore {
+	return &ItemStore{
+		items: make(map[string]storedItem),
+		now:   time.Now,
+	}
+}
+
+// Put stores i under the 20 byte target, replacing any previous item.
+func (s *ItemStore) Put(target string, i *Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[target] = storedItem{i, s.now()}
+}
+
+// Update stores i under the 20 byte target unless check, called with the
+// unexpired item currently stored or nil, returns an error, which is
+// returned.
+func (s *ItemStore) Update(target string, i *Item, check func(cur *Item) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cur *Item
+	if c, ok := s.items[target]; ok && s.now().Sub(c.updated) <= itemTTL {
+		cur = c.item
+	}
+	if err := check(cur); err != nil {
+		return err
+	}
+	s.items[target] = storedItem{i, s.now()}
+	return nil
+}
+
+// Get returns the unexpired item stored under the 20 byte target, or nil if
+// there is none.
+func (s *ItemStore) Get(target string) *Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.items[target]
+	if !ok {
+		return nil
+	}
+	if s.now().Sub(i.updated) > itemTTL {
+		delete(s.items, target)
+		return nil
+	}
+	return i.item
+}
@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// MarshalKey returns the PEM encoding of an ed25519 private key used to sign
+// mutable items, in PKCS #8 form.
+func MarshalKey(key ed25519.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+}
+
+// ParseKey parses a PEM encoded ed25519 private key in PKCS #8 form, as
+// returned by MarshalKey or "openssl genpkey -algorithm ed25519".
+func ParseKey(b []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, want ed25519", key)
+	}
+	return k, nil
+}
+
+// EncodePublicKey encodes a string of hexadecimal characters of an ed25519 public key as the literal bytes it represents.
+func EncodePublicKey(key string) (ed25519.PublicKey, error) {
+	key = strings.TrimPrefix(key, "0x")
+	key = strings.TrimPrefix(key, "0X")
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q: needs to represent %d bytes", key, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(k), nil
+}
@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Prefixes of the info hashes in the "xt" parameters of a magnet link: a v1
+// info hash, and a v2 info hash as a multihash, as defined in BEP 52.
+const (
+	btihPrefix = "urn:btih:"
+	btmhPrefix = "urn:btmh:"
+)
+
+// sha256Multihash prefixes a SHA-256 hash encoded as a multihash: the hash
+// function's code and the hash's length.
+const sha256Multihash = "\x12\x20"
+
+// Magnet is a magnet link to a torrent, as defined in BEP 9.
+//
+// https://www.bittorrent.org/beps/bep_0009.html
+type Magnet struct {
+	// 20 byte v1 info hash of the torrent, "" if it only has a v2 one.
+	InfoHash string
+	// 32 byte v2 info hash of the torrent, as defined in BEP 52, "" if it only
+	// has a v1 one. Hybrid torrents have both.
+	InfoHashV2 string
+	// Display name of the torrent, "" if absent.
+	Name string
+	// Addresses of peers of the torrent, from "x.pe" parameters, as host:port
+	// strings. They aren't resolved, so parsing a link never blocks.
+	Peers []string
+}
+
+// IsMagnet reports whether s is a magnet link.
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "magnet:")
+}
+
+// ParseMagnet parses a magnet link whose "xt" parameters are a BitTorrent v1
+// info hash, hex or base32 encoded, and/or a v2 info hash, hex encoded as a
+// SHA-256 multihash.
+func ParseMagnet(s string) (*Magnet, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet link: %v", err)
+	}
+	if !strings.EqualFold(u.Scheme, "magnet") {
+		return nil, fmt.Errorf("error parsing magnet link: scheme is %q, want magnet", u.Scheme)
+	}
+	// Magnet links are all query, RawQuery is empty if there's no "?".
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet link: %v", err)
+	}
+	m := &Magnet{Name: q.Get("dn"), Peers: q["x.pe"]}
+	// Links to several torrents number their parameters, e.g. xt.1.
+	var keys []string
+	for k := range q {
+		if k == "xt" || strings.HasPrefix(k, "xt.") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, xt := range q[k] {
+			switch lower := strings.ToLower(xt); {
+			case strings.HasPrefix(lower, btihPrefix) && m.InfoHash == "":
+				h, err := decodeHash(xt[len(btihPrefix):])
+				if err == nil && len(h) != 20 {
+					err = fmt.Errorf("invalid infoHash %q: needs to represent 20 bytes", xt[len(btihPrefix):])
+				}
+				if err != nil {
+					return nil, fmt.Errorf("error parsing magnet link: %v", err)
+				}
+				m.InfoHash = h
+			case strings.HasPrefix(lower, btmhPrefix) && m.InfoHashV2 == "":
+				mh, err := hex.DecodeString(xt[len(btmhPrefix):])
+				if err != nil {
+					return nil, fmt.Errorf("error parsing magnet link: %v", err)
+				}
+				if len(mh) != len(sha256Multihash)+32 || !strings.HasPrefix(string(mh), sha256Multihash) {
+					return nil, fmt.Errorf("error parsing magnet link: %q isn't a SHA-256 multihash", xt[len(btmhPrefix):])
+				}
+				m.InfoHashV2 = string(mh[len(sha256Multihash):])
+			}
+		}
+		if m.InfoHash != "" || m.InfoHashV2 != "" {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("error parsing magnet link: no %q or %q info hash", btihPrefix, btmhPrefix)
+}
+
+// InfoHashes returns the 20 byte info hashes m's torrent is looked up by in
+// the DHT, its v1 info hash first.
+func (m *Magnet) InfoHashes() []string {
+	return infoHashes(m.InfoHash, m.InfoHashV2)
+}
+
+// infoHashes returns the 20 byte info hashes a torrent with the given v1 and
+// v2 info hashes, either of which may be "", is looked up by in the DHT. v2
+// info hashes are truncated to 20 bytes, as defined in BEP 52.
+func infoHashes(v1, v2 string) []string {
+	var hashes []string
+	if v1 != "" {
+		hashes = append(hashes, v1)
+	}
+	if v2 != "" {
+		hashes = append(hashes, v2[:20])
+	}
+	return hashes
+}
+
+// InfoHashes returns the 20 byte info hashes the torrent given by infoHash is
+// looked up by in the DHT: both the v1 and truncated v2 ones of a magnet link
+// to a hybrid torrent, or else the one EncodeInfoHash returns.
+func InfoHashes(infoHash string) ([]string, error) {
+	if IsMagnet(infoHash) {
+		m, err := ParseMagnet(infoHash)
+		if err != nil {
+			return nil, err
+		}
+		return m.InfoHashes(), nil
+	}
+	h, err := decodeInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return []string{h}, nil
+}
+
+// decodeInfoHash decodes an info hash written as 40 hexadecimal characters,
+// optionally 0x prefixed, or 32 base32 characters, or a 32 byte v2 info hash
+// written as 64 hexadecimal characters, which is truncated to 20 bytes.
+func decodeInfoHash(infoHash string) (string, error) {
+	h, err := decodeHash(infoHash)
+	if err != nil {
+		return "", err
+	}
+	switch len(h) {
+	case 20:
+		return h, nil
+	case 32:
+		return h[:20], nil
+	}
+	return "", fmt.Errorf("invalid infoHash %q: needs to represent 20 or 32 bytes", infoHash)
+}
+
+// decodeHash decodes a hash written as 32 base32 characters, or as
+// hexadecimal characters, optionally 0x prefixed.
+func decodeHash(s string) (string, error) {
+	var h []byte
+	var err error
+	if len(s) == base32.StdEncoding.EncodedLen(20) {
+		h, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	} else {
+		s = strings.TrimPrefix(s, "0x")
+		s = strings.TrimPrefix(s, "0X")
+		h, err = hex.DecodeString(s)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
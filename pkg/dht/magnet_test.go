@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+const testInfoHash = "\xf0\x9c\x8d\x08\x84\x59\x00\x88\xf4\x00\x4e\x01\x0a\x92\x8f\x8b\x61\x78\xc2\xfd"
+
+func TestEncodeInfoHash(t *testing.T) {
+	cases := []struct {
+		in  string
+		err bool
+	}{
+		{"F09C8D0884590088F4004E010A928F8B6178C2FD", false},
+		{"0xf09c8d0884590088f4004e010a928f8b6178c2fd", false},
+		{"6COI2CEELEAIR5AAJYAQVEUPRNQXRQX5", false},
+		{"6coi2ceeleair5aajyaqveuprnqxrqx5", false},
+		{"magnet:?xt=urn:btih:F09C8D0884590088F4004E010A928F8B6178C2FD&dn=test", false},
+		{"magnet:?xt=urn:btih:6COI2CEELEAIR5AAJYAQVEUPRNQXRQX5", false},
+		{"MAGNET:?dn=test&xt=urn:btih:f09c8d0884590088f4004e010a928f8b6178c2fd", false},
+		{"F09C8D0884590088F4004E010A928F8B6178C2", true},
+		{"6COI2CEELEAIR5AAJYAQVEUPRNQXRQX1", true},
+		{"magnet:?dn=test", true},
+		{"magnet:?xt=urn:sha1:6COI2CEELEAIR5AAJYAQVEUPRNQXRQX5", true},
+		{"magnet:?xt=urn:btih:abc", true},
+		{"F09C8D0884590088F4004E010A928F8B6178C2FD000102030405060708090A0B", false},
+		{"magnet:?xt=urn:btmh:1220F09C8D0884590088F4004E010A928F8B6178C2FD000102030405060708090A0B", false},
+		{"magnet:?xt=urn:btmh:1220F09C8D0884590088F4004E010A928F8B6178C2FD00010203", true},
+		{"magnet:?xt=urn:btmh:1320F09C8D0884590088F4004E010A928F8B6178C2FD000102030405060708090A0B", true},
+		{"F09C8D0884590088F4004E010A928F8B6178C2FD000102", true},
+	}
+	for n, c := range cases {
+		got, err := EncodeInfoHash(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error %v, got %v", n, c.err, err)
+			continue
+		}
+		if !c.err && got != testInfoHash {
+			t.Errorf("case %d: expected %x, got %x", n, testInfoHash, got)
+		}
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	got, err := ParseMagnet("magnet:?xt=urn:btih:F09C8D0884590088F4004E010A928F8B6178C2FD&dn=Some+Torrent&x.pe=10.0.0.1:6881&x.pe=%5B2001:db8::1%5D:51413&tr=udp://tracker:80")
+	if err != nil {
+		t.Fatalf("error parsing magnet link: %v", err)
+	}
+	want := &Magnet{
+		InfoHash: testInfoHash,
+		Name:     "Some Torrent",
+		Peers:    []string{"10.0.0.1:6881", "[2001:db8::1]:51413"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if _, err := ParseMagnet("http://example.com/?xt=urn:btih:F09C8D0884590088F4004E010A928F8B6178C2FD"); err == nil {
+		t.Errorf("expected error parsing link of another scheme")
+	}
+}
+
+func TestParseMagnetHybrid(t *testing.T) {
+	v2 := testInfoHash + "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b"
+	other := "6COI2CEELEAIR5AAJYAQVEUPRNQXRQX6"
+	got, err := ParseMagnet("magnet:?xt=urn:btmh:1220F09C8D0884590088F4004E010A928F8B6178C2FD000102030405060708090A0B&xt=urn:btih:" + other)
+	if err != nil {
+		t.Fatalf("error parsing magnet link: %v", err)
+	}
+	if got.InfoHashV2 != v2 || got.InfoHash == "" {
+		t.Errorf("expected v2 info hash %x and a v1 one, got %+v", v2, got)
+	}
+	if hashes := got.InfoHashes(); len(hashes) != 2 || hashes[0] != got.InfoHash || hashes[1] != testInfoHash {
+		t.Errorf("expected v1 and truncated v2 info hashes, got %x", hashes)
+	}
+	hashes, err := InfoHashes("magnet:?xt=urn:btmh:1220F09C8D0884590088F4004E010A928F8B6178C2FD000102030405060708090A0B")
+	if err != nil || len(hashes) != 1 || hashes[0] != testInfoHash {
+		t.Errorf("expected truncated v2 info hash %x, got %x, %v", testInfoHash, hashes, err)
+	}
+}
+
+func TestAddValues(t *testing.T) {
+	m := NewResponse("aa", map[string]interface{}{
+		"values": []interface{}{"\x0a\x00\x00\x01\x1a\xe1"},
+	})
+	peers := []Peer{
+		{net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}},
+		{net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6881}},
+		{net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}},
+	}
+	n, err := m.AddValues(peers)
+	if err != nil {
+		t.Fatalf("error adding values: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 peers added, got %d", n)
+	}
+	got, err := m.Values()
+	if err != nil {
+		t.Fatalf("error parsing values: %v", err)
+	}
+	if len(got) != 3 || got[1].UDPAddr.String() != "10.0.0.2:6881" || got[2].UDPAddr.String() != "[2001:db8::1]:51413" {
+		t.Errorf("expected values %v, got %v", peers, got)
+	}
+
+	m = NewResponse("aa", nil)
+	if n, err := m.AddValues(peers[:1]); err != nil || n != 1 {
+		t.Errorf("expected 1 peer added to a response without values, got %d, %v", n, err)
+	}
+}
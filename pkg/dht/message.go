@@ -23,13 +23,22 @@ type query string
 
 // Message query types.
 const (
-	announcePeer query = "announce_peer"
-	findNode     query = "find_node"
-	getPeers     query = "get_peers"
-	ping         query = "ping"
+	announcePeer     query = "announce_peer"
+	findNode         query = "find_node"
+	get              query = "get"
+	getPeers         query = "get_peers"
+	ping             query = "ping"
+	put              query = "put"
+	sampleInfohashes query = "sample_infohashes"
 )
 
 // Message encapsulates a DHT message as defined in BEP 5.
+//
+// IP is the compact address of the querier as seen by the responder, included
+// in responses as defined in BEP 42.
+//
+// ReadOnly is 1 in queries from nodes that don't answer queries, which
+// shouldn't be added to routing tables, as defined in BEP 43.
 type Message struct {
 	TransactionID string                 `bencode:"t" json:"t"`
 	Mtype         string                 `bencode:"y" json:"y"`
@@ -38,6 +47,8 @@ type Message struct {
 	Response      map[string]interface{} `bencode:"r,omitempty" json:"r,omitempty"`
 	Error         []interface{}          `bencode:"e,omitempty" json:"e,omitempty"`
 	Version       string                 `bencode:"v,omitempty" json:"v,omitempty"`
+	IP            string                 `bencode:"ip,omitempty" json:"ip,omitempty"`
+	ReadOnly      int64                  `bencode:"ro,omitempty" json:"ro,omitempty"`
 }
 
 // NewRequest returns a new query message with the specified arguments.
@@ -65,24 +76,60 @@ func NewResponse(id string, response map[string]interface{}) *Message {
 	}
 }
 
-// Nodes returns Node objects present in the Message.
+// NewError returns a new error message with the specified code and description.
+func NewError(id string, code int, msg string) *Message {
+	return &Message{
+		TransactionID: id,
+		Mtype:         "e",
+		Error:         []interface{}{code, msg},
+	}
+}
+
+// Nodes returns Node objects present in the "nodes" key of the Message.
 //
 // If the "nodes" key is present in both Arguments and Response dictionaries,
 // an error is returned.
 func (m *Message) Nodes() ([]Node, error) {
-	_, args := m.Arguments["nodes"]
-	_, resp := m.Response["nodes"]
+	nodes, err := m.byteString("nodes")
+	if err != nil {
+		return nil, err
+	}
+	return parseCompactNodesEncoding([]byte(nodes))
+}
+
+// Nodes6 returns Node objects present in the "nodes6" key of the Message, as
+// defined in BEP 32.
+//
+// If the "nodes6" key is present in both Arguments and Response dictionaries,
+// an error is returned.
+func (m *Message) Nodes6() ([]Node, error) {
+	nodes, err := m.byteString("nodes6")
+	if err != nil {
+		return nil, err
+	}
+	return parseCompactNodes6Encoding([]byte(nodes))
+}
+
+// byteString returns the byte string value of key in the Message's Arguments
+// or Response dictionary, or "" if it is absent from both.
+func (m *Message) byteString(key string) (string, error) {
+	a, args := m.Arguments[key]
+	r, resp := m.Response[key]
 	if args && resp {
-		return nil, fmt.Errorf("message has \"nodes\" key present as both an argument and a response: %v", m)
+		return "", fmt.Errorf("message has %q key present as both an argument and a response: %v", key, m)
 	}
-	var nodes string
-	if n, ok := m.Arguments["nodes"]; ok {
-		nodes = n.(string)
+	v := a
+	if resp {
+		v = r
 	}
-	if n, ok := m.Response["nodes"]; ok {
-		nodes = n.(string)
+	if v == nil {
+		return "", nil
 	}
-	return parseCompactNodesEncoding([]byte(nodes))
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("message has %q key of type %T, want string", key, v)
+	}
+	return str, nil
 }
 
 // Values returns Peer objects present in the Message.
@@ -102,36 +149,134 @@ func (m *Message) Values() ([]Peer, error) {
 	if v, ok := m.Response["values"]; ok {
 		values = v
 	}
-	return parseCompactPeersEncoding([]interface{}{values})
+	switch v := values.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		return parseCompactPeersEncoding(v)
+	default:
+		return parseCompactPeersEncoding([]interface{}{v})
+	}
+}
+
+// AddValues adds peers found elsewhere, such as in a magnet link, to the
+// "values" key of a get_peers response, skipping those already in it, and
+// returns how many were added.
+func (m *Message) AddValues(peers []Peer) (int, error) {
+	values, err := m.Values()
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	l := make([]interface{}, 0, len(values)+len(peers))
+	for _, p := range values {
+		seen[p.UDPAddr.String()] = true
+		e, err := encodeCompactPeer(p)
+		if err != nil {
+			return 0, err
+		}
+		l = append(l, e)
+	}
+	added := 0
+	for _, p := range peers {
+		if seen[p.UDPAddr.String()] {
+			continue
+		}
+		e, err := encodeCompactPeer(p)
+		if err != nil {
+			return 0, err
+		}
+		seen[p.UDPAddr.String()] = true
+		l = append(l, e)
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	if m.Response == nil {
+		m.Response = make(map[string]interface{})
+	}
+	m.Response["values"] = l
+	return added, nil
 }
 
 // String pretty prints a message as JSON.
 func (m *Message) String() string {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Printf("error marshalling message: %v", err)
+	}
+	return string(b)
+}
+
+// MarshalJSON marshals a message into JSON, with byte strings translated to
+// hex and known keys such as "nodes" and "values" expanded.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	// message has Message's fields but not its methods, so that copying and
+	// marshalling don't recurse.
+	type message Message
 	c := &Message{}
-	if err := deepcopy.Copy(c, m); err != nil {
+	if err := deepcopy.Copy((*message)(c), (*message)(m)); err != nil {
 		log.Printf("error copying %#v", m)
 	}
 	// Translate byte strings to hex for better readability.
-	c.TransactionID = fmt.Sprintf("0x%x", c.TransactionID)
-	c.Version = fmt.Sprintf("0x%x", c.Version)
+	c.TransactionID = fmt.Sprintf("0x%x", m.TransactionID)
+	c.Version = fmt.Sprintf("0x%x", m.Version)
+	if p, err := m.ExternalAddr(); err == nil && p != nil {
+		c.IP = p.UDPAddr.String()
+	} else if m.IP != "" {
+		c.IP = fmt.Sprintf("0x%x", m.IP)
+	}
 
 	f := func(src, dest map[string]interface{}) {
 		for k, v := range src {
 			switch k {
 			case "nodes":
-				n, err := parseCompactNodesEncoding([]byte(v.(string)))
+				n, err := parseCompactNodesEncoding([]byte(fmt.Sprint(v)))
 				if err != nil {
 					log.Print(err)
 				}
 				dest["nodes"] = n
+			case "nodes6":
+				n, err := parseCompactNodes6Encoding([]byte(fmt.Sprint(v)))
+				if err != nil {
+					log.Print(err)
+				}
+				dest["nodes6"] = n
 			case "values":
-				p, err := parseCompactPeersEncoding(v.([]interface{}))
+				l, ok := v.([]interface{})
+				if !ok {
+					l = []interface{}{v}
+				}
+				p, err := parseCompactPeersEncoding(l)
 				if err != nil {
 					log.Print(err)
 				}
 				dest["values"] = p
+			case "v":
+				dest["v"] = readableValue(v)
+			case "samples":
+				h, err := parseSamples(fmt.Sprint(v))
+				if err != nil {
+					log.Print(err)
+				}
+				samples := make([]string, len(h))
+				for i := range h {
+					samples[i] = fmt.Sprintf("0x%x", h[i])
+				}
+				dest["samples"] = samples
+			case "interval", "num":
+				dest[k] = v
+			case "BFsd", "BFpe":
+				f, err := ParseBloomFilter([]byte(fmt.Sprint(v)))
+				if err != nil {
+					log.Print(err)
+					dest[k] = fmt.Sprintf("0x%x", v)
+					continue
+				}
+				dest[k] = f
 			default:
-				dest[k] = fmt.Sprintf("0x%x", v)
+				dest[k] = hexValue(v)
 			}
 		}
 	}
@@ -139,11 +284,30 @@ func (m *Message) String() string {
 	f(m.Arguments, c.Arguments)
 	f(m.Response, c.Response)
 
-	b, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
-		log.Printf("error marshalling message: %v", err)
+	return json.Marshal((*message)(c))
+}
+
+// hexValue translates the byte strings in a bencoded value to hex, leaving
+// integers as they are.
+func hexValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = hexValue(e)
+		}
+		return l
+	case map[string]interface{}:
+		d := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			d[k] = hexValue(e)
+		}
+		return d
+	default:
+		return fmt.Sprintf("0x%x", v)
 	}
-	return string(b)
 }
 
 // Node encapsulates entries in the "nodes" key in "find_node" and "get_peers" messages.
@@ -152,29 +316,45 @@ type Node struct {
 	Peer *Peer
 }
 
-// MarshalJSON marshals a node object into JSON.
+// MarshalJSON marshals a node object into JSON, along with whether its id is
+// secure, as defined in BEP 42.
 func (n *Node) MarshalJSON() ([]byte, error) {
 	hash := fmt.Sprintf("0x%x", n.ID)
 	return json.Marshal(
 		struct {
-			ID   string `json:"id"`
-			Peer *Peer  `json:"address"`
+			ID     string `json:"id"`
+			Peer   *Peer  `json:"address"`
+			Secure bool   `json:"secure"`
 		}{
 			hash,
 			n.Peer,
+			n.Secure(),
 		})
 }
 
-// parseCompactNodesEncoding parses contact information for nodes.
+// parseCompactNodesEncoding parses contact information for IPv4 nodes.
 func parseCompactNodesEncoding(b []byte) ([]Node, error) {
+	return parseNodes(b, net.IPv4len)
+}
+
+// parseCompactNodes6Encoding parses contact information for IPv6 nodes, as
+// defined in BEP 32.
+func parseCompactNodes6Encoding(b []byte) ([]Node, error) {
+	return parseNodes(b, net.IPv6len)
+}
+
+// parseNodes parses a concatenation of 20 byte node ids each followed by the
+// compact encoding of an ipLen byte address and port.
+func parseNodes(b []byte, ipLen int) ([]Node, error) {
+	size := 20 + ipLen + 2
 	buf := bytes.NewBuffer(b)
-	if buf.Len()%26 != 0 {
-		return nil, fmt.Errorf("compact encoding must be a multiple of 26 bytes long")
+	if buf.Len()%size != 0 {
+		return nil, fmt.Errorf("compact encoding must be a multiple of %d bytes long", size)
 	}
 	var nodes []Node
-	for i := 0; i <= buf.Len()/26; i++ {
+	for n := buf.Len() / size; len(nodes) < n; {
 		id := buf.Next(20)
-		peer, err := parseCompactPeerEncoding(buf.Next(6))
+		peer, err := parseCompactPeerEncoding(buf.Next(ipLen + 2))
 		if err != nil {
 			return nil, err
 		}
@@ -186,11 +366,48 @@ func parseCompactNodesEncoding(b []byte) ([]Node, error) {
 	return nodes, nil
 }
 
+// encodeCompactNodes returns the compact encoding of contact information for
+// the IPv4 nodes in nodes.
+//
+// Nodes without a 20 byte id or an IPv4 address are skipped.
+func encodeCompactNodes(nodes []Node) string {
+	return encodeNodes(nodes, false)
+}
+
+// encodeCompactNodes6 returns the compact encoding of contact information for
+// the IPv6 nodes in nodes, as defined in BEP 32.
+//
+// Nodes without a 20 byte id or an IPv6 address are skipped.
+func encodeCompactNodes6(nodes []Node) string {
+	return encodeNodes(nodes, true)
+}
+
+func encodeNodes(nodes []Node, ipv6 bool) string {
+	buf := bytes.NewBuffer([]byte{})
+	for _, n := range nodes {
+		if len(n.ID) != 20 || n.Peer == nil || n.Peer.IsIPv6() != ipv6 {
+			continue
+		}
+		p, err := encodeCompactPeer(*n.Peer)
+		if err != nil {
+			continue
+		}
+		buf.Write(n.ID)
+		buf.WriteString(p)
+	}
+	return buf.String()
+}
+
 // Peer encapsulates "peer" contact information included in "find_node" and "get_peers" messages.
 type Peer struct {
 	UDPAddr net.UDPAddr
 }
 
+// IsIPv6 reports whether the Peer has an IPv6 address.
+func (p *Peer) IsIPv6() bool {
+	return p.UDPAddr.IP.To4() == nil
+}
+
 // MarshalText encodes the Peer in text format.
 func (p *Peer) MarshalText() ([]byte, error) {
 	return []byte(p.UDPAddr.String()), nil
@@ -200,7 +417,11 @@ func (p *Peer) MarshalText() ([]byte, error) {
 func parseCompactPeersEncoding(e []interface{}) ([]Peer, error) {
 	var peers []Peer
 	for _, c := range e {
-		peer, err := parseCompactPeerEncoding([]byte(c.(string)))
+		s, ok := c.(string)
+		if !ok {
+			return nil, fmt.Errorf("compact peer encoding must be a string, got %T", c)
+		}
+		peer, err := parseCompactPeerEncoding([]byte(s))
 		if err != nil {
 			return nil, err
 		}
@@ -210,12 +431,20 @@ func parseCompactPeersEncoding(e []interface{}) ([]Peer, error) {
 }
 
 // parseCompactPeerEncoding parses contact information for a single peer.
+//
+// IPv4 peers are 6 bytes long and IPv6 peers, defined in BEP 32, are 18 bytes long.
 func parseCompactPeerEncoding(b []byte) (*Peer, error) {
-	if len(b) != 6 {
-		return nil, fmt.Errorf("compact peer encoding must be 6 bytes long")
+	var ip net.IP
+	switch len(b) {
+	case net.IPv4len + 2:
+		ip = net.IPv4(b[0], b[1], b[2], b[3])
+	case net.IPv6len + 2:
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, b)
+	default:
+		return nil, fmt.Errorf("compact peer encoding must be 6 or 18 bytes long")
 	}
-	ip := net.IPv4(b[0], b[1], b[2], b[3])
-	port := binary.BigEndian.Uint16(b[4:])
+	port := binary.BigEndian.Uint16(b[len(b)-2:])
 	return &Peer{
 		net.UDPAddr{
 			IP:   ip,
@@ -223,3 +452,18 @@ func parseCompactPeerEncoding(b []byte) (*Peer, error) {
 		},
 	}, nil
 }
+
+// encodeCompactPeer returns the compact encoding of contact information for a single peer.
+func encodeCompactPeer(p Peer) (string, error) {
+	ip := p.UDPAddr.IP.To4()
+	if ip == nil {
+		ip = p.UDPAddr.IP.To16()
+	}
+	if ip == nil {
+		return "", fmt.Errorf("compact peer encoding requires an IP address, got %v", p.UDPAddr.IP)
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(p.UDPAddr.Port))
+	return string(b), nil
+}
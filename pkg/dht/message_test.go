@@ -1,7 +1,9 @@
 package dht
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"net"
 	"reflect"
 	"testing"
@@ -138,11 +140,13 @@ func TestString(t *testing.T) {
     "nodes": [
       {
         "id": "0x3431343234333434343534363437343834393441",
-        "address": "52.66.52.67:13380"
+        "address": "52.66.52.67:13380",
+        "secure": false
       },
       {
         "id": "0x3445344635303531353235333534433041383031",
-        "address": "48.49.48.48:12598"
+        "address": "48.49.48.48:12598",
+        "secure": false
       }
     ],
     "target": "0x343536",
@@ -189,6 +193,24 @@ func TestString(t *testing.T) {
 	}
 }
 
+func TestMarshalJSON(t *testing.T) {
+	m := &Message{
+		TransactionID: string([]byte{0xff, 0x01}),
+		Mtype:         "r",
+		Response: map[string]interface{}{
+			"id": string([]byte{0xab, 0xcd}),
+		},
+	}
+	got, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned error %v", err)
+	}
+	want := `{"t":"0xff01","y":"r","r":{"id":"0xabcd"},"v":"0x"}`
+	if string(got) != want {
+		t.Errorf("expected json.Marshal() = %v, got %v", want, string(got))
+	}
+}
+
 func TestParseCompactNodesEncoding(t *testing.T) {
 	encoding, err := hex.DecodeString(
 		"4142434445464748494A4B4C4D4E4F5051525354C0A801010016" +
@@ -222,12 +244,61 @@ func TestParseCompactNodesEncoding(t *testing.T) {
 		t.Errorf("expected %v, got %v", want, got)
 	}
 
+	if got, err := parseCompactNodesEncoding(bytes.Repeat(encoding, 4)); err != nil || len(got) != 8 {
+		t.Errorf("expected 8 nodes, got (%v, %v)", got, err)
+	}
+	if got, err := parseCompactNodesEncoding(nil); err != nil || len(got) != 0 {
+		t.Errorf("expected no nodes, got (%v, %v)", got, err)
+	}
+
 	encoding = []byte("12345")
 	if _, err := parseCompactNodesEncoding(encoding); err == nil {
 		t.Errorf("parseCompactNodesEncoding(%v) expected error", encoding)
 	}
 }
 
+func TestParseCompactNodes6Encoding(t *testing.T) {
+	encoding, err := hex.DecodeString(
+		"4142434445464748494A4B4C4D4E4F5051525354" +
+			"20010db8000000000000000000000001" + "0016",
+	)
+	if err != nil {
+		t.Fatalf("error decoding hex string: %v", err)
+	}
+	got, err := parseCompactNodes6Encoding(encoding)
+	if err != nil {
+		t.Fatalf("error parsing compact nodes6 encoding: %v", err)
+	}
+	want := []Node{{
+		ID: []byte("ABCDEFGHIJKLMNOPQRST"),
+		Peer: &Peer{
+			net.UDPAddr{
+				IP:   net.ParseIP("2001:db8::1"),
+				Port: 22,
+			},
+		},
+	}}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if e := encodeCompactNodes6(append(want, Node{ID: []byte("ABCDEFGHIJKLMNOPQRST"), Peer: &Peer{net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}})); e != string(encoding) {
+		t.Errorf("encodeCompactNodes6(%v) = %x, want %x", want, e, encoding)
+	}
+	if e := encodeCompactNodes(want); e != "" {
+		t.Errorf("expected encodeCompactNodes to skip IPv6 nodes, got %x", e)
+	}
+
+	m := &Message{Response: map[string]interface{}{"nodes6": string(encoding)}}
+	if got, err := m.Nodes6(); err != nil || !reflect.DeepEqual(want, got) {
+		t.Errorf("expected Nodes6() = (%v, nil), got (%v, %v)", want, got, err)
+	}
+
+	encoding = encoding[:26]
+	if _, err := parseCompactNodes6Encoding(encoding); err == nil {
+		t.Errorf("parseCompactNodes6Encoding(%v) expected error", encoding)
+	}
+}
+
 func TestParseCompactPeersEncoding(t *testing.T) {
 	encoding, err := hex.DecodeString("C0A801010016")
 	if err != nil {
@@ -273,6 +344,27 @@ func TestParseCompactPeerEncoding(t *testing.T) {
 		t.Errorf("expected %v, got %v", want, got)
 	}
 
+	encoding, err = hex.DecodeString("20010db80000000000000000000000010017")
+	if err != nil {
+		t.Fatalf("error decoding hex string: %v", err)
+	}
+	got, err = parseCompactPeerEncoding(encoding)
+	if err != nil {
+		t.Fatalf("error parsing compact peer encoding: %v", err)
+	}
+	want = &Peer{
+		net.UDPAddr{
+			IP:   net.ParseIP("2001:db8::1"),
+			Port: 23,
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if e, err := encodeCompactPeer(*want); err != nil || e != string(encoding) {
+		t.Errorf("encodeCompactPeer(%v) = (%x, %v), want %x", want, e, err, encoding)
+	}
+
 	encoding = []byte("12345")
 	if _, err := parseCompactPeerEncoding(encoding); err == nil {
 		t.Errorf("parseCompactPeerEncoding(%v) expected error", encoding)
@@ -0,0 +1,157 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Constants of the pcap file format.
+//
+// https://www.tcpdump.org/manpages/pcap-savefile.5.html
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	// linkTypeRaw is LINKTYPE_RAW: packets begin with an IPv4 or IPv6 header.
+	linkTypeRaw = 101
+)
+
+// Capture writes datagrams to a pcap file, wrapped in synthetic IP and UDP
+// headers so that tools such as Wireshark can decode them.
+//
+// A Capture may be shared by many DHTs and used concurrently.
+type Capture struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewCapture returns a Capture writing to w, after writing the pcap file
+// header.
+func NewCapture(w io.Writer) (*Capture, error) {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(h[6:], pcapVersionMinor)
+	// Bytes 8 to 16 are the unused timezone offset and timestamp accuracy.
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	if _, err := w.Write(h); err != nil {
+		return nil, fmt.Errorf("error writing pcap header: %v", err)
+	}
+	return &Capture{w: w}, nil
+}
+
+// Write records a datagram of payload b sent from src to dst.
+//
+// Unspecified addresses, such as those of sockets listening on all interfaces
+// whose route to the other address can't be found, are written in the family
+// of the other address.
+func (c *Capture) Write(src, dst net.UDPAddr, b []byte) error {
+	p := packet(src, dst, b)
+	if len(p) > pcapSnapLen {
+		return fmt.Errorf("datagram of %d bytes is too large to capture", len(b))
+	}
+	now := time.Now()
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(p)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(p)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write(append(h, p...)); err != nil {
+		return fmt.Errorf("error writing pcap packet: %v", err)
+	}
+	return nil
+}
+
+// packet returns an IP packet carrying a UDP datagram of payload b from src to
+// dst.
+func packet(src, dst net.UDPAddr, b []byte) []byte {
+	udp := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], b)
+
+	if ipv4(src.IP) && ipv4(dst.IP) {
+		s4, d4 := src.IP.To4(), dst.IP.To4()
+		if s4 == nil {
+			s4 = net.IPv4zero.To4()
+		}
+		if d4 == nil {
+			d4 = net.IPv4zero.To4()
+		}
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudoHeader(s4, d4, len(udp)), udp))
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 4<<4 | 5 // Version 4, 5 word header.
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // TTL.
+		ip[9] = 17 // UDP.
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		binary.BigEndian.PutUint16(ip[10:], ^uint16(sum(0, ip)))
+		return append(ip, udp...)
+	}
+
+	s6, d6 := src.IP.To16(), dst.IP.To16()
+	if s6 == nil || s6.IsUnspecified() {
+		s6 = net.IPv6unspecified
+	}
+	if d6 == nil || d6.IsUnspecified() {
+		d6 = net.IPv6unspecified
+	}
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudoHeader(s6, d6, len(udp)), udp))
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // UDP.
+	ip[7] = 64 // Hop limit.
+	copy(ip[8:], s6)
+	copy(ip[24:], d6)
+	return append(ip, udp...)
+}
+
+// ipv4 reports whether ip is an IPv4 address or unspecified.
+func ipv4(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified() || ip.To4() != nil
+}
+
+// pseudoHeader returns the fields of the IP header covered by the UDP
+// checksum.
+func pseudoHeader(src, dst net.IP, length int) []byte {
+	h := append(append([]byte{}, src...), dst...)
+	if len(src) == net.IPv4len {
+		return append(h, 0, 17, byte(length>>8), byte(length))
+	}
+	return append(h, byte(length>>24), byte(length>>16), byte(length>>8), byte(length), 0, 0, 0, 17)
+}
+
+// udpChecksum returns the checksum of a UDP datagram, as defined in RFC 768.
+func udpChecksum(pseudo, udp []byte) uint16 {
+	c := ^uint16(sum(sum(0, pseudo), udp))
+	if c == 0 {
+		// Zero means no checksum was computed.
+		return 0xffff
+	}
+	return c
+}
+
+// sum adds b to the 16 bit ones' complement sum s, as defined in RFC 1071.
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// readPcap returns the packets in a pcap file written by a Capture.
+func readPcap(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != pcapMagic || binary.LittleEndian.Uint32(b[20:]) != linkTypeRaw {
+		t.Fatalf("invalid pcap header % x", b[:24])
+	}
+	var packets [][]byte
+	for b = b[24:]; len(b) > 0; {
+		if len(b) < 16 {
+			t.Fatalf("truncated packet header % x", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		if binary.LittleEndian.Uint32(b[12:]) != uint32(n) || len(b) < 16+n {
+			t.Fatalf("invalid packet header % x", b[:16])
+		}
+		packets = append(packets, b[16:16+n])
+		b = b[16+n:]
+	}
+	return packets
+}
+
+func TestPacket(t *testing.T) {
+	payload := []byte("d1:y1:qe")
+	cases := []struct {
+		src, dst net.UDPAddr
+		ipv6     bool
+		srcIP    net.IP
+		dstIP    net.IP
+	}{
+		{
+			net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+			net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 25401},
+			false, net.ParseIP("10.0.0.1").To4(), net.ParseIP("192.168.1.1").To4(),
+		},
+		{
+			net.UDPAddr{IP: net.IPv6unspecified, Port: 6881},
+			net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 25401},
+			false, net.IPv4zero.To4(), net.ParseIP("192.168.1.1").To4(),
+		},
+		{
+			net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			net.UDPAddr{Port: 25401},
+			true, net.ParseIP("2001:db8::1"), net.IPv6unspecified,
+		},
+	}
+	for n, c := range cases {
+		p := packet(c.src, c.dst, payload)
+		var src, dst net.IP
+		var udp []byte
+		if c.ipv6 {
+			if p[0]>>4 != 6 || p[6] != 17 || int(binary.BigEndian.Uint16(p[4:])) != len(p)-40 {
+				t.Errorf("case %d: invalid IPv6 header % x", n, p[:40])
+				continue
+			}
+			src, dst, udp = p[8:24], p[24:40], p[40:]
+		} else {
+			if p[0] != 0x45 || p[9] != 17 || int(binary.BigEndian.Uint16(p[2:])) != len(p) {
+				t.Errorf("case %d: invalid IPv4 header % x", n, p[:20])
+				continue
+			}
+			if s := sum(0, p[:20]); s != 0xffff {
+				t.Errorf("case %d: invalid IPv4 header checksum, sums to %#x", n, s)
+			}
+			src, dst, udp = p[12:16], p[16:20], p[20:]
+		}
+		if !src.Equal(c.srcIP) || !dst.Equal(c.dstIP) {
+			t.Errorf("case %d: expected %v -> %v, got %v -> %v", n, c.srcIP, c.dstIP, src, dst)
+		}
+		if sp, dp := int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[2:])); sp != c.src.Port || dp != c.dst.Port {
+			t.Errorf("case %d: expected ports %d -> %d, got %d -> %d", n, c.src.Port, c.dst.Port, sp, dp)
+		}
+		if s := sum(sum(0, pseudoHeader(src, dst, len(udp))), udp); s != 0xffff {
+			t.Errorf("case %d: invalid UDP checksum, sums to %#x", n, s)
+		}
+		if !bytes.Equal(udp[8:], payload) {
+			t.Errorf("case %d: expected payload %q, got %q", n, payload, udp[8:])
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf)
+	if err != nil {
+		t.Fatalf("error creating capture: %v", err)
+	}
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+	d.SetCapture(c)
+	if _, err := d.Ping(*addr); err != nil {
+		t.Fatalf("error issuing Ping: %v", err)
+	}
+	d.SetCapture(nil)
+	if _, err := d.Ping(*addr); err != nil {
+		t.Fatalf("error issuing Ping: %v", err)
+	}
+	packets := readPcap(t, buf.Bytes())
+	// The test server echoes the query back.
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets captured, got %d", len(packets))
+	}
+	// Our socket listens on all interfaces, so the interface used is recorded.
+	if src, dst := net.IP(packets[0][12:16]), net.IP(packets[1][16:20]); !src.Equal(addr.IP) || !dst.Equal(addr.IP) {
+		t.Errorf("expected packets from and to our address on the loopback interface, got %v and %v", src, dst)
+	}
+	sent, received := packets[0][20:], packets[1][20:]
+	if port := int(binary.BigEndian.Uint16(sent[2:])); port != addr.Port {
+		t.Errorf("expected query sent to port %d, got %d", addr.Port, port)
+	}
+	if port := int(binary.BigEndian.Uint16(received)); port != addr.Port {
+		t.Errorf("expected response received from port %d, got %d", addr.Port, port)
+	}
+	if !bytes.Equal(sent[8:], received[8:]) {
+		t.Errorf("expected echoed payload %q, got %q", sent[8:], received[8:])
+	}
+}
@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// peerTTL is how long an announced peer is kept without being re-announced.
+//
+// BEP 5 leaves this to implementations; 30 minutes matches common clients.
+const peerTTL = 30 * time.Minute
+
+// PeerStore holds the peers announced to a node, keyed by info_hash.
+type PeerStore struct {
+	mu    sync.Mutex
+	peers map[string]map[string]storedPeer
+	now   func() time.Time
+}
+
+type storedPeer struct {
+	peer    Peer
+	seed    bool
+	updated time.Time
+}
+
+// NewPeerStore returns an empty PeerStore.
+func NewPeerStore() *PeerStore {
+	return &PeerStore{
+		peers: make(map[string]map[string]storedPeer),
+		now:   time.Now,
+	}
+}
+
+// Add records p as a peer for the torrent with the given 20 byte infoHash.
+// seed records that the peer has the complete torrent, as defined in BEP 33.
+func (s *PeerStore) Add(infoHash string, p Peer, seed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.peers[infoHash]
+	if !ok {
+		m = make(map[string]storedPeer)
+		s.peers[infoHash] = m
+	}
+	m[p.UDPAddr.String()] = storedPeer{p, seed, s.now()}
+}
+
+// Get returns up to max unexpired peers for the torrent with the given 20
+// byte infoHash. If max is <= 0, all peers are returned. If noseed is set,
+// seeds are left out as defined in BEP 33.
+func (s *PeerStore) Get(infoHash string, max int, noseed bool) []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []Peer
+	for _, p := range s.live(infoHash) {
+		if noseed && p.seed {
+			continue
+		}
+		if max <= 0 || len(peers) < max {
+			peers = append(peers, p.peer)
+		}
+	}
+	return peers
+}
+
+// Filters returns bloom filters of the addresses of the unexpired seeds and
+// of the other peers for the torrent with the given 20 byte infoHash, as
+// defined in BEP 33.
+func (s *PeerStore) Filters(infoHash string) (seeds, peers *BloomFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seeds, peers = &BloomFilter{}, &BloomFilter{}
+	for _, p := range s.live(infoHash) {
+		if p.seed {
+			seeds.Add(p.peer.UDPAddr.IP)
+		} else {
+			peers.Add(p.peer.UDPAddr.IP)
+		}
+	}
+	return seeds, peers
+}
+
+// live returns the unexpired peers for infoHash, forgetting expired ones. s.mu
+// must be held.
+func (s *PeerStore) live(infoHash string) []storedPeer {
+	var peers []storedPeer
+	for k, p := range s.peers[infoHash] {
+		if s.now().Sub(p.updated) > peerTTL {
+			delete(s.peers[infoHash], k)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return peers
+}
+
+// Sample returns up to max info hashes chosen at random among those with
+// unexpired peers, and the number of such info hashes.
+func (s *PeerStore) Sample(max int) ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infoHashes []string
+	for h, m := range s.peers {
+		for k, p := range m {
+			if s.now().Sub(p.updated) > peerTTL {
+				delete(m, k)
+			}
+		}
+		if len(m) == 0 {
+			delete(s.peers, h)
+			continue
+		}
+		infoHashes = append(infoHashes, h)
+	}
+	n := len(infoHashes)
+	rand.Shuffle(n, func(i, j int) {
+		infoHashes[i], infoHashes[j] = infoHashes[j], infoHashes[i]
+	})
+	if len(infoHashes) > max {
+		infoHashes = infoHashes[:max]
+	}
+	return infoHashes, n
+}
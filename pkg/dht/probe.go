@@ -0,0 +1,269 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"regexp"
+	"time"
+)
+
+// protocol is the name of the protocol sent at the start of a peer wire
+// handshake, as defined in BEP 3.
+//
+// https://www.bittorrent.org/beps/bep_0003.html
+const protocol = "BitTorrent protocol"
+
+// Bits of the reserved bytes of a handshake advertising the extension
+// protocol, BEP 10, and the fast extension, BEP 6.
+const (
+	extensionByte, extensionBit = 5, 0x10
+	fastByte, fastBit           = 7, 0x04
+)
+
+// Peer wire messages a probe reads the pieces a peer has from, and those it
+// skips that may be sent before them.
+const (
+	msgHave        = 4
+	msgBitfield    = 5
+	msgPort        = 9
+	msgSuggest     = 0x0d
+	msgHaveAll     = 0x0e
+	msgHaveNone    = 0x0f
+	msgAllowedFast = 0x11
+	msgExtended    = 20
+)
+
+// maxBitfield bounds the length of the bitfield message a probe accepts, a
+// bit per piece of a torrent of over 500,000 pieces.
+const maxBitfield = 1 << 16
+
+// Status of a probed peer.
+const (
+	// StatusSeeder peers have every piece of the torrent.
+	StatusSeeder = "seeder"
+	// StatusLeecher peers are missing pieces.
+	StatusLeecher = "leecher"
+	// StatusUnknown peers completed the handshake, but the probe was called
+	// off before they told which pieces they have.
+	StatusUnknown = "unknown"
+)
+
+// azureusStyle matches peer ids starting with the client's name and version,
+// e.g. "-DC0001-".
+var azureusStyle = regexp.MustCompile(`^-[A-Za-z~]{2}[0-9A-Za-z]{4}-`)
+
+// PeerInfo is what probing a peer of a torrent over the peer wire protocol
+// found out about it.
+type PeerInfo struct {
+	// 20 byte peer id the peer sent in its handshake.
+	PeerID string
+	// Whether the peer supports the extension protocol, as defined in BEP 10.
+	Extensions bool
+	// StatusSeeder, StatusLeecher or StatusUnknown.
+	Status string
+	// Number of pieces the peer has, -1 if it didn't say how many.
+	Pieces int
+}
+
+// Client returns the name and version of the client the peer runs, as
+// encoded at the start of its peer id, or "" if it doesn't follow that
+// convention.
+func (p *PeerInfo) Client() string {
+	return azureusStyle.FindString(p.PeerID)
+}
+
+// MarshalJSON marshals a PeerInfo into JSON.
+func (p *PeerInfo) MarshalJSON() ([]byte, error) {
+	var pieces *int
+	if p.Pieces >= 0 {
+		pieces = &p.Pieces
+	}
+	return json.Marshal(
+		struct {
+			PeerID     string `json:"peer_id"`
+			Client     string `json:"client,omitempty"`
+			Extensions bool   `json:"extensions"`
+			Status     string `json:"status"`
+			Pieces     *int   `json:"pieces,omitempty"`
+		}{
+			fmt.Sprintf("0x%x", p.PeerID),
+			p.Client(),
+			p.Extensions,
+			p.Status,
+			pieces,
+		})
+}
+
+// NewPeerID returns a random peer id identifying dhtcli.
+func NewPeerID() (string, error) {
+	id := make([]byte, 20)
+	copy(id, Version)
+	if _, err := rand.Read(id[len(Version):]); err != nil {
+		return "", fmt.Errorf("error generating peer id: %v", err)
+	}
+	return string(id), nil
+}
+
+// ProbePeer connects to a peer of the torrent with the given info hash over
+// TCP, as peers found in the DHT are contacted, and exchanges a handshake
+// with it, as defined in BEP 3, giving up after timeout or once ctx is done.
+//
+// The peer must echo the info hash back. Its messages are then read, skipping
+// those that may come first such as its BEP 10 extended handshake, to tell
+// seeders from leechers: a bitfield, or have all and have none messages of
+// the fast extension, BEP 6. Peers with no pieces may send none of these, so
+// peers still silent once timeout passes are taken to be leechers without
+// pieces, as are those sending any other message first. If ctx is done first
+// instead, their status is StatusUnknown. Without the torrent's metainfo the
+// number of pieces isn't known, so a bitfield whose bits are all set, apart
+// from trailing padding, is taken to be a seeder's.
+func ProbePeer(ctx context.Context, addr net.TCPAddr, infoHash, peerID string, timeout time.Duration) (*PeerInfo, error) {
+	hash, err := EncodeInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(pctx, "tcp", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer: %v", err)
+	}
+	defer conn.Close()
+	// Unblock reads and writes once pctx is done.
+	stop := context.AfterFunc(pctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	info, err := probe(conn, hash, peerID)
+	if err != nil && pctx.Err() != nil {
+		switch {
+		case info == nil:
+			return nil, fmt.Errorf("error probing peer: %v", pctx.Err())
+		case ctx.Err() != nil:
+			info.Status, info.Pieces = StatusUnknown, -1
+		default:
+			info.Status, info.Pieces = StatusLeecher, 0
+		}
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// probe exchanges a handshake over conn and reads the pieces the peer has.
+//
+// If reading them fails after the handshake was verified, what the handshake
+// told is returned along with the error.
+func probe(conn io.ReadWriter, infoHash, peerID string) (*PeerInfo, error) {
+	if _, err := conn.Write(handshake(infoHash, peerID)); err != nil {
+		return nil, fmt.Errorf("error sending handshake: %v", err)
+	}
+	resp := make([]byte, 1+len(protocol)+8+20+20)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("error reading handshake: %v", err)
+	}
+	if int(resp[0]) != len(protocol) || string(resp[1:1+len(protocol)]) != protocol {
+		return nil, fmt.Errorf("error reading handshake: peer doesn't speak %q", protocol)
+	}
+	reserved := resp[1+len(protocol) : 1+len(protocol)+8]
+	if h := string(resp[1+len(protocol)+8 : len(resp)-20]); h != infoHash {
+		return nil, fmt.Errorf("peer replied with info hash 0x%x, want 0x%x", h, infoHash)
+	}
+	info := &PeerInfo{
+		PeerID:     string(resp[len(resp)-20:]),
+		Extensions: reserved[extensionByte]&extensionBit != 0,
+	}
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return info, fmt.Errorf("error reading bitfield: %v", err)
+		}
+		switch id {
+		case -1, msgExtended, msgPort, msgAllowedFast, msgSuggest:
+			// Keep-alives and messages that may precede the bitfield.
+			continue
+		case msgBitfield:
+			info.Pieces = 0
+			for _, b := range payload {
+				info.Pieces += bits.OnesCount8(b)
+			}
+			info.Status = StatusLeecher
+			if full(payload) {
+				info.Status = StatusSeeder
+			}
+		case msgHaveAll:
+			info.Status, info.Pieces = StatusSeeder, -1
+		case msgHave:
+			// Peers announce pieces one at a time once they have some, but
+			// not all, of them.
+			info.Status, info.Pieces = StatusLeecher, -1
+		case msgHaveNone:
+			info.Status, info.Pieces = StatusLeecher, 0
+		default:
+			// Peers with no pieces may skip straight to other messages.
+			info.Status, info.Pieces = StatusLeecher, 0
+		}
+		return info, nil
+	}
+}
+
+// handshake returns the handshake sent to peers, advertising support for the
+// extension protocol and fast extension.
+func handshake(infoHash, peerID string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(byte(len(protocol)))
+	b.WriteString(protocol)
+	reserved := make([]byte, 8)
+	reserved[extensionByte] |= extensionBit
+	reserved[fastByte] |= fastBit
+	b.Write(reserved)
+	b.WriteString(infoHash)
+	b.WriteString(peerID)
+	return b.Bytes()
+}
+
+// readMessage reads a length prefixed peer wire message, returning its id,
+// -1 for keep-alives, and payload.
+func readMessage(r io.Reader) (int, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 {
+		return -1, nil, nil
+	}
+	if length > maxBitfield+1 {
+		return 0, nil, fmt.Errorf("message of %d bytes is too long", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return int(b[0]), b[1:], nil
+}
+
+// full reports whether every bit of a bitfield is set, apart from those
+// padding its last byte.
+func full(bitfield []byte) bool {
+	if len(bitfield) == 0 {
+		return false
+	}
+	for _, b := range bitfield[:len(bitfield)-1] {
+		if b != 0xff {
+			return false
+		}
+	}
+	last := bitfield[len(bitfield)-1]
+	// The set bits of the last byte must be leading ones.
+	return last != 0 && last == ^byte(0xff>>bits.LeadingZeros8(^last))
+}
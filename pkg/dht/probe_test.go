@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePeer accepts a single connection on localhost, reads a handshake and
+// replies with reply.
+func fakePeer(t *testing.T, reply []byte) net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+			return
+		}
+		conn.Write(reply)
+		// Hold the connection open until the prober is done with it.
+		io.Copy(io.Discard, conn)
+	}()
+	return *l.Addr().(*net.TCPAddr)
+}
+
+// probeTimeout is long enough for in-process fakes to answer even on a busy
+// machine.
+const probeTimeout = time.Second
+
+// message returns a length prefixed peer wire message.
+func message(id byte, payload string) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(1+len(payload)))
+	return string(b) + string(id) + payload
+}
+
+func TestProbePeer(t *testing.T) {
+	peerID := "-XX0100-abcdefghijkl"
+	reserved := "\x00\x00\x00\x00\x00\x10\x00\x04"
+	hs := "\x13BitTorrent protocol" + reserved + testInfoHash + peerID
+	cases := []struct {
+		reply string
+		want  PeerInfo
+	}{
+		{hs + message(msgBitfield, "\xff\xe0"), PeerInfo{peerID, true, StatusSeeder, 11}},
+		{hs + "\x00\x00\x00\x00" + message(msgBitfield, "\xff\x60"), PeerInfo{peerID, true, StatusLeecher, 10}},
+		{hs + message(msgHaveAll, ""), PeerInfo{peerID, true, StatusSeeder, -1}},
+		{hs + message(msgHaveNone, ""), PeerInfo{peerID, true, StatusLeecher, 0}},
+		// Extended handshakes and the like may come before the bitfield.
+		{hs + message(msgExtended, "\x00de") + message(msgPort, "\x1a\xe1") + message(msgBitfield, "\xff"), PeerInfo{peerID, true, StatusSeeder, 8}},
+		{hs + message(msgAllowedFast, "\x00\x00\x00\x01") + message(msgSuggest, "\x00\x00\x00\x02") + message(msgHave, "\x00\x00\x00\x03"), PeerInfo{peerID, true, StatusLeecher, -1}},
+		{strings.Replace(hs, reserved, strings.Repeat("\x00", 8), 1) + message(1, ""), PeerInfo{peerID, false, StatusLeecher, 0}},
+		// Silent after the handshake, until the probe times out.
+		{hs, PeerInfo{peerID, true, StatusLeecher, 0}},
+	}
+	for n, c := range cases {
+		addr := fakePeer(t, []byte(c.reply))
+		got, err := ProbePeer(context.Background(), addr, "F09C8D0884590088F4004E010A928F8B6178C2FD", "-DC0001-abcdefghijkl", probeTimeout)
+		if err != nil {
+			t.Errorf("case %d: error probing peer: %v", n, err)
+			continue
+		}
+		if *got != c.want {
+			t.Errorf("case %d: expected %+v, got %+v", n, c.want, *got)
+		}
+	}
+	if got := (&PeerInfo{PeerID: peerID}).Client(); got != "-XX0100-" {
+		t.Errorf("expected client -XX0100-, got %q", got)
+	}
+}
+
+func TestProbePeerCancelled(t *testing.T) {
+	peerID := "-XX0100-abcdefghijkl"
+	hs := "\x13BitTorrent protocol" + strings.Repeat("\x00", 8) + testInfoHash + peerID
+	// A peer still silent when ctx is done, rather than when the probe times
+	// out, hasn't been shown to be a leecher.
+	addr := fakePeer(t, []byte(hs))
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	got, err := ProbePeer(ctx, addr, "F09C8D0884590088F4004E010A928F8B6178C2FD", "-DC0001-abcdefghijkl", time.Minute)
+	if err != nil {
+		t.Fatalf("error probing peer: %v", err)
+	}
+	if want := (PeerInfo{peerID, false, StatusUnknown, -1}); *got != want {
+		t.Errorf("expected %+v, got %+v", want, *got)
+	}
+}
+
+func TestProbePeerErrors(t *testing.T) {
+	other := strings.Repeat("\x01", 20)
+	cases := []string{
+		// Another torrent.
+		"\x13BitTorrent protocol" + strings.Repeat("\x00", 8) + other + strings.Repeat("p", 20),
+		// Another protocol.
+		"\x13BitTorrent Protocol" + strings.Repeat("\x00", 8) + testInfoHash + strings.Repeat("p", 20),
+		// Truncated handshake, until the probe times out.
+		"\x13BitTorrent protocol",
+	}
+	for n, c := range cases {
+		addr := fakePeer(t, []byte(c))
+		got, err := ProbePeer(context.Background(), addr, "F09C8D0884590088F4004E010A928F8B6178C2FD", "-DC0001-abcdefghijkl", probeTimeout)
+		if err == nil {
+			t.Errorf("case %d: expected error, got %+v", n, got)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	cases := []struct {
+		bitfield string
+		want     bool
+	}{
+		{"\xff", true},
+		{"\xff\x80", true},
+		{"\xff\xfe", true},
+		{"\xfe", true},
+		{"\xff\x00", false},
+		{"\xff\x40", false},
+		{"\x7f\xff", false},
+		{"", false},
+	}
+	for n, c := range cases {
+		if got := full([]byte(c.bitfield)); got != c.want {
+			t.Errorf("case %d: expected %v for %x, got %v", n, c.want, c.bitfield, got)
+		}
+	}
+}
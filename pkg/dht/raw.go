@@ -0,0 +1,138 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Prefixes of JSON strings parsed by ParseArguments as byte strings given in
+// another encoding.
+const (
+	hexPrefix    = "hex:"
+	base64Prefix = "b64:"
+	stringPrefix = "str:"
+)
+
+// ParseArguments parses a JSON object into the arguments dictionary of a query
+// that dhtcli doesn't model.
+//
+// Strings prefixed with "hex:" or "b64:" are decoded from hexadecimal or
+// standard base64 into the byte strings they represent, and the prefix "str:"
+// is dropped from strings that would otherwise start with one of them. Numbers
+// must be integers, and true and false become 1 and 0, since bencode has
+// neither fractions nor booleans.
+func ParseArguments(b []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error parsing arguments: %v", err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("error parsing arguments: trailing data after JSON object")
+	}
+	args, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("arguments must be a JSON object, got %s", b)
+	}
+	a, err := argument("", args)
+	if err != nil {
+		return nil, err
+	}
+	return a.(map[string]interface{}), nil
+}
+
+// argument translates a decoded JSON value at path into a bencodable one.
+func argument(path string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			a, err := argument(path+"/"+k, x)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = a
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, x := range v {
+			a, err := argument(fmt.Sprintf("%v/%d", path, i), x)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = a
+		}
+		return l, nil
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("argument %v: %v is not an integer", path, v)
+		}
+		return i, nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		switch {
+		case strings.HasPrefix(v, hexPrefix):
+			b, err := hex.DecodeString(strings.TrimPrefix(v, hexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("argument %v: %v", path, err)
+			}
+			return string(b), nil
+		case strings.HasPrefix(v, base64Prefix):
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, base64Prefix))
+			if err != nil {
+				return nil, fmt.Errorf("argument %v: %v", path, err)
+			}
+			return string(b), nil
+		}
+		return strings.TrimPrefix(v, stringPrefix), nil
+	}
+	return nil, fmt.Errorf("argument %v: null can't be bencoded", path)
+}
+
+// NewQuery returns a query message calling method with args, which dhtcli may
+// not otherwise model. The "id" argument is set to d.ID unless args has one.
+func (d *DHT) NewQuery(method string, args map[string]interface{}) (*Message, error) {
+	a := map[string]interface{}{"id": d.ID}
+	for k, v := range args {
+		a[k] = v
+	}
+	req, err := NewRequest(query(method), a)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %v request: %v", method, err)
+	}
+	return req, nil
+}
+
+// Query issues a query message, such as one returned by NewQuery, to a DHT
+// node and returns its response.
+//
+// Unlike other queries, if the node replies with an error, the reply is
+// returned along with the *KRPCError.
+func (d *DHT) Query(server net.UDPAddr, req *Message) (*Message, error) {
+	return d.QueryContext(context.Background(), server, req)
+}
+
+// QueryContext is like Query but gives up once ctx is done.
+func (d *DHT) QueryContext(ctx context.Context, server net.UDPAddr, req *Message) (*Message, error) {
+	resp, err := d.exchange(ctx, server, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.KRPCError(); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
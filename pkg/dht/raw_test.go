@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArguments(t *testing.T) {
+	cases := []struct {
+		json string
+		want map[string]interface{}
+		err  bool
+	}{
+		{`{}`, map[string]interface{}{}, false},
+		{
+			`{"target": "hex:00ff", "token": "b64:AAE=", "name": "abc", "escaped": "str:hex:00"}`,
+			map[string]interface{}{"target": "\x00\xff", "token": "\x00\x01", "name": "abc", "escaped": "hex:00"},
+			false,
+		},
+		{
+			`{"port": 6881, "scrape": true, "noseed": false, "want": ["n4", "n6"], "d": {"k": "hex:61"}}`,
+			map[string]interface{}{
+				"port":   int64(6881),
+				"scrape": int64(1),
+				"noseed": int64(0),
+				"want":   []interface{}{"n4", "n6"},
+				"d":      map[string]interface{}{"k": "a"},
+			},
+			false,
+		},
+		{`{"target": "hex:0g"}`, nil, true},
+		{`{"token": "b64:!"}`, nil, true},
+		{`{"port": 1.5}`, nil, true},
+		{`{"id": null}`, nil, true},
+		{`["id"]`, nil, true},
+		{`{} {}`, nil, true},
+		{`{`, nil, true},
+	}
+	for n, c := range cases {
+		got, err := ParseArguments([]byte(c.json))
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error %v, got %v", n, c.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: expected %v, got %v", n, c.want, got)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+	req, err := d.NewQuery("vote", map[string]interface{}{"target": "abc", "vote": int64(5)})
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+	want := map[string]interface{}{"id": d.ID, "target": "abc", "vote": int64(5)}
+	if req.Query != "vote" || !reflect.DeepEqual(req.Arguments, want) {
+		t.Errorf("expected vote query with arguments %v, got %v query with %v", want, req.Query, req.Arguments)
+	}
+	// The test server echoes queries back.
+	got, err := d.Query(*addr, req)
+	if err != nil {
+		t.Fatalf("error issuing query: %v", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("expected %v, got %v", req, got)
+	}
+
+	req, err = d.NewQuery("ping", map[string]interface{}{"id": "01234567890123456789"})
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+	if id := req.Arguments["id"]; id != "01234567890123456789" {
+		t.Errorf("expected id argument to be kept, got %q", id)
+	}
+}
@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultRetries is how many times a query is retransmitted before giving up
+// unless DHT.Retries is set otherwise.
+const DefaultRetries = 1
+
+// Bounds on the retransmission timeout derived from a node's round trip time.
+const (
+	minRTO = 200 * time.Millisecond
+	maxRTO = 10 * time.Second
+)
+
+// RTT is the smoothed round trip time estimate of a node, maintained as
+// described in RFC 6298 for TCP retransmission timeouts, along with whether
+// the node is responding at all.
+//
+// https://www.rfc-editor.org/rfc/rfc6298
+type RTT struct {
+	// Smoothed round trip time and its variation. Zero until the first
+	// sample.
+	SRTT, RTTVar time.Duration
+	// Whether the node failed to respond to the last query sent to it.
+	Dead bool
+}
+
+// sample folds a round trip time measurement r into the estimate.
+func (e *RTT) sample(r time.Duration) {
+	if e.SRTT == 0 {
+		e.SRTT = r
+		e.RTTVar = r / 2
+		return
+	}
+	diff := e.SRTT - r
+	if diff < 0 {
+		diff = -diff
+	}
+	e.RTTVar = (3*e.RTTVar + diff) / 4
+	e.SRTT = (7*e.SRTT + r) / 8
+}
+
+// rto returns how long to wait for a response before retransmitting, or 0 if
+// the node's round trip time is unknown.
+func (e *RTT) rto() time.Duration {
+	if e.SRTT == 0 {
+		return 0
+	}
+	rto := e.SRTT + 4*e.RTTVar
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// schedule returns how long to wait for the first response from server
+// before retransmitting, and how many times to retransmit.
+//
+// Nodes whose round trip time is unknown are retransmitted to so that the last
+// wait ends along with d.Timeout, and nodes that failed to respond to their
+// last query aren't retried.
+func (d *DHT) schedule(server net.UDPAddr) (time.Duration, int) {
+	timeout := d.timeout()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	retries := d.Retries
+	e, ok := d.rtt[server.String()]
+	if ok && e.Dead {
+		retries = 0
+	}
+	if ok && e.rto() != 0 {
+		return e.rto(), retries
+	}
+	// Waits double with each attempt, so the first is 1/(2^attempts-1) of the
+	// total.
+	attempts := retries + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 30 {
+		attempts = 30
+	}
+	return timeout / time.Duration(1<<attempts-1), retries
+}
+
+// timeout returns how long a query waits for a response, retransmissions
+// included.
+func (d *DHT) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return d.Timeout
+}
+
+// observe records the outcome of a query to server. r is the round trip time
+// of the response, or 0 if it can't be measured, as when the response could
+// be to any of several retransmissions.
+func (d *DHT) observe(server net.UDPAddr, r time.Duration, responded bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.rtt[server.String()]
+	if !ok {
+		e = &RTT{}
+		d.rtt[server.String()] = e
+	}
+	e.Dead = !responded
+	if r > 0 {
+		e.sample(r)
+	}
+}
+
+// NodeRTT returns the round trip time estimate of the node at server, and
+// whether it has been queried.
+func (d *DHT) NodeRTT(server net.UDPAddr) (RTT, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.rtt[server.String()]
+	if !ok {
+		return RTT{}, false
+	}
+	return *e, true
+}
+
+// SetNodeRTT seeds the round trip time estimate of the node at server, e.g.
+// with one saved from an earlier run.
+func (d *DHT) SetNodeRTT(server net.UDPAddr, r RTT) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rtt[server.String()] = &r
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestRTT(t *testing.T) {
+	tests := []struct {
+		samples []time.Duration
+		srtt    time.Duration
+		rttvar  time.Duration
+		rto     time.Duration
+	}{
+		{nil, 0, 0, 0},
+		{[]time.Duration{100 * time.Millisecond}, 100 * time.Millisecond, 50 * time.Millisecond, 300 * time.Millisecond},
+		{[]time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, 100 * time.Millisecond, 37500 * time.Microsecond, 250 * time.Millisecond},
+		{[]time.Duration{100 * time.Millisecond, 900 * time.Millisecond}, 200 * time.Millisecond, 237500 * time.Microsecond, 1150 * time.Millisecond},
+		// Clamped to minRTO and maxRTO.
+		{[]time.Duration{10 * time.Millisecond}, 10 * time.Millisecond, 5 * time.Millisecond, minRTO},
+		{[]time.Duration{8 * time.Second}, 8 * time.Second, 4 * time.Second, maxRTO},
+	}
+	for _, test := range tests {
+		var e RTT
+		for _, r := range test.samples {
+			e.sample(r)
+		}
+		if e.SRTT != test.srtt || e.RTTVar != test.rttvar {
+			t.Errorf("after samples %v, expected srtt %v and rttvar %v, got %v and %v", test.samples, test.srtt, test.rttvar, e.SRTT, e.RTTVar)
+		}
+		if rto := e.rto(); rto != test.rto {
+			t.Errorf("after samples %v, expected rto %v, got %v", test.samples, test.rto, rto)
+		}
+	}
+}
+
+// lossyServer replies to pings after dropping the first drop of them.
+func lossyServer(t *testing.T, drop int) net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if drop > 0 {
+				drop--
+				continue
+			}
+			m := &Message{}
+			if err := bencode.DecodeBytes(buf[:n], m); err != nil {
+				continue
+			}
+			resp := bytes.NewBuffer([]byte{})
+			if err := bencode.NewEncoder(resp).Encode(NewResponse(m.TransactionID, map[string]interface{}{"id": "abcdefghij0123456789"})); err != nil {
+				return
+			}
+			conn.WriteToUDP(resp.Bytes(), from)
+		}
+	}()
+	return *conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestQueryRetries(t *testing.T) {
+	tests := []struct {
+		drop    int
+		retries int
+		wantErr bool
+	}{
+		{0, 0, false},
+		{1, 0, true},
+		{1, 1, false},
+		{2, 1, true},
+		{2, 2, false},
+	}
+	for _, test := range tests {
+		server := lossyServer(t, test.drop)
+		d, err := New()
+		if err != nil {
+			t.Fatalf("error creating new DHT object: %v", err)
+		}
+		d.Timeout = 50 * time.Millisecond
+		d.Retries = test.retries
+		_, err = d.Ping(server)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("dropping %d pings with %d retries, expected error %v, got %v", test.drop, test.retries, test.wantErr, err)
+		}
+		d.Close()
+	}
+}
+
+func TestQuerySchedule(t *testing.T) {
+	server := lossyServer(t, 0)
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+	d.Timeout = 7 * time.Second
+	d.Retries = 2
+	// Waits of 1s, 2s and 4s add up to d.Timeout.
+	if rto, retries := d.schedule(server); rto != time.Second || retries != 2 {
+		t.Errorf("expected unknown node to be waited on for %v with 2 retries, got %v with %d", time.Second, rto, retries)
+	}
+	if _, err := d.Ping(server); err != nil {
+		t.Fatalf("error pinging: %v", err)
+	}
+	// A node on the loopback interface responds far faster than d.Timeout.
+	if rto, retries := d.schedule(server); rto != minRTO || retries != 2 {
+		t.Errorf("expected responsive node to be waited on for %v with 2 retries, got %v with %d", minRTO, rto, retries)
+	}
+	d.observe(server, 0, false)
+	if rto, retries := d.schedule(server); rto != minRTO || retries != 0 {
+		t.Errorf("expected dead node to be waited on for %v without retries, got %v with %d", minRTO, rto, retries)
+	}
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MaxSampleInterval is the longest interval a node may ask to be left alone
+// for between sample_infohashes queries, as defined in BEP 51.
+const MaxSampleInterval = 6 * time.Hour
+
+// Samples is the parsed response to a "sample_infohashes" query, as defined
+// in BEP 51.
+//
+// https://www.bittorrent.org/beps/bep_0051.html
+type Samples struct {
+	// 20 byte info hashes sampled from those the node stores peers for.
+	InfoHashes []string
+	// Num is the number of info hashes the node stores peers for.
+	Num int64
+	// Interval is how long to wait before querying the node again.
+	Interval time.Duration
+	// Nodes close to the query's target, to continue sampling with.
+	Nodes []Node
+}
+
+// Samples returns the parsed "samples", "num", "interval", "nodes" and
+// "nodes6" keys of a sample_infohashes response.
+func (m *Message) Samples() (*Samples, error) {
+	samples, err := m.byteString("samples")
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseSamples(samples)
+	if err != nil {
+		return nil, err
+	}
+	num, _ := m.Response["num"].(int64)
+	interval, _ := m.Response["interval"].(int64)
+	if interval < 0 {
+		interval = 0
+	}
+	if max := int64(MaxSampleInterval / time.Second); interval > max {
+		interval = max
+	}
+	ret := &Samples{
+		InfoHashes: h,
+		Num:        num,
+		Interval:   time.Duration(interval) * time.Second,
+	}
+	nodes, err := m.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	nodes6, err := m.Nodes6()
+	if err != nil {
+		return nil, err
+	}
+	ret.Nodes = append(nodes, nodes6...)
+	return ret, nil
+}
+
+// parseSamples splits the concatenation of 20 byte info hashes in the
+// "samples" key of a sample_infohashes response.
+func parseSamples(s string) ([]string, error) {
+	if len(s)%20 != 0 {
+		return nil, fmt.Errorf("samples must be a multiple of 20 bytes long, got %d", len(s))
+	}
+	var h []string
+	for i := 0; i < len(s); i += 20 {
+		h = append(h, s[i:i+20])
+	}
+	return h, nil
+}
+
+// MarshalJSON marshals Samples into JSON.
+func (s *Samples) MarshalJSON() ([]byte, error) {
+	h := make([]string, len(s.InfoHashes))
+	for i := range s.InfoHashes {
+		h[i] = fmt.Sprintf("0x%x", s.InfoHashes[i])
+	}
+	nodes := s.Nodes
+	if nodes == nil {
+		nodes = []Node{}
+	}
+	return json.Marshal(
+		struct {
+			Samples  []string `json:"samples"`
+			Num      int64    `json:"num"`
+			Interval int64    `json:"interval"`
+			Nodes    []Node   `json:"nodes"`
+		}{
+			h,
+			s.Num,
+			int64(s.Interval / time.Second),
+			nodes,
+		})
+}
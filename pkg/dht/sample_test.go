@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageSamples(t *testing.T) {
+	node := "ABCDEFGHIJKLMNOPQRST" + string([]byte{0x7F, 0x00, 0x00, 0x01, 0x1A, 0xE1})
+	cases := []struct {
+		resp     map[string]interface{}
+		samples  int
+		num      int64
+		interval time.Duration
+		nodes    int
+		fail     bool
+	}{
+		{map[string]interface{}{}, 0, 0, 0, 0, false},
+		{map[string]interface{}{
+			"samples":  strings.Repeat("a", 40),
+			"num":      int64(5),
+			"interval": int64(60),
+			"nodes":    node,
+		}, 2, 5, time.Minute, 1, false},
+		// Intervals are capped at MaxSampleInterval.
+		{map[string]interface{}{"interval": int64(1 << 40)}, 0, 0, MaxSampleInterval, 0, false},
+		{map[string]interface{}{"samples": "abc"}, 0, 0, 0, 0, true},
+		{map[string]interface{}{"nodes": "abc"}, 0, 0, 0, 0, true},
+	}
+	for n, c := range cases {
+		m := NewResponse("aa", c.resp)
+		s, err := m.Samples()
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected Samples() to return error: %v, got %v", n, c.fail, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(s.InfoHashes) != c.samples || s.Num != c.num || s.Interval != c.interval || len(s.Nodes) != c.nodes {
+			t.Errorf("case %d: expected %d samples, num %d, interval %v and %d nodes, got %+v", n, c.samples, c.num, c.interval, c.nodes, s)
+		}
+	}
+}
+
+func TestServerSampleInfohashes(t *testing.T) {
+	_, client, server := newTestServer(t)
+	target := "4142434445464748494A4B4C4D4E4F5051525354"
+	resp, err := client.SampleInfohashes(server, target)
+	if err != nil {
+		t.Fatalf("error issuing SampleInfohashes: %v", err)
+	}
+	s, err := resp.Samples()
+	if err != nil {
+		t.Fatalf("error parsing samples: %v", err)
+	}
+	if len(s.InfoHashes) != 0 || s.Num != 0 || s.Interval != sampleInterval {
+		t.Errorf("expected no samples, got %+v", s)
+	}
+
+	for _, infoHash := range []string{target, "4142434445464748494A4B4C4D4E4F5051525355"} {
+		resp, err := client.GetPeers(server, infoHash)
+		if err != nil {
+			t.Fatalf("error issuing GetPeers: %v", err)
+		}
+		token, _ := resp.Response["token"].(string)
+		if _, err := client.AnnouncePeer(server, infoHash, fmt.Sprintf("%x", token), 6881); err != nil {
+			t.Fatalf("error issuing AnnouncePeer: %v", err)
+		}
+	}
+	resp, err = client.SampleInfohashes(server, target)
+	if err != nil {
+		t.Fatalf("error issuing SampleInfohashes: %v", err)
+	}
+	if s, err = resp.Samples(); err != nil {
+		t.Fatalf("error parsing samples: %v", err)
+	}
+	if len(s.InfoHashes) != 2 || s.Num != 2 {
+		t.Errorf("expected 2 samples, got %+v", s)
+	}
+
+	if _, err := client.SampleInfohashes(server, "123"); err == nil {
+		t.Errorf("expected SampleInfohashes with an invalid target to error")
+	}
+}
+
+func TestPeerStoreSample(t *testing.T) {
+	s := NewPeerStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	for _, h := range []string{"a", "b", "c"} {
+		s.Add(h, Peer{}, false)
+	}
+	if got, n := s.Sample(2); len(got) != 2 || n != 3 {
+		t.Errorf("expected 2 of 3 info hashes, got %v of %d", got, n)
+	}
+	if got, n := s.Sample(5); len(got) != 3 || n != 3 {
+		t.Errorf("expected 3 of 3 info hashes, got %v of %d", got, n)
+	}
+	now = now.Add(peerTTL + time.Second)
+	if got, n := s.Sample(5); len(got) != 0 || n != 0 {
+		t.Errorf("expected info hashes to expire, got %v of %d", got, n)
+	}
+}
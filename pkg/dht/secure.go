@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+// castagnoli is the CRC32-C table node ids are derived with, as defined in BEP 42.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Masks applied to IP addresses before hashing them, as defined in BEP 42.
+var (
+	secureMask4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	secureMask6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// secureCRC returns the CRC32-C of ip masked and combined with the 3 bit
+// random number r, as defined in BEP 42.
+func secureCRC(ip net.IP, r byte) uint32 {
+	mask := secureMask6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, secureMask4
+	}
+	b := make([]byte, len(mask))
+	for i := range mask {
+		b[i] = ip[i] & mask[i]
+	}
+	b[0] |= (r & 0x7) << 5
+	return crc32.Checksum(b, castagnoli)
+}
+
+// SecureID returns a random 20 byte node id derived from our external IP
+// address, as defined in BEP 42.
+//
+// Nodes enforcing BEP 42 only keep nodes whose ids match their address in
+// their routing tables, which makes it expensive to place many nodes close to
+// a target.
+func SecureID(ip net.IP) (string, error) {
+	if ip.To4() == nil && len(ip) != net.IPv6len {
+		return "", fmt.Errorf("invalid IP address %v", ip)
+	}
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	crc := secureCRC(ip, id[19])
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], crc)
+	id[0], id[1] = c[0], c[1]
+	id[2] = c[2]&0xf8 | id[2]&0x7
+	return string(id), nil
+}
+
+// SetSecureID replaces the DHT's node id with one derived from ip, our
+// external IP address, as defined in BEP 42, unless it already is. Routing
+// tables are built around the node id, so it must be set before they are.
+func (d *DHT) SetSecureID(ip net.IP) error {
+	if SecureIDValid([]byte(d.ID), ip) {
+		return nil
+	}
+	id, err := SecureID(ip)
+	if err != nil {
+		return err
+	}
+	d.ID = id
+	return nil
+}
+
+// SecureIDValid reports whether the 20 byte node id is derived from ip as
+// defined in BEP 42. Local addresses, which can't be verified, are always
+// valid.
+func SecureIDValid(id []byte, ip net.IP) bool {
+	if len(id) != 20 {
+		return false
+	}
+	if isLocal(ip) {
+		return true
+	}
+	if ip.To4() == nil && len(ip) != net.IPv6len {
+		return false
+	}
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], secureCRC(ip, id[19]))
+	return id[0] == c[0] && id[1] == c[1] && id[2]&0xf8 == c[2]&0xf8
+}
+
+// isLocal reports whether ip is a loopback, private or link-local address,
+// which BEP 42 exempts from verification.
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// Secure reports whether the node's id is derived from its IP address as
+// defined in BEP 42.
+func (n *Node) Secure() bool {
+	return n.Peer != nil && SecureIDValid(n.ID, n.Peer.UDPAddr.IP)
+}
+
+// ExternalAddr returns our own address as seen by the node that sent the
+// Message, from its "ip" key as defined in BEP 42, or nil if absent.
+func (m *Message) ExternalAddr() (*Peer, error) {
+	if m.IP == "" {
+		return nil, nil
+	}
+	return parseCompactPeerEncoding([]byte(m.IP))
+}
@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSecureIDValid(t *testing.T) {
+	// Test vectors from BEP 42. Only the first 21 bits of the id are derived
+	// from the IP address; the last byte is the random number.
+	cases := []struct {
+		ip     string
+		rand   byte
+		prefix []byte
+	}{
+		{"124.31.75.21", 1, []byte{0x5f, 0xbf, 0xbf}},
+		{"21.75.31.124", 86, []byte{0x5a, 0x3c, 0xe9}},
+		{"65.23.51.170", 22, []byte{0xa5, 0xd4, 0x32}},
+		{"84.124.73.14", 65, []byte{0x1b, 0x03, 0x21}},
+		{"43.213.53.83", 90, []byte{0xe5, 0x6f, 0x6c}},
+	}
+	for n, c := range cases {
+		id := make([]byte, 20)
+		copy(id, c.prefix)
+		id[19] = c.rand
+		ip := net.ParseIP(c.ip)
+		if !SecureIDValid(id, ip) {
+			t.Errorf("case %d: expected id 0x%x to be valid for %v", n, id, ip)
+		}
+		id[0] ^= 0xff
+		if SecureIDValid(id, ip) {
+			t.Errorf("case %d: expected id 0x%x to be invalid for %v", n, id, ip)
+		}
+	}
+}
+
+func TestSecureID(t *testing.T) {
+	cases := []struct {
+		ip   string
+		fail bool
+	}{
+		{"124.31.75.21", false},
+		{"2001:db8::1", false},
+		{"", true},
+	}
+	for n, c := range cases {
+		ip := net.ParseIP(c.ip)
+		id, err := SecureID(ip)
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected SecureID(%v) to return error: %v, got %v", n, ip, c.fail, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(id) != 20 || !SecureIDValid([]byte(id), ip) {
+			t.Errorf("case %d: expected SecureID(%v) to return a valid id, got 0x%x", n, ip, id)
+		}
+	}
+}
+
+func TestSetSecureID(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatalf("error creating new DHT object: %v", err)
+	}
+	defer d.Close()
+	ip := net.ParseIP("124.31.75.21")
+	if err := d.SetSecureID(ip); err != nil || !SecureIDValid([]byte(d.ID), ip) {
+		t.Fatalf("expected id derived from %v, got 0x%x, %v", ip, d.ID, err)
+	}
+	// An id that is already derived from ip is kept.
+	id := d.ID
+	if err := d.SetSecureID(ip); err != nil || d.ID != id {
+		t.Errorf("expected id 0x%x to be kept, got 0x%x, %v", id, d.ID, err)
+	}
+}
+
+func TestNodeSecure(t *testing.T) {
+	insecure := []byte("abcdefghij0123456789")
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"124.31.75.21", false},
+		// Local addresses are exempt from verification.
+		{"127.0.0.1", true},
+		{"192.168.1.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+	}
+	for n, c := range cases {
+		node := Node{ID: insecure, Peer: &Peer{net.UDPAddr{IP: net.ParseIP(c.ip), Port: 6881}}}
+		if got := node.Secure(); got != c.want {
+			t.Errorf("case %d: expected %v to be secure: %v, got %v", n, c.ip, c.want, got)
+		}
+		// Marshalled nodes are classified too.
+		b, err := json.Marshal(&node)
+		if err != nil {
+			t.Fatalf("case %d: json.Marshal() returned error %v", n, err)
+		}
+		if want := fmt.Sprintf(`"secure":%v`, c.want); !strings.Contains(string(b), want) {
+			t.Errorf("case %d: expected %s to contain %s", n, b, want)
+		}
+	}
+}
+
+func TestExternalAddr(t *testing.T) {
+	ip, err := encodeCompactPeer(Peer{net.UDPAddr{IP: net.ParseIP("124.31.75.21"), Port: 6881}})
+	if err != nil {
+		t.Fatalf("error encoding peer: %v", err)
+	}
+	cases := []struct {
+		ip   string
+		want string
+		fail bool
+	}{
+		{"", "", false},
+		{ip, "124.31.75.21:6881", false},
+		{"abc", "", true},
+	}
+	for n, c := range cases {
+		m := &Message{IP: c.ip}
+		p, err := m.ExternalAddr()
+		if (err != nil) != c.fail {
+			t.Errorf("case %d: expected ExternalAddr() to return error: %v, got %v", n, c.fail, err)
+			continue
+		}
+		var got string
+		if p != nil {
+			got = p.UDPAddr.String()
+		}
+		if got != c.want {
+			t.Errorf("case %d: expected ExternalAddr() to return %q, got %q", n, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// K is the number of nodes returned in response to find_node and get_peers
+// queries, referenced as K value in BEP 5.
+const K = 8
+
+// maxValues bounds the number of peers returned in a single get_peers response
+// so that it fits in a UDP datagram.
+const maxValues = 50
+
+// maxSamples bounds the number of info hashes returned in a single
+// sample_infohashes response so that it fits in a UDP datagram.
+const maxSamples = 20
+
+// sampleInterval is the interval returned in sample_infohashes responses.
+// Samples are drawn anew for every query, so this only limits how often a
+// single querier should ask.
+const sampleInterval = time.Minute
+
+// maxConfirming bounds the number of new queriers pinged at once before being
+// added to the routing table.
+const maxConfirming = 64
+
+// Storage error codes as defined in BEP 44.
+const (
+	errTooBig         = 205
+	errInvalidSig     = 206
+	errSaltTooBig     = 207
+	errCASMismatch    = 301
+	errSeqLessThanCur = 302
+)
+
+// RoutingTable is the set of nodes a Server refers queriers to.
+type RoutingTable interface {
+	// Insert records that n has been heard from.
+	Insert(n Node)
+	// Closest returns up to k known nodes closest to the 20 byte target.
+	Closest(target string, k int) []Node
+}
+
+// Server answers queries from other DHT nodes as defined in BEP 5, stores
+// items put to it as defined in BEP 44, and samples the info hashes it stores
+// peers for as defined in BEP 51. Scrapes of the peers it stores are answered
+// with bloom filters as defined in BEP 33.
+type Server struct {
+	dht    *DHT
+	table  RoutingTable
+	table6 RoutingTable
+	peers  *PeerStore
+	items  *ItemStore
+	tokens *tokenSecrets
+
+	mu         sync.Mutex
+	confirming map[string]bool
+}
+
+// NewServer returns a Server answering queries received by d.
+//
+// Nodes that query the server are inserted into table, or table6 for IPv6
+// nodes, once they answer a ping, and find_node and get_peers queries are
+// answered from them. Read-only queriers, as defined in BEP 43, aren't. BEP 32
+// recommends separate routing tables for each address family. If table6 is
+// nil, IPv6 nodes are neither recorded nor returned.
+func NewServer(d *DHT, table, table6 RoutingTable) (*Server, error) {
+	if table == nil {
+		return nil, fmt.Errorf("server requires a routing table")
+	}
+	tokens, err := newTokenSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("error creating token secret: %v", err)
+	}
+	s := &Server{
+		dht:        d,
+		table:      table,
+		table6:     table6,
+		peers:      NewPeerStore(),
+		items:      NewItemStore(),
+		tokens:     tokens,
+		confirming: make(map[string]bool),
+	}
+	d.handle(s.handle)
+	return s, nil
+}
+
+// Bootstrap populates the routing table by asking addr for the nodes closest
+// to our own id and keeping the ones that answer a ping.
+func (s *Server) Bootstrap(addr net.UDPAddr) error {
+	resp, err := s.dht.FindNode(addr, fmt.Sprintf("%x", s.dht.ID))
+	if err != nil {
+		return fmt.Errorf("error querying bootstrap node: %v", err)
+	}
+	if id, ok := resp.Response["id"].(string); ok && len(id) == 20 {
+		s.insert(Node{ID: []byte(id), Peer: &Peer{UDPAddr: addr}})
+	}
+	nodes, err := resp.Nodes()
+	if err != nil {
+		return fmt.Errorf("error parsing bootstrap response: %v", err)
+	}
+	nodes6, err := resp.Nodes6()
+	if err != nil {
+		return fmt.Errorf("error parsing bootstrap response: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, n := range append(nodes, nodes6...) {
+		wg.Add(1)
+		go func(n Node) {
+			defer wg.Done()
+			if _, err := s.dht.Ping(n.Peer.UDPAddr); err == nil {
+				s.insert(n)
+			}
+		}(n)
+	}
+	wg.Wait()
+	return nil
+}
+
+// insert records n in the routing table for its address family.
+func (s *Server) insert(n Node) {
+	if !n.Peer.IsIPv6() {
+		s.table.Insert(n)
+	} else if s.table6 != nil {
+		s.table6.Insert(n)
+	}
+}
+
+// confirm inserts n, a node that queried us, into the routing table once it
+// answers a ping, so that only nodes that can be reached are referred to
+// others. Nodes already in the routing table are refreshed right away.
+func (s *Server) confirm(n Node) {
+	table := s.table
+	if n.Peer.IsIPv6() {
+		table = s.table6
+	}
+	if table == nil {
+		return
+	}
+	for _, k := range table.Closest(string(n.ID), 1) {
+		if bytes.Equal(k.ID, n.ID) && sameAddr(k.Peer.UDPAddr, n.Peer.UDPAddr) {
+			table.Insert(n)
+			return
+		}
+	}
+	a := n.Peer.UDPAddr.String()
+	s.mu.Lock()
+	if s.confirming[a] || len(s.confirming) >= maxConfirming {
+		s.mu.Unlock()
+		return
+	}
+	s.confirming[a] = true
+	s.mu.Unlock()
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.confirming, a)
+			s.mu.Unlock()
+		}()
+		resp, err := s.dht.Ping(n.Peer.UDPAddr)
+		if err != nil {
+			return
+		}
+		if id, _ := resp.Response["id"].(string); id == string(n.ID) {
+			table.Insert(n)
+		}
+	}()
+}
+
+// addNodes adds the nodes closest to target to the response r, in the "nodes"
+// and/or "nodes6" keys as requested by the querier.
+func (s *Server) addNodes(r map[string]interface{}, target string, want4, want6 bool) {
+	if want4 {
+		r["nodes"] = encodeCompactNodes(s.table.Closest(target, K))
+	}
+	if want6 && s.table6 != nil {
+		r["nodes6"] = encodeCompactNodes6(s.table6.Closest(target, K))
+	}
+}
+
+// wants returns the address families requested by the query m from a remote
+// node at from. If the query has no "want" argument, the family of from is
+// returned as described in BEP 32.
+func wants(from net.UDPAddr, m *Message) (want4, want6 bool) {
+	want, ok := m.Arguments["want"].([]interface{})
+	if !ok {
+		ipv6 := from.IP.To4() == nil
+		return !ipv6, ipv6
+	}
+	for _, w := range want {
+		switch w {
+		case WantIPv4:
+			want4 = true
+		case WantIPv6:
+			want6 = true
+		}
+	}
+	return want4, want6
+}
+
+// handle answers a single query received from a remote node.
+func (s *Server) handle(from net.UDPAddr, m *Message) {
+	resp := s.respond(from, m)
+	// Tell the querier its external address so it can derive a secure node
+	// id, as defined in BEP 42.
+	if ip, err := encodeCompactPeer(Peer{from}); err == nil {
+		resp.IP = ip
+	}
+	if err := s.dht.send(from, resp); err != nil {
+		log.Printf("error responding to %v: %v", &from, err)
+	}
+}
+
+// respond returns the message to send in reply to query m from a remote node.
+func (s *Server) respond(from net.UDPAddr, m *Message) *Message {
+	id, ok := m.Arguments["id"].(string)
+	if !ok || len(id) != 20 {
+		return NewError(m.TransactionID, ErrorProtocol, "invalid id")
+	}
+	r := map[string]interface{}{"id": s.dht.ID}
+	want4, want6 := wants(from, m)
+	switch query(m.Query) {
+	case ping:
+	case findNode:
+		target, ok := m.Arguments["target"].(string)
+		if !ok || len(target) != 20 {
+			return NewError(m.TransactionID, ErrorProtocol, "invalid target")
+		}
+		s.addNodes(r, target, want4, want6)
+	case getPeers:
+		infoHash, ok := m.Arguments["info_hash"].(string)
+		if !ok || len(infoHash) != 20 {
+			return NewError(m.TransactionID, ErrorProtocol, "invalid info_hash")
+		}
+		r["token"] = s.tokens.token(from.IP)
+		noseed, _ := m.Arguments["noseed"].(int64)
+		if peers := s.peers.Get(infoHash, maxValues, noseed != 0); len(peers) > 0 {
+			var values []interface{}
+			for _, p := range peers {
+				if p.IsIPv6() && !want6 || !p.IsIPv6() && !want4 {
+					continue
+				}
+				if v, err := encodeCompactPeer(p); err == nil {
+					values = append(values, v)
+				}
+			}
+			if len(values) > 0 {
+				r["values"] = values
+			}
+		}
+		if scrape, _ := m.Arguments["scrape"].(int64); scrape != 0 {
+			seeds, peers := s.peers.Filters(infoHash)
+			r["BFsd"] = string(seeds[:])
+			r["BFpe"] = string(peers[:])
+		}
+		// Nodes are returned even alongside values so that lookups can keep
+		// making progress toward the info_hash.
+		s.addNodes(r, infoHash, want4, want6)
+	case announcePeer:
+		infoHash, ok := m.Arguments["info_hash"].(string)
+		if !ok || len(infoHash) != 20 {
+			return NewError(m.TransactionID, ErrorProtocol, "invalid info_hash")
+		}
+		token, _ := m.Arguments["token"].(string)
+		if !s.tokens.valid(token, from.IP) {
+			return NewError(m.TransactionID, ErrorProtocol, "bad token")
+		}
+		port := from.Port
+		if implied, _ := m.Arguments["implied_port"].(int64); implied == 0 {
+			p, ok := m.Arguments["port"].(int64)
+			if !ok || p <= 0 || p > 65535 {
+				return NewError(m.TransactionID, ErrorProtocol, "invalid port")
+			}
+			port = int(p)
+		}
+		seed, _ := m.Arguments["seed"].(int64)
+		s.peers.Add(infoHash, Peer{net.UDPAddr{IP: from.IP, Port: port}}, seed != 0)
+	case sampleInfohashes:
+		target, ok := m.Arguments["target"].(string)
+		if !ok || len(target) != 20 {
+			return NewError(m.TransactionID, ErrorProtocol, "invalid target")
+		}
+		samples, num := s.peers.Sample(maxSamples)
+		r["samples"] = strings.Join(samples, "")
+		r["num"] = num
+		r["interval"] = int64(sampleInterval / time.Second)
+		s.addNodes(r, target, want4, want6)
+	case get:
+		target, ok := m.Arguments["target"].(string)
+		if !ok || len(target) != 20 {
+			return NewError(m.TransactionID, ErrorProtocol, "invalid target")
+		}
+		r["token"] = s.tokens.token(from.IP)
+		if i := s.items.Get(target); i != nil {
+			// Mutable items are only returned if newer than the querier's.
+			if seq, ok := m.Arguments["seq"].(int64); i.Mutable() && ok && i.Seq <= seq {
+				r["seq"] = i.Seq
+			} else {
+				addItem(r, i)
+			}
+		}
+		s.addNodes(r, target, want4, want6)
+	case put:
+		token, _ := m.Arguments["token"].(string)
+		if !s.tokens.valid(token, from.IP) {
+			return NewError(m.TransactionID, ErrorProtocol, "bad token")
+		}
+		if code, msg := s.put(m.Arguments); code != 0 {
+			return NewError(m.TransactionID, code, msg)
+		}
+	default:
+		return NewError(m.TransactionID, ErrorMethodUnknown, "method unknown")
+	}
+	if m.ReadOnly == 0 {
+		s.confirm(Node{ID: []byte(id), Peer: &Peer{UDPAddr: from}})
+	}
+	return NewResponse(m.TransactionID, r)
+}
+
+// put stores the item in the arguments of a put query, returning a KRPC error
+// code and message if it is rejected.
+func (s *Server) put(args map[string]interface{}) (int, string) {
+	i, err := itemFromDict(args)
+	if err != nil {
+		return ErrorProtocol, err.Error()
+	}
+	if len(i.Salt) > MaxSaltSize {
+		return errSaltTooBig, "salt (salt field) too big"
+	}
+	if _, err := i.encode(); err != nil {
+		return errTooBig, "message (v field) too big"
+	}
+	target, err := i.Target()
+	if err != nil {
+		return ErrorProtocol, err.Error()
+	}
+	if !i.Mutable() {
+		s.items.Put(target, i)
+		return 0, ""
+	}
+	if err := i.Verify(target); err != nil {
+		return errInvalidSig, "invalid signature"
+	}
+	// The check and store must be atomic for compare-and-swap to be
+	// meaningful.
+	code := errSeqLessThanCur
+	err = s.items.Update(target, i, func(cur *Item) error {
+		if cur == nil {
+			return nil
+		}
+		if cas, ok := args["cas"].(int64); ok && cas != cur.Seq {
+			code = errCASMismatch
+			return fmt.Errorf("CAS mismatch, re-read value and try again")
+		}
+		if i.Seq < cur.Seq {
+			return fmt.Errorf("sequence number less than current")
+		}
+		if i.Seq == cur.Seq {
+			// Putting the same item again only refreshes it.
+			a, _ := i.encode()
+			b, _ := cur.encode()
+			if !bytes.Equal(a, b) {
+				return fmt.Errorf("sequence number less than current")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return code, err.Error()
+	}
+	return 0, ""
+}
+
+// addItem adds the fields of item i to the get response r.
+func addItem(r map[string]interface{}, i *Item) {
+	r["v"] = i.V
+	if i.Mutable() {
+		r["k"] = string(i.K)
+		r["seq"] = i.Seq
+		r["sig"] = string(i.Sig)
+	}
+}
+
+// tokenInterval is how often the secret used to generate tokens changes.
+//
+// BEP 5 recommends changing the secret every five minutes and accepting
+// tokens up to ten minutes old.
+const tokenInterval = 5 * time.Minute
+
+// tokenSecrets generates and validates get_peers tokens.
+//
+// A token is the SHA1 hash of the requester's IP address concatenated with a
+// secret. The current and previous secrets are accepted.
+type tokenSecrets struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+func newTokenSecrets() (*tokenSecrets, error) {
+	t := &tokenSecrets{current: make([]byte, 16), rotated: time.Now()}
+	if _, err := rand.Read(t.current); err != nil {
+		return nil, err
+	}
+	t.previous = t.current
+	return t, nil
+}
+
+// rotate replaces the secret if it is older than tokenInterval.
+func (t *tokenSecrets) rotate() {
+	if time.Since(t.rotated) < tokenInterval {
+		return
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("error generating token secret: %v", err)
+		return
+	}
+	t.previous, t.current, t.rotated = t.current, secret, time.Now()
+}
+
+func (t *tokenSecrets) token(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return makeToken(t.current, ip)
+}
+
+func (t *tokenSecrets) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return token == makeToken(t.current, ip) || token == makeToken(t.previous, ip)
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.New()
+	h.Write(ip)
+	h.Write(secret)
+	return string(h.Sum(nil)[:8])
+}
@@ -0,0 +1,425 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a Server listening on localhost and a client DHT to query it with.
+func newTestServer(t *testing.T) (*Server, *DHT, net.UDPAddr) {
+	t.Helper()
+	sd, err := Listen(net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("error creating server DHT: %v", err)
+	}
+	t.Cleanup(func() { sd.Close() })
+	s, err := NewServer(sd, &testTable{}, &testTable{})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	client, err := New()
+	if err != nil {
+		t.Fatalf("error creating client DHT: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return s, client, *sd.LocalAddr().(*net.UDPAddr)
+}
+
+// testTable is a RoutingTable that returns every node it was given.
+type testTable struct {
+	mu    sync.Mutex
+	nodes []Node
+}
+
+func (t *testTable) Insert(n Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, o := range t.nodes {
+		if string(o.ID) == string(n.ID) {
+			t.nodes[i] = n
+			return
+		}
+	}
+	t.nodes = append(t.nodes, n)
+}
+
+func (t *testTable) Closest(target string, k int) []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.nodes) > k {
+		return t.nodes[:k]
+	}
+	return t.nodes
+}
+
+// eventually reports whether cond becomes true within a second.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestServerPing(t *testing.T) {
+	s, client, server := newTestServer(t)
+	// The client answers the ping confirming it can be reached.
+	if _, err := NewServer(client, &testTable{}, nil); err != nil {
+		t.Fatalf("error creating client server: %v", err)
+	}
+	resp, err := client.Ping(server)
+	if err != nil {
+		t.Fatalf("error issuing Ping: %v", err)
+	}
+	if resp.Mtype != "r" || resp.Response["id"] != s.dht.ID {
+		t.Errorf("expected response with id %x, got %v", s.dht.ID, resp)
+	}
+	// The client is now known to the server.
+	if !eventually(func() bool { return len(s.table.Closest(client.ID, K)) == 1 }) {
+		t.Errorf("expected client in routing table, got %v", s.table.Closest(client.ID, K))
+	}
+}
+
+func TestServerUnconfirmed(t *testing.T) {
+	s, client, server := newTestServer(t)
+	client.Timeout = 100 * time.Millisecond
+	s.dht.Timeout = 100 * time.Millisecond
+	// Neither a client that doesn't answer pings, nor one that says it
+	// won't, is referred to others.
+	readOnly, err := New()
+	if err != nil {
+		t.Fatalf("error creating client DHT: %v", err)
+	}
+	t.Cleanup(func() { readOnly.Close() })
+	readOnly.ReadOnly = true
+	if _, err := NewServer(readOnly, &testTable{}, nil); err != nil {
+		t.Fatalf("error creating client server: %v", err)
+	}
+	for _, d := range []*DHT{client, readOnly} {
+		if _, err := d.Ping(server); err != nil {
+			t.Fatalf("error issuing Ping: %v", err)
+		}
+	}
+	if eventually(func() bool { return len(s.table.Closest(client.ID, K)) > 0 }) {
+		t.Errorf("expected unconfirmed clients not in routing table, got %v", s.table.Closest(client.ID, K))
+	}
+}
+
+func TestServerFindNode(t *testing.T) {
+	s, client, server := newTestServer(t)
+	known := Node{
+		ID:   []byte("ABCDEFGHIJKLMNOPQRST"),
+		Peer: &Peer{net.UDPAddr{IP: net.ParseIP("192.168.1.1").To4(), Port: 22}},
+	}
+	s.table.Insert(known)
+	resp, err := client.FindNode(server, "4142434445464748494A4B4C4D4E4F5051525354")
+	if err != nil {
+		t.Fatalf("error issuing FindNode: %v", err)
+	}
+	nodes, err := resp.Nodes()
+	if err != nil {
+		t.Fatalf("error parsing nodes: %v", err)
+	}
+	if len(nodes) != 1 || string(nodes[0].ID) != string(known.ID) || nodes[0].Peer.UDPAddr.String() != "192.168.1.1:22" {
+		t.Errorf("expected nodes [%v], got %v", known, nodes)
+	}
+}
+
+func TestServerWant(t *testing.T) {
+	s, client, server := newTestServer(t)
+	s.table.Insert(Node{
+		ID:   []byte("ABCDEFGHIJKLMNOPQRST"),
+		Peer: &Peer{net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22}},
+	})
+	s.table6.Insert(Node{
+		ID:   []byte("abcdefghijklmnopqrst"),
+		Peer: &Peer{net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 23}},
+	})
+	// Keep the client out of the routing table.
+	client.ID = "ABCDEFGHIJKLMNOPQRST"
+	cases := []struct {
+		want   []string
+		nodes  int
+		nodes6 int
+	}{
+		// Without "want", nodes of the querier's family are returned.
+		{nil, 1, 0},
+		{[]string{WantIPv4}, 1, 0},
+		{[]string{WantIPv6}, 0, 1},
+		{[]string{WantIPv4, WantIPv6}, 1, 1},
+	}
+	for n, c := range cases {
+		client.Want = c.want
+		resp, err := client.FindNode(server, "4142434445464748494A4B4C4D4E4F5051525354")
+		if err != nil {
+			t.Fatalf("case %d: error issuing FindNode: %v", n, err)
+		}
+		nodes, err := resp.Nodes()
+		if err != nil {
+			t.Fatalf("case %d: error parsing nodes: %v", n, err)
+		}
+		nodes6, err := resp.Nodes6()
+		if err != nil {
+			t.Fatalf("case %d: error parsing nodes6: %v", n, err)
+		}
+		if len(nodes) != c.nodes || len(nodes6) != c.nodes6 {
+			t.Errorf("case %d: expected %d nodes and %d nodes6, got %v and %v", n, c.nodes, c.nodes6, nodes, nodes6)
+		}
+		if c.nodes6 > 0 && nodes6[0].Peer.UDPAddr.String() != "[2001:db8::1]:23" {
+			t.Errorf("case %d: expected nodes6 to contain [2001:db8::1]:23, got %v", n, nodes6)
+		}
+	}
+}
+
+func TestServerAnnounceAndGetPeers(t *testing.T) {
+	_, client, server := newTestServer(t)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	resp, err := client.GetPeers(server, infoHash)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	token, ok := resp.Response["token"].(string)
+	if !ok {
+		t.Fatalf("get_peers response has no token: %v", resp)
+	}
+	if _, ok := resp.Response["values"]; ok {
+		t.Errorf("expected no values before announcing, got %v", resp)
+	}
+
+	_, err = client.AnnouncePeer(server, infoHash, "deadbeef", 6881)
+	var kerr *KRPCError
+	if !errors.As(err, &kerr) || kerr.Code != ErrorProtocol {
+		t.Errorf("expected announce with a bad token to be rejected, got %v", err)
+	}
+
+	for _, port := range []int{6881, 0} {
+		resp, err = client.AnnouncePeer(server, infoHash, fmt.Sprintf("%x", token), port)
+		if err != nil {
+			t.Fatalf("error issuing AnnouncePeer: %v", err)
+		}
+		if resp.Mtype != "r" {
+			t.Errorf("expected announce on port %d to succeed, got %v", port, resp)
+		}
+	}
+
+	resp, err = client.GetPeers(server, infoHash)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	peers, err := resp.Values()
+	if err != nil {
+		t.Fatalf("error parsing values: %v", err)
+	}
+	clientPort := client.LocalAddr().(*net.UDPAddr).Port
+	got := map[int]bool{}
+	for _, p := range peers {
+		got[p.UDPAddr.Port] = true
+	}
+	if len(peers) != 2 || !got[6881] || !got[clientPort] {
+		t.Errorf("expected peers on ports 6881 and %d, got %v", clientPort, peers)
+	}
+}
+
+func TestServerPutAndGet(t *testing.T) {
+	_, client, server := newTestServer(t)
+	item := &Item{V: "Hello World!"}
+	target := "e5f96f6f38320f0f33959cb4d3d656452117aadb"
+	resp, err := client.Get(server, target)
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	token, ok := resp.Response["token"].(string)
+	if !ok {
+		t.Fatalf("get response has no token: %v", resp)
+	}
+	if _, ok := resp.Response["v"]; ok {
+		t.Errorf("expected no value before putting, got %v", resp)
+	}
+
+	_, err = client.Put(server, "deadbeef", item)
+	var kerr *KRPCError
+	if !errors.As(err, &kerr) || kerr.Code != ErrorProtocol {
+		t.Errorf("expected put with a bad token to be rejected, got %v", err)
+	}
+	resp, err = client.Put(server, fmt.Sprintf("%x", token), item)
+	if err != nil {
+		t.Fatalf("error issuing Put: %v", err)
+	}
+	if resp.Mtype != "r" {
+		t.Errorf("expected put to succeed, got %v", resp)
+	}
+
+	resp, err = client.Get(server, target)
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	got, err := resp.Item()
+	if err != nil {
+		t.Fatalf("error parsing item: %v", err)
+	}
+	if got == nil || got.V != item.V {
+		t.Errorf("expected item %v, got %v", item, got)
+	}
+}
+
+func TestServerMutablePut(t *testing.T) {
+	_, client, server := newTestServer(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	salt := []byte("salt")
+	item := func(v string, seq int64) *Item {
+		i, err := NewMutableItem(v, key, salt, seq)
+		if err != nil {
+			t.Fatalf("error creating item: %v", err)
+		}
+		return i
+	}
+	first := item("first", 1)
+	target, _ := first.Target()
+	resp, err := client.Get(server, fmt.Sprintf("%x", target))
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	token := fmt.Sprintf("%x", resp.Response["token"])
+
+	forged := item("forged", 1)
+	forged.V = "other"
+	cas := func(c int64) *int64 { return &c }
+	cases := []struct {
+		item *Item
+		cas  *int64
+		code int64
+	}{
+		{first, nil, 0},
+		// Putting the same item again is allowed.
+		{first, nil, 0},
+		{item("changed", 1), nil, errSeqLessThanCur},
+		{item("older", 0), nil, errSeqLessThanCur},
+		{forged, nil, errInvalidSig},
+		{item("second", 2), cas(0), errCASMismatch},
+		{item("second", 2), cas(1), 0},
+	}
+	for n, c := range cases {
+		if c.cas != nil {
+			resp, err = client.PutCAS(server, token, c.item, *c.cas)
+		} else {
+			resp, err = client.Put(server, token, c.item)
+		}
+		if c.code == 0 && (err != nil || resp.Mtype != "r") {
+			t.Errorf("case %d: expected put to succeed, got %v, %v", n, resp, err)
+		}
+		var kerr *KRPCError
+		if c.code != 0 && (!errors.As(err, &kerr) || int64(kerr.Code) != c.code) {
+			t.Errorf("case %d: expected error %d, got %v", n, c.code, err)
+		}
+	}
+
+	resp, err = client.Get(server, fmt.Sprintf("%x", target))
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	got, err := resp.Item()
+	if err != nil {
+		t.Fatalf("error parsing item: %v", err)
+	}
+	got.Salt = salt
+	if err := got.Verify(target); err != nil || got.V != "second" || got.Seq != 2 {
+		t.Errorf("expected verified item \"second\" with seq 2, got %v (%v)", got, err)
+	}
+
+	// Items aren't returned to queriers that already have them.
+	req, err := NewRequest(get, map[string]interface{}{"id": client.ID, "target": target, "seq": int64(2)})
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	resp, err = client.query(context.Background(), server, req)
+	if err != nil {
+		t.Fatalf("error issuing query: %v", err)
+	}
+	if _, ok := resp.Response["v"]; ok || resp.Response["seq"] != int64(2) {
+		t.Errorf("expected only seq in response to get with current seq, got %v", resp)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s, client, server := newTestServer(t)
+	cases := []struct {
+		q    query
+		args map[string]interface{}
+		code int64
+	}{
+		{"unknown", map[string]interface{}{"id": client.ID}, ErrorMethodUnknown},
+		{ping, map[string]interface{}{"id": "short"}, ErrorProtocol},
+		{findNode, map[string]interface{}{"id": client.ID, "target": "short"}, ErrorProtocol},
+		{getPeers, map[string]interface{}{"id": client.ID}, ErrorProtocol},
+		{get, map[string]interface{}{"id": client.ID, "target": "short"}, ErrorProtocol},
+		{put, map[string]interface{}{"id": client.ID, "token": s.tokens.token(net.ParseIP("127.0.0.1"))}, ErrorProtocol},
+		{put, map[string]interface{}{"id": client.ID, "token": s.tokens.token(net.ParseIP("127.0.0.1")), "v": strings.Repeat("a", MaxItemSize)}, errTooBig},
+		{put, map[string]interface{}{"id": client.ID, "token": s.tokens.token(net.ParseIP("127.0.0.1")), "v": "a", "k": strings.Repeat("k", 32), "seq": int64(1), "sig": strings.Repeat("s", 64), "salt": strings.Repeat("s", MaxSaltSize+1)}, errSaltTooBig},
+	}
+	for n, c := range cases {
+		req, err := NewRequest(c.q, c.args)
+		if err != nil {
+			t.Fatalf("case %d: error creating request: %v", n, err)
+		}
+		_, err = client.query(context.Background(), server, req)
+		var kerr *KRPCError
+		if !errors.As(err, &kerr) || int64(kerr.Code) != c.code {
+			t.Errorf("case %d: expected error %d, got %v", n, c.code, err)
+		}
+	}
+	if nodes := s.table.Closest(client.ID, K); len(nodes) != 0 {
+		t.Errorf("expected failed queries not to populate the routing table, got %v", nodes)
+	}
+}
+
+func TestPeerStore(t *testing.T) {
+	s := NewPeerStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	p := Peer{net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	s.Add("a", p, false)
+	s.Add("a", p, false)
+	s.Add("a", Peer{net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}}, false)
+	if got := s.Get("a", 0, false); len(got) != 2 {
+		t.Errorf("expected 2 peers, got %v", got)
+	}
+	if got := s.Get("a", 1, false); len(got) != 1 {
+		t.Errorf("expected 1 peer, got %v", got)
+	}
+	if got := s.Get("b", 0, false); len(got) != 0 {
+		t.Errorf("expected no peers, got %v", got)
+	}
+	now = now.Add(peerTTL + time.Second)
+	if got := s.Get("a", 0, false); len(got) != 0 {
+		t.Errorf("expected peers to expire, got %v", got)
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	s := NewItemStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.Put("a", &Item{V: "1"})
+	s.Put("a", &Item{V: "2"})
+	if got := s.Get("a"); got == nil || got.V != "2" {
+		t.Errorf("expected item 2, got %v", got)
+	}
+	if got := s.Get("b"); got != nil {
+		t.Errorf("expected no item, got %v", got)
+	}
+	now = now.Add(itemTTL + time.Second)
+	if got := s.Get("a"); got != nil {
+		t.Errorf("expected item to expire, got %v", got)
+	}
+}
@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+// Torrent is the metainfo of a torrent read from a .torrent file, as defined
+// in BEP 3, or for BitTorrent v2 and hybrid torrents in BEP 52.
+//
+// https://www.bittorrent.org/beps/bep_0003.html
+type Torrent struct {
+	// 20 byte SHA-1 hash of the bencoded info dictionary, "" for v2 only
+	// torrents.
+	InfoHash string
+	// 32 byte SHA-256 hash of the bencoded info dictionary, "" for v1 only
+	// torrents.
+	InfoHashV2 string
+	// Suggested name of the file, or directory for multi-file torrents.
+	Name string
+	// Total size of the files in bytes.
+	Length int64
+	// Files of the torrent. Single file torrents have one, named Name.
+	Files []TorrentFile
+}
+
+// TorrentFile is a file of a torrent.
+type TorrentFile struct {
+	// Path of the file, its components joined by "/", relative to the
+	// torrent's directory.
+	Path string
+	// Size of the file in bytes.
+	Length int64
+}
+
+// ParseTorrent parses the bencoded metainfo of a torrent.
+//
+// The info hashes are computed over the info dictionary exactly as it is
+// encoded in b, so torrents whose encoding isn't canonical still hash to what
+// other clients look them up by. Torrents with a "meta version" of 2 have a
+// v2 info hash, and those that also have "pieces", hybrid torrents, a v1 one.
+func ParseTorrent(b []byte) (*Torrent, error) {
+	var metainfo struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	if err := bencode.DecodeBytes(b, &metainfo); err != nil {
+		return nil, fmt.Errorf("error decoding torrent: %v", err)
+	}
+	if len(metainfo.Info) == 0 {
+		return nil, fmt.Errorf("error decoding torrent: no \"info\" key")
+	}
+	var info struct {
+		Name        string  `bencode:"name"`
+		MetaVersion int64   `bencode:"meta version"`
+		Pieces      *string `bencode:"pieces"`
+		Length      *int64  `bencode:"length"`
+		Files       []struct {
+			Length int64    `bencode:"length"`
+			Path   []string `bencode:"path"`
+			Attr   string   `bencode:"attr"`
+		} `bencode:"files"`
+		FileTree map[string]interface{} `bencode:"file tree"`
+	}
+	if err := bencode.DecodeBytes(metainfo.Info, &info); err != nil {
+		return nil, fmt.Errorf("error decoding torrent info: %v", err)
+	}
+	t := &Torrent{Name: info.Name}
+	v2 := info.MetaVersion == 2
+	if !v2 || info.Pieces != nil {
+		h := sha1.Sum(metainfo.Info)
+		t.InfoHash = string(h[:])
+	}
+	if v2 {
+		h := sha256.Sum256(metainfo.Info)
+		t.InfoHashV2 = string(h[:])
+	}
+	switch {
+	// Single file v2 torrents have a tree of just the file, named Name.
+	case v2 && info.FileTree != nil:
+		if err := t.addFileTree("", info.FileTree); err != nil {
+			return nil, fmt.Errorf("error decoding torrent info: %v", err)
+		}
+	case info.Length != nil:
+		t.Files = []TorrentFile{{info.Name, *info.Length}}
+	case info.Files != nil:
+		for _, f := range info.Files {
+			// Padding files of hybrid torrents aren't part of the content.
+			if strings.Contains(f.Attr, "p") {
+				continue
+			}
+			t.Files = append(t.Files, TorrentFile{strings.Join(f.Path, "/"), f.Length})
+		}
+	default:
+		return nil, fmt.Errorf("error decoding torrent info: no \"length\", \"files\" or \"file tree\" key")
+	}
+	for _, f := range t.Files {
+		t.Length += f.Length
+	}
+	return t, nil
+}
+
+// addFileTree adds the files in a BEP 52 file tree under dir to t, in the
+// order of their paths.
+//
+// Directories are dictionaries of their entries. Files are dictionaries with
+// a single "" key, whose value is a dictionary of the file's length and
+// hashes.
+func (t *Torrent) addFileTree(dir string, tree map[string]interface{}) error {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree entry %q isn't a dictionary", name)
+		}
+		path := name
+		if dir != "" {
+			path = dir + "/" + name
+		}
+		f, ok := entry[""].(map[string]interface{})
+		if !ok {
+			if err := t.addFileTree(path, entry); err != nil {
+				return err
+			}
+			continue
+		}
+		length, ok := f["length"].(int64)
+		if !ok {
+			return fmt.Errorf("file %q has no length", path)
+		}
+		t.Files = append(t.Files, TorrentFile{path, length})
+	}
+	return nil
+}
+
+// InfoHashes returns the 20 byte info hashes t is looked up by in the DHT,
+// its v1 info hash first.
+func (t *Torrent) InfoHashes() []string {
+	return infoHashes(t.InfoHash, t.InfoHashV2)
+}
+
+// Magnet returns a magnet link to t, with both info hashes of hybrid
+// torrents.
+func (t *Torrent) Magnet() string {
+	var params []string
+	if t.InfoHash != "" {
+		params = append(params, fmt.Sprintf("xt=%s%x", btihPrefix, t.InfoHash))
+	}
+	if t.InfoHashV2 != "" {
+		params = append(params, fmt.Sprintf("xt=%s%x%x", btmhPrefix, sha256Multihash, t.InfoHashV2))
+	}
+	if t.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(t.Name))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// MarshalJSON marshals a Torrent into JSON.
+func (t *Torrent) MarshalJSON() ([]byte, error) {
+	type file struct {
+		Path   string `json:"path"`
+		Length int64  `json:"length"`
+	}
+	files := []file{}
+	for _, f := range t.Files {
+		files = append(files, file{f.Path, f.Length})
+	}
+	var v1, v2 string
+	if t.InfoHash != "" {
+		v1 = fmt.Sprintf("0x%x", t.InfoHash)
+	}
+	if t.InfoHashV2 != "" {
+		v2 = fmt.Sprintf("0x%x", t.InfoHashV2)
+	}
+	return json.Marshal(
+		struct {
+			InfoHash   string `json:"info_hash,omitempty"`
+			InfoHashV2 string `json:"info_hash_v2,omitempty"`
+			Name       string `json:"name"`
+			Length     int64  `json:"length"`
+			Files      []file `json:"files"`
+		}{
+			v1,
+			v2,
+			t.Name,
+			t.Length,
+			files,
+		})
+}
@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTorrent(t *testing.T) {
+	// Keys of the info dictionaries aren't sorted, so re-encoding them would
+	// change their hashes.
+	single := "d4:name5:x.iso6:lengthi7e12:piece lengthi1e6:pieces0:e"
+	multi := "d4:name3:dir5:filesld6:lengthi10e4:pathl1:a5:b.txteed6:lengthi5e4:pathl1:ceee12:piece lengthi1e6:pieces0:e"
+	cases := []struct {
+		b    string
+		info string
+		want *Torrent
+	}{
+		{
+			"d8:announce3:foo4:info" + single + "e",
+			single,
+			&Torrent{Name: "x.iso", Length: 7, Files: []TorrentFile{{"x.iso", 7}}},
+		},
+		{
+			"d4:info" + multi + "7:comment3:bare",
+			multi,
+			&Torrent{Name: "dir", Length: 15, Files: []TorrentFile{{"a/b.txt", 10}, {"c", 5}}},
+		},
+	}
+	for n, c := range cases {
+		got, err := ParseTorrent([]byte(c.b))
+		if err != nil {
+			t.Errorf("case %d: error parsing torrent: %v", n, err)
+			continue
+		}
+		h := sha1.Sum([]byte(c.info))
+		c.want.InfoHash = string(h[:])
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: expected %+v, got %+v", n, c.want, got)
+		}
+	}
+}
+
+func TestParseTorrentV2(t *testing.T) {
+	tree := "9:file treed1:ad0:d6:lengthi4eee4:dir2d1:bd0:d6:lengthi3eeeee"
+	v2 := "d" + tree + "12:meta versioni2e4:name2:v212:piece lengthi16384ee"
+	// Hybrid torrents pad v1 files to piece boundaries.
+	files := "5:filesld6:lengthi4e4:pathl1:aeed4:attr1:p6:lengthi16380e4:pathl4:.pad5:16380eed6:lengthi3e4:pathl4:dir21:beee"
+	hybrid := "d" + files + tree + "12:meta versioni2e4:name2:hy12:piece lengthi16384e6:pieces0:e"
+	wantFiles := []TorrentFile{{"a", 4}, {"dir2/b", 3}}
+	for n, info := range []string{v2, hybrid} {
+		got, err := ParseTorrent([]byte("d4:info" + info + "e"))
+		if err != nil {
+			t.Errorf("case %d: error parsing torrent: %v", n, err)
+			continue
+		}
+		h := sha256.Sum256([]byte(info))
+		if got.InfoHashV2 != string(h[:]) {
+			t.Errorf("case %d: expected v2 info hash %x, got %x", n, h, got.InfoHashV2)
+		}
+		if v1 := sha1.Sum([]byte(info)); n == 1 && got.InfoHash != string(v1[:]) || n == 0 && got.InfoHash != "" {
+			t.Errorf("case %d: unexpected v1 info hash %x", n, got.InfoHash)
+		}
+		if got.Length != 7 || !reflect.DeepEqual(got.Files, wantFiles) {
+			t.Errorf("case %d: expected files %v, got %v", n, wantFiles, got.Files)
+		}
+		m, err := ParseMagnet(got.Magnet())
+		if err != nil || m.InfoHash != got.InfoHash || m.InfoHashV2 != got.InfoHashV2 {
+			t.Errorf("case %d: expected magnet link with the same info hashes, got %v, %v", n, got.Magnet(), err)
+		}
+	}
+}
+
+func TestParseTorrentErrors(t *testing.T) {
+	cases := []string{
+		"d8:announce3:fooe",
+		"d4:infod4:name1:xee",
+		"d4:infoi1ee",
+		"not bencode",
+		strings.Repeat("d", 3),
+	}
+	for n, c := range cases {
+		if got, err := ParseTorrent([]byte(c)); err == nil {
+			t.Errorf("case %d: expected error parsing %q, got %v", n, c, got)
+		}
+	}
+}
@@ -2,51 +2,284 @@ package queryprocessor
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/jeanralphaviles/dhtcli/pkg/dht"
 	"log"
 	"math/big"
 	"net"
+	"sort"
+	"sync"
+	"time"
 )
 
 // QueryProcessor maintains state for queries into the DHT.
 type QueryProcessor struct {
-	dht          *dht.DHT
-	routingTable *routingTable
+	dht *dht.DHT
+	// Routing tables of IPv4 and IPv6 nodes, kept separate as recommended by BEP 32.
+	table  *RoutingTable
+	table6 *RoutingTable
+	// Nodes lookups start from when the routing tables are empty.
+	bootstrap []dht.Node
+	// Number of closest nodes tracked by a lookup: referenced as K value in BEP 5.
+	k int
+	// How lookups treat nodes without BEP 42 secure ids.
+	security Security
+	// Our external addresses as reported by bootstrap nodes.
+	self map[string]bool
+	// Number of queries a lookup keeps in flight at once: referenced as alpha
+	// in the Kademlia paper.
+	alpha int
+
+	mu    sync.Mutex
+	stats Stats
+	// Our external IP address as last reported by any node.
+	external net.IP
+}
+
+// Stats counts the outcomes of the queries issued by a QueryProcessor's
+// lookups.
+type Stats struct {
+	Queried   int
+	Responded int
+	// Queries nodes replied to with a KRPC error.
+	Errors int
+	// Queries nodes didn't reply to at all.
+	TimedOut int
 }
 
+// DefaultAlpha is the number of queries a lookup keeps in flight at once
+// unless set with SetAlpha.
+const DefaultAlpha = 3
+
+// Security determines how lookups treat nodes whose ids aren't derived from
+// their IP addresses as defined in BEP 42.
+type Security int
+
+const (
+	// SecurityOff treats all nodes alike.
+	SecurityOff Security = iota
+	// SecurityPrefer queries nodes with secure ids before others, so that
+	// nodes with insecure ids are only queried if there aren't K secure ones
+	// closer to the target.
+	SecurityPrefer
+	// SecurityRequire never follows nodes with insecure ids. Bootstrap nodes
+	// are still queried.
+	SecurityRequire
+)
+
 // New returns a new DHT QueryProcessor initialized with a bootstrap node.
+//
+// If the bootstrap node reports our external address, our node id is derived
+// from it as defined in BEP 42, so that nodes enforcing it keep us in their
+// routing tables.
 func New(bootstrap net.UDPAddr, k int) (*QueryProcessor, error) {
+	return NewContext(context.Background(), bootstrap, k)
+}
+
+// NewContext is like New but gives up pinging the bootstrap node once ctx is
+// done.
+func NewContext(ctx context.Context, bootstrap net.UDPAddr, k int) (*QueryProcessor, error) {
 	d, err := dht.New()
 	if err != nil {
 		return nil, fmt.Errorf("error creating DHT object: %v", err)
 	}
-	rt, err := newRoutingTable(k)
+	return NewWithDHT(ctx, d, bootstrap, k)
+}
+
+// NewWithDHT is like NewContext but issues queries through d, e.g. one whose
+// timeouts or capture are set before the bootstrap node is pinged. The
+// QueryProcessor takes ownership of d: it is closed along with the
+// QueryProcessor, or if creating it fails.
+func NewWithDHT(ctx context.Context, d *dht.DHT, bootstrap net.UDPAddr, k int) (*QueryProcessor, error) {
+	resp, err := d.PingContext(ctx, bootstrap)
 	if err != nil {
-		return nil, fmt.Errorf("error creating routing table: %v", err)
+		d.Close()
+		return nil, fmt.Errorf("error determining id of bootstrap node: %v", err)
 	}
-	q := &QueryProcessor{
-		dht:          d,
-		routingTable: rt,
+	if p, err := resp.ExternalAddr(); err == nil && p != nil {
+		d.SetSecureID(p.UDPAddr.IP)
 	}
-	// Get node id of Bootstrap node.
-	resp, err := d.Ping(bootstrap)
+	q, err := newQueryProcessor(d, k)
 	if err != nil {
-		return nil, fmt.Errorf("error determining id of bootstrap node: %v", err)
+		d.Close()
+		return nil, err
+	}
+	if err := q.addBootstrap(bootstrap, resp); err != nil {
+		d.Close()
+		return nil, err
 	}
-	id, ok := resp.Response["id"]
+	return q, nil
+}
+
+// newQueryProcessor returns a QueryProcessor issuing queries through d, with
+// empty routing tables for d's node id.
+func newQueryProcessor(d *dht.DHT, k int) (*QueryProcessor, error) {
+	rt, err := NewRoutingTable(d.ID, k)
+	if err != nil {
+		return nil, fmt.Errorf("error creating routing table: %v", err)
+	}
+	rt6, _ := NewRoutingTable(d.ID, k)
+	rt.SetPing(Pinger(d))
+	rt6.SetPing(Pinger(d))
+	return &QueryProcessor{
+		dht:    d,
+		table:  rt,
+		table6: rt6,
+		k:      k,
+		self:   make(map[string]bool),
+		alpha:  DefaultAlpha,
+	}, nil
+}
+
+// AddBootstrap adds another node for lookups to start from, e.g. one of a
+// different address family than the node given to New.
+func (q *QueryProcessor) AddBootstrap(bootstrap net.UDPAddr) error {
+	return q.AddBootstrapContext(context.Background(), bootstrap)
+}
+
+// AddBootstrapContext is like AddBootstrap but gives up pinging the node once
+// ctx is done.
+func (q *QueryProcessor) AddBootstrapContext(ctx context.Context, bootstrap net.UDPAddr) error {
+	resp, err := q.dht.PingContext(ctx, bootstrap)
+	if err != nil {
+		return fmt.Errorf("error determining id of bootstrap node: %v", err)
+	}
+	return q.addBootstrap(bootstrap, resp)
+}
+
+// addBootstrap adds the node at addr, which replied to a ping with resp, as a
+// bootstrap node.
+func (q *QueryProcessor) addBootstrap(addr net.UDPAddr, resp *dht.Message) error {
+	id, ok := resp.Response["id"].(string)
 	if !ok {
-		return nil, fmt.Errorf("ping response from bootstrap node did not include id: %v", resp)
+		return fmt.Errorf("ping response from bootstrap node did not include id: %v", resp)
 	}
 	node := dht.Node{
-		ID: []byte(id.(string)),
+		ID: []byte(id),
 		Peer: &dht.Peer{
-			UDPAddr: bootstrap,
+			UDPAddr: addr,
 		},
 	}
-	distance := big.NewInt(0)
-	q.routingTable.insert(node, *distance)
-	return q, nil
+	if p, err := resp.ExternalAddr(); err == nil && p != nil {
+		q.self[p.UDPAddr.String()] = true
+	}
+	q.observe(resp)
+	q.bootstrap = append(q.bootstrap, node)
+	q.tableFor(node).Insert(node)
+	return nil
+}
+
+// SetSecurity sets how lookups treat nodes whose ids aren't derived from their
+// IP addresses as defined in BEP 42.
+func (q *QueryProcessor) SetSecurity(s Security) {
+	q.security = s
+}
+
+// SetAlpha sets the number of queries a lookup keeps in flight at once.
+// Values below 1 select DefaultAlpha.
+func (q *QueryProcessor) SetAlpha(alpha int) {
+	q.alpha = alpha
+}
+
+// SetTimeout sets how long each query waits for a response, retransmissions
+// included. If zero, dht.DefaultTimeout is used.
+func (q *QueryProcessor) SetTimeout(timeout time.Duration) {
+	q.dht.Timeout = timeout
+}
+
+// SetRetries sets how many times each query is retransmitted within its
+// timeout before giving up on a node.
+func (q *QueryProcessor) SetRetries(retries int) {
+	q.dht.Retries = retries
+}
+
+// Stats returns counts of the outcomes of the queries issued by lookups so
+// far.
+func (q *QueryProcessor) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// observe notes our external IP address if resp reports it, as defined in
+// BEP 42.
+func (q *QueryProcessor) observe(resp *dht.Message) {
+	p, err := resp.ExternalAddr()
+	if err != nil || p == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.external = p.UDPAddr.IP
+}
+
+// record counts the outcome of a query that returned err.
+func (q *QueryProcessor) record(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Queried++
+	var kerr *dht.KRPCError
+	var terr *dht.TimeoutError
+	switch {
+	case err == nil:
+		q.stats.Responded++
+	case errors.As(err, &kerr):
+		q.stats.Errors++
+	case errors.As(err, &terr):
+		q.stats.TimedOut++
+	}
+}
+
+// ID returns our node id.
+func (q *QueryProcessor) ID() string {
+	return q.dht.ID
+}
+
+// SetWant sets the address families of nodes lookups walk through, dht.WantIPv4
+// and/or dht.WantIPv6 as defined in BEP 32. If want is empty, lookups follow
+// whichever nodes are returned, which is the family of our own address.
+func (q *QueryProcessor) SetWant(want []string) {
+	q.dht.Want = want
+}
+
+// wants reports whether lookups follow nodes of the given family.
+func (q *QueryProcessor) wants(family string) bool {
+	if len(q.dht.Want) == 0 {
+		return true
+	}
+	for _, w := range q.dht.Want {
+		if w == family {
+			return true
+		}
+	}
+	return false
+}
+
+// tableFor returns the routing table for n's address family.
+func (q *QueryProcessor) tableFor(n dht.Node) *RoutingTable {
+	if n.Peer != nil && n.Peer.IsIPv6() {
+		return q.table6
+	}
+	return q.table
+}
+
+// Table returns the QueryProcessor's routing table of IPv4 nodes.
+func (q *QueryProcessor) Table() *RoutingTable {
+	return q.table
+}
+
+// Table6 returns the QueryProcessor's routing table of IPv6 nodes.
+func (q *QueryProcessor) Table6() *RoutingTable {
+	return q.table6
+}
+
+// Close releases the QueryProcessor's DHT socket.
+func (q *QueryProcessor) Close() error {
+	return q.dht.Close()
 }
 
 // distance returns the distance metric between two node ids.
@@ -66,67 +299,719 @@ func distance(a, b []byte) (*big.Int, error) {
 	return i, nil
 }
 
-// FindNode finds the contact information for a target node given its node id.
+// maxDistance returns the furthest distance possible between two node ids, 2^160 - 1.
+func maxDistance() *big.Int {
+	return new(big.Int).SetBytes(bytes.Repeat([]byte{0xFF}, 20))
+}
+
+// lookup walks the DHT toward the 20 byte target t.
 //
-// Returns a response with a key "nodes" containing information for the target
-// node and/or the closest nodes to the target.
-func (q *QueryProcessor) FindNode(target string) (*dht.Message, error) {
-	var ret *dht.Message
-	closestDistance := new(big.Int)
-	// Furthest distance possible, 2^160.
-	closestDistance.SetBytes(bytes.Repeat([]byte{0xFF}, 20))
-	var visited []dht.Node
-	for q.routingTable.Len() > 0 {
-		node, _ := q.routingTable.pop()
-		visited = append(visited, node)
-		resp, err := q.dht.FindNode(node.Peer.UDPAddr, target)
-		if err != nil {
-			log.Print(err)
+// query is issued to the closest unqueried nodes known, starting from the
+// routing table, keeping up to alpha queries in flight at once. The lookup
+// ends once the K closest nodes heard of have all responded, passing over
+// those that don't for the next closest. visit is called with each successful
+// response, the node that sent it, and that node's distance to t. The lookup
+// stops early if visit returns false, and with ctx's error once ctx is done.
+func (q *QueryProcessor) lookup(ctx context.Context, t string, query func(ctx context.Context, server net.UDPAddr) (*dht.Message, error), visit func(node dht.Node, resp *dht.Message, d *big.Int) bool) error {
+	shortlist, err := newShortlist(q.k)
+	if err != nil {
+		return fmt.Errorf("error creating shortlist: %v", err)
+	}
+	if q.security == SecurityPrefer {
+		shortlist.demote = func(n dht.Node) bool { return !n.Secure() }
+	}
+	seen := make(map[string]bool)
+	var seeds []dht.Node
+	if q.wants(dht.WantIPv4) {
+		seeds = append(seeds, q.follow(q.table.Closest(t, q.k))...)
+	}
+	if q.wants(dht.WantIPv6) {
+		seeds = append(seeds, q.follow(q.table6.Closest(t, q.k))...)
+	}
+	bootstrapped := len(seeds) == 0
+	if bootstrapped {
+		seeds = q.bootstrap
+	}
+	insert := func(nodes []dht.Node) {
+		for _, n := range nodes {
+			d, err := distance([]byte(t), n.ID)
+			if err != nil {
+				d = maxDistance()
+			}
+			seen[string(n.ID)] = true
+			shortlist.insert(n, *d)
+		}
+	}
+	insert(seeds)
+	type result struct {
+		node dht.Node
+		resp *dht.Message
+		err  error
+	}
+	alpha := q.alpha
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	// Buffered so that queries still in flight when the lookup ends don't
+	// block.
+	results := make(chan result, alpha)
+	inflight := 0
+	responded := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for inflight < alpha {
+			node, err := shortlist.pop()
+			if err != nil {
+				break
+			}
+			inflight++
+			go func(node dht.Node) {
+				resp, err := query(ctx, node.Peer.UDPAddr)
+				q.record(err)
+				results <- result{node, resp, err}
+			}(node)
+		}
+		if inflight == 0 {
+			// None of the nodes in the routing tables responded, e.g. as
+			// they were saved long ago. Start over from the bootstrap nodes.
+			if !responded && !bootstrapped && len(q.bootstrap) > 0 {
+				bootstrapped = true
+				insert(q.bootstrap)
+				continue
+			}
+			break
+		}
+		var r result
+		select {
+		case r = <-results:
+			inflight--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		node, resp := r.node, r.resp
+		if r.err != nil {
+			log.Print(r.err)
+			shortlist.remove(node)
+			// Nodes that time out are evicted, so that they aren't saved in
+			// the state and queried again next time.
+			var terr *dht.TimeoutError
+			if errors.As(r.err, &terr) {
+				q.tableFor(node).Remove(node.ID)
+			}
 			continue
 		}
-		nodes, err := resp.Nodes()
+		if resp.Mtype != "r" {
+			log.Printf("unexpected reply from %v: %v", &node.Peer.UDPAddr, resp)
+			shortlist.remove(node)
+			continue
+		}
+		q.observe(resp)
+		nodes, err := q.nodes(resp)
 		if err != nil {
 			log.Print(err)
+			shortlist.remove(node)
 			continue
 		}
-		if ret == nil {
-			// At least return the result of the first FindNode query if it
-			// contains any nodes.
-			ret = resp
+		responded = true
+		if id, ok := resp.Response["id"].(string); ok && len(id) == 20 {
+			node = dht.Node{ID: []byte(id), Peer: node.Peer}
+			if q.security != SecurityRequire || node.Secure() {
+				q.tableFor(node).Insert(node)
+			}
 		}
-		t, _ := dht.EncodeInfoHash(target)
 		d, err := distance([]byte(t), node.ID)
 		if err != nil {
+			// Without knowing how close the node is, its response can't be
+			// used to make progress toward the target.
 			log.Printf("distance(%x, %x): %v", []byte(t), node.ID, err)
+			visit(node, resp, maxDistance())
 			continue
 		}
-		if d.Cmp(closestDistance) < 0 {
-			// Set ret to the FindNodes response from the closest node heard from.
-			ret = resp
-			closestDistance = d
+		if !visit(node, resp, d) {
+			return nil
 		}
-	NODES:
-		for _, n := range nodes {
+		for _, n := range q.follow(nodes) {
 			distance, err := distance([]byte(t), n.ID)
 			if err != nil {
 				log.Printf("distance(%x, %x): %v", []byte(t), n.ID, err)
 				continue
 			}
-			if distance.Int64() == 0 {
+			// Exclude previously seen nodes and ourselves, which nodes may
+			// know under the id we had before adopting a secure one.
+			if seen[string(n.ID)] || string(n.ID) == q.dht.ID || q.self[n.Peer.UDPAddr.String()] {
+				continue
+			}
+			seen[string(n.ID)] = true
+			shortlist.insert(n, *distance)
+		}
+	}
+	if !responded {
+		return fmt.Errorf("could not successfully query any DHT nodes")
+	}
+	return nil
+}
+
+// follow returns the nodes lookups may query, dropping nodes with insecure
+// ids if they are required.
+func (q *QueryProcessor) follow(nodes []dht.Node) []dht.Node {
+	if q.security != SecurityRequire {
+		return nodes
+	}
+	var ret []dht.Node
+	for _, n := range nodes {
+		if n.Secure() {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// nodes returns the nodes in resp of the address families lookups follow.
+func (q *QueryProcessor) nodes(resp *dht.Message) ([]dht.Node, error) {
+	var nodes []dht.Node
+	if q.wants(dht.WantIPv4) {
+		n, err := resp.Nodes()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n...)
+	}
+	if q.wants(dht.WantIPv6) {
+		n, err := resp.Nodes6()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n...)
+	}
+	return nodes, nil
+}
+
+// FindNode finds the contact information for a target node given its node id.
+//
+// Returns a response with a key "nodes" containing information for the target
+// node and/or the closest nodes to the target.
+func (q *QueryProcessor) FindNode(target string) (*dht.Message, error) {
+	return q.FindNodeContext(context.Background(), target)
+}
+
+// FindNodeContext is like FindNode but stops once ctx is done, returning the
+// response from the closest node heard from so far, if any, along with ctx's
+// error.
+func (q *QueryProcessor) FindNodeContext(ctx context.Context, target string) (*dht.Message, error) {
+	t, err := dht.EncodeInfoHash(target)
+	if err != nil {
+		return nil, err
+	}
+	var ret *dht.Message
+	closestDistance := maxDistance()
+	err = q.lookup(ctx, t, func(ctx context.Context, server net.UDPAddr) (*dht.Message, error) {
+		return q.dht.FindNodeContext(ctx, server, target)
+	}, func(node dht.Node, resp *dht.Message, d *big.Int) bool {
+		if ret == nil || d.Cmp(closestDistance) < 0 {
+			// Set ret to the FindNodes response from the closest node heard
+			// from, or at least the first one.
+			ret = resp
+			closestDistance = d
+		}
+		nodes, _ := q.nodes(resp)
+		for _, n := range nodes {
+			if bytes.Equal(n.ID, []byte(t)) {
 				// Target found
-				return ret, nil
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	return ret, err
+}
+
+// GetPeers searches the DHT for peers of the torrent with the given info_hash.
+//
+// Every node visited on the way toward the info_hash is asked for peers. The
+// peers they return are deduplicated, and the token each node returned is
+// recorded for use in a later announce_peer query.
+func (q *QueryProcessor) GetPeers(infoHash string) (*PeersResult, error) {
+	return q.GetPeersContext(context.Background(), infoHash)
+}
+
+// GetPeersContext is like GetPeers but stops once ctx is done, returning the
+// peers and nodes found so far along with ctx's error.
+func (q *QueryProcessor) GetPeersContext(ctx context.Context, infoHash string) (*PeersResult, error) {
+	t, err := dht.EncodeInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	ret := &PeersResult{InfoHash: t}
+	seen := make(map[string]bool)
+	err = q.lookup(ctx, t, func(ctx context.Context, server net.UDPAddr) (*dht.Message, error) {
+		return q.dht.GetPeersContext(ctx, server, infoHash)
+	}, func(node dht.Node, resp *dht.Message, d *big.Int) bool {
+		peers, err := resp.Values()
+		if err != nil {
+			log.Print(err)
+		}
+		for _, p := range peers {
+			if a := p.UDPAddr.String(); !seen[a] {
+				seen[a] = true
+				ret.Peers = append(ret.Peers, p)
+			}
+		}
+		token, _ := resp.Response["token"].(string)
+		ret.Nodes = append(ret.Nodes, TokenNode{Node: node, Token: token, distance: d})
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	sort.SliceStable(ret.Nodes, func(i, j int) bool {
+		return ret.Nodes[i].distance.Cmp(ret.Nodes[j].distance) < 0
+	})
+	return ret, err
+}
+
+// Scrape estimates the number of seeds and other peers of the torrent with
+// the given info_hash, as defined in BEP 33.
+//
+// Every node visited on the way toward the info_hash is asked for bloom
+// filters of the seeds and peers it stores, which are merged so that peers
+// known to several nodes are only counted once.
+func (q *QueryProcessor) Scrape(infoHash string) (*ScrapeResult, error) {
+	return q.ScrapeContext(context.Background(), infoHash)
+}
+
+// ScrapeContext is like Scrape but stops once ctx is done, returning the
+// estimate from the filters merged so far along with ctx's error.
+func (q *QueryProcessor) ScrapeContext(ctx context.Context, infoHash string) (*ScrapeResult, error) {
+	t, err := dht.EncodeInfoHash(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ScrapeResult{InfoHash: t, Seeds: &dht.BloomFilter{}, Peers: &dht.BloomFilter{}}
+	err = q.lookup(ctx, t, func(ctx context.Context, server net.UDPAddr) (*dht.Message, error) {
+		return q.dht.ScrapeContext(ctx, server, infoHash, false)
+	}, func(node dht.Node, resp *dht.Message, d *big.Int) bool {
+		seeds, peers, err := resp.Scrape()
+		if err != nil {
+			log.Print(err)
+			return true
+		}
+		if seeds == nil && peers == nil {
+			// The node doesn't support BEP 33.
+			return true
+		}
+		if seeds != nil {
+			ret.Seeds.Merge(seeds)
+		}
+		if peers != nil {
+			ret.Peers.Merge(peers)
+		}
+		ret.Nodes++
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	return ret, err
+}
+
+// AnnouncePeer announces ourselves as a peer of the torrent with the given
+// info_hash to the K closest nodes to it.
+//
+// A get_peers lookup is run first to find the closest nodes and obtain their
+// tokens. port is the port of the announced peer; if zero, the
+// "implied_port" setting is sent instead.
+func (q *QueryProcessor) AnnouncePeer(infoHash string, port int) (*AnnounceResult, error) {
+	return q.AnnouncePeerContext(context.Background(), infoHash, port)
+}
+
+// AnnouncePeerContext is like AnnouncePeer but stops once ctx is done,
+// returning the nodes that accepted the announce so far, if any, along with
+// ctx's error. Nodes are only announced to once the lookup has completed.
+func (q *QueryProcessor) AnnouncePeerContext(ctx context.Context, infoHash string, port int) (*AnnounceResult, error) {
+	peers, err := q.GetPeersContext(ctx, infoHash)
+	if err != nil {
+		// peers is nil if the lookup never started, as for invalid hashes.
+		if peers != nil && ctx.Err() != nil {
+			return &AnnounceResult{InfoHash: peers.InfoHash, Port: port}, err
+		}
+		return nil, err
+	}
+	accepted, rejected, err := q.store(ctx, peers.Nodes, func(ctx context.Context, server net.UDPAddr, token string) (*dht.Message, error) {
+		return q.dht.AnnouncePeerContext(ctx, server, infoHash, token, port)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error announcing %v: %v", infoHash, err)
+	}
+	return &AnnounceResult{InfoHash: peers.InfoHash, Port: port, Accepted: accepted, Rejected: rejected}, ctx.Err()
+}
+
+// store issues query concurrently to the first K nodes that returned a token,
+// with the hexadecimal token each returned, and returns the nodes that
+// accepted it and those that didn't. Queries still in flight once ctx is done
+// are abandoned and their nodes counted as rejected.
+func (q *QueryProcessor) store(ctx context.Context, nodes []TokenNode, query func(ctx context.Context, server net.UDPAddr, token string) (*dht.Message, error)) ([]dht.Node, []RejectedNode, error) {
+	var targets []dht.Node
+	var tokens []string
+	for _, n := range nodes {
+		if len(targets) == q.k {
+			break
+		}
+		if n.Token == "" {
+			continue
+		}
+		targets = append(targets, n.Node)
+		tokens = append(tokens, fmt.Sprintf("%x", n.Token))
+	}
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("no nodes returned a token")
+	}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := query(ctx, targets[i].Peer.UDPAddr, tokens[i])
+			q.record(err)
+			if err != nil {
+				errs[i] = err
+			} else if resp.Mtype != "r" {
+				errs[i] = fmt.Errorf("unexpected reply %v", resp)
 			}
-			// Exclude previously visited nodes.
-			for _, v := range visited {
-				if bytes.Equal(v.ID, n.ID) {
-					continue NODES
+		}(i)
+	}
+	wg.Wait()
+	var accepted []dht.Node
+	var rejected []RejectedNode
+	for i, n := range targets {
+		if errs[i] != nil {
+			rejected = append(rejected, RejectedNode{Node: n, Err: errs[i]})
+		} else {
+			accepted = append(accepted, n)
+		}
+	}
+	return accepted, rejected, nil
+}
+
+// Get searches the DHT for the item stored under the given target, as defined
+// in BEP 44.
+//
+// Every node visited on the way toward the target is asked for the item, and
+// the token each returns is recorded for use in a later put. The lookup stops
+// at the first node returning an immutable item whose SHA-1 hash matches the
+// target. Mutable items are only found by Get if stored without a salt; see
+// GetMutable.
+func (q *QueryProcessor) Get(target string) (*ItemResult, error) {
+	return q.GetContext(context.Background(), target)
+}
+
+// GetContext is like Get but stops once ctx is done, returning what was found
+// so far along with ctx's error.
+func (q *QueryProcessor) GetContext(ctx context.Context, target string) (*ItemResult, error) {
+	t, err := dht.EncodeInfoHash(target)
+	if err != nil {
+		return nil, err
+	}
+	return q.get(ctx, t, nil, false)
+}
+
+// GetMutable searches the DHT for the mutable item signed by the given
+// ed25519 public key with the given salt, as defined in BEP 44.
+//
+// Every node visited on the way toward the item's target is asked for it,
+// and the validly signed item with the highest sequence number is returned.
+func (q *QueryProcessor) GetMutable(key ed25519.PublicKey, salt []byte) (*ItemResult, error) {
+	return q.GetMutableContext(context.Background(), key, salt)
+}
+
+// GetMutableContext is like GetMutable but stops once ctx is done, returning
+// the newest item found so far, if any, along with ctx's error.
+func (q *QueryProcessor) GetMutableContext(ctx context.Context, key ed25519.PublicKey, salt []byte) (*ItemResult, error) {
+	t, err := (&dht.Item{K: key, Salt: salt}).Target()
+	if err != nil {
+		return nil, err
+	}
+	return q.get(ctx, t, salt, true)
+}
+
+// get looks up the item stored under the 20 byte target t, verifying mutable
+// items with salt. If all is set, the lookup doesn't stop once an immutable
+// item is found, so that every node close to t is visited.
+func (q *QueryProcessor) get(ctx context.Context, t string, salt []byte, all bool) (*ItemResult, error) {
+	ret := &ItemResult{Target: t}
+	target := fmt.Sprintf("%x", t)
+	err := q.lookup(ctx, t, func(ctx context.Context, server net.UDPAddr) (*dht.Message, error) {
+		return q.dht.GetContext(ctx, server, target)
+	}, func(node dht.Node, resp *dht.Message, d *big.Int) bool {
+		token, _ := resp.Response["token"].(string)
+		ret.Nodes = append(ret.Nodes, TokenNode{Node: node, Token: token, distance: d})
+		item, err := resp.Item()
+		if err != nil {
+			log.Printf("invalid item from %v: %v", node.Peer, err)
+			return true
+		}
+		if item == nil {
+			return true
+		}
+		item.Salt = salt
+		if err := item.Verify(t); err != nil {
+			log.Printf("invalid item from %v: %v", node.Peer, err)
+			return true
+		}
+		if !item.Mutable() {
+			ret.Item = item
+			return all
+		}
+		// Nodes may hold older versions of a mutable item.
+		if ret.Item == nil || item.Seq > ret.Item.Seq {
+			ret.Item = item
+		}
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	sort.SliceStable(ret.Nodes, func(i, j int) bool {
+		return ret.Nodes[i].distance.Cmp(ret.Nodes[j].distance) < 0
+	})
+	return ret, err
+}
+
+// Put stores item on the K closest nodes to its target, as defined in BEP 44.
+//
+// A get lookup is run first to find the closest nodes and obtain their
+// tokens. Mutable items must already be signed.
+func (q *QueryProcessor) Put(item *dht.Item) (*PutResult, error) {
+	return q.PutContext(context.Background(), item)
+}
+
+// PutContext is like Put but stops once ctx is done, returning the nodes that
+// accepted the item so far, if any, along with ctx's error. Nodes are only
+// stored on once the lookup has completed.
+func (q *QueryProcessor) PutContext(ctx context.Context, item *dht.Item) (*PutResult, error) {
+	return q.put(ctx, item, func(*dht.Item) (*dht.Item, *int64, error) {
+		return item, nil, nil
+	})
+}
+
+// PutMutable signs v with key and stores it as a mutable item with the given
+// salt on the K closest nodes to its target, as defined in BEP 44.
+//
+// A get lookup is run first to find the closest nodes, obtain their tokens
+// and the newest version of the item stored. The item is stored with the
+// next sequence number, and the current sequence number is sent as "cas" so
+// that nodes reject the put if the item changed in the meantime.
+func (q *QueryProcessor) PutMutable(v interface{}, key ed25519.PrivateKey, salt []byte) (*PutResult, error) {
+	return q.PutMutableContext(context.Background(), v, key, salt)
+}
+
+// PutMutableContext is like PutMutable but stops once ctx is done, like
+// PutContext.
+func (q *QueryProcessor) PutMutableContext(ctx context.Context, v interface{}, key ed25519.PrivateKey, salt []byte) (*PutResult, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key: needs to be %d bytes", ed25519.PrivateKeySize)
+	}
+	item := &dht.Item{K: key.Public().(ed25519.PublicKey), Salt: salt}
+	return q.put(ctx, item, func(cur *dht.Item) (*dht.Item, *int64, error) {
+		if cur == nil {
+			i, err := dht.NewMutableItem(v, key, salt, 0)
+			return i, nil, err
+		}
+		cas := cur.Seq
+		i, err := dht.NewMutableItem(v, key, salt, cur.Seq+1)
+		return i, &cas, err
+	})
+}
+
+// PutCAS stores the signed mutable item on the K closest nodes to its target,
+// as defined in BEP 44, if the sequence number of the item they store is cas.
+func (q *QueryProcessor) PutCAS(item *dht.Item, cas int64) (*PutResult, error) {
+	return q.PutCASContext(context.Background(), item, cas)
+}
+
+// PutCASContext is like PutCAS but stops once ctx is done, like PutContext.
+func (q *QueryProcessor) PutCASContext(ctx context.Context, item *dht.Item, cas int64) (*PutResult, error) {
+	if !item.Mutable() {
+		return nil, fmt.Errorf("compare-and-swap requires a mutable item")
+	}
+	return q.put(ctx, item, func(*dht.Item) (*dht.Item, *int64, error) {
+		return item, &cas, nil
+	})
+}
+
+// put looks up the target of item and stores the item returned by next,
+// called with the newest item found there, and "cas" value if not nil, on the
+// closest nodes.
+func (q *QueryProcessor) put(ctx context.Context, item *dht.Item, next func(cur *dht.Item) (*dht.Item, *int64, error)) (*PutResult, error) {
+	t, err := item.Target()
+	if err != nil {
+		return nil, err
+	}
+	// Walk all the way to the target, even if the item is already stored,
+	// to reach the closest nodes.
+	found, err := q.get(ctx, t, item.Salt, true)
+	if err != nil {
+		if ctx.Err() != nil {
+			return &PutResult{Target: t, Item: item}, err
+		}
+		return nil, err
+	}
+	item, cas, err := next(found.Item)
+	if err != nil {
+		return nil, err
+	}
+	accepted, rejected, err := q.store(ctx, found.Nodes, func(ctx context.Context, server net.UDPAddr, token string) (*dht.Message, error) {
+		if cas != nil {
+			return q.dht.PutCASContext(ctx, server, token, item, *cas)
+		}
+		return q.dht.PutContext(ctx, server, token, item)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error putting item %x: %v", t, err)
+	}
+	return &PutResult{Target: t, Item: item, Accepted: accepted, Rejected: rejected}, ctx.Err()
+}
+
+// Sample walks the DHT with sample_infohashes queries as defined in BEP 51,
+// calling visit with every info hash not seen before along with the node that
+// returned it. The walk stops early if visit returns false.
+//
+// Up to alpha queries are kept in flight at once. Each node is queried with a
+// random target so that the nodes it returns, which are queried in turn,
+// cover the whole keyspace. A node holding more info hashes than it returned
+// is queried again once the interval it returned has elapsed, as long as it
+// keeps returning new ones. The walk ends once no node is left to query,
+// which on the public DHT may take very long.
+func (q *QueryProcessor) Sample(visit func(r SampleResult) bool) error {
+	return q.SampleContext(context.Background(), visit)
+}
+
+// SampleContext is like Sample but stops with ctx's error once ctx is done.
+func (q *QueryProcessor) SampleContext(ctx context.Context, visit func(r SampleResult) bool) error {
+	type scheduled struct {
+		node dht.Node
+		at   time.Time
+	}
+	var pending []scheduled
+	seen := make(map[string]bool)
+	add := func(nodes []dht.Node) {
+		for _, n := range q.follow(nodes) {
+			a := n.Peer.UDPAddr.String()
+			if seen[a] || string(n.ID) == q.dht.ID || q.self[a] {
+				continue
+			}
+			seen[a] = true
+			pending = append(pending, scheduled{node: n})
+		}
+	}
+	add(q.bootstrap)
+	add(q.table.Closest(q.dht.ID, q.k))
+	add(q.table6.Closest(q.dht.ID, q.k))
+	type result struct {
+		node dht.Node
+		resp *dht.Message
+		err  error
+	}
+	alpha := q.alpha
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	results := make(chan result, alpha)
+	inflight := 0
+	found := make(map[string]bool)
+	responded := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Query the nodes that may be queried soonest, up to alpha at once.
+		var wait <-chan time.Time
+		for inflight < alpha && len(pending) > 0 {
+			next := 0
+			for i := range pending {
+				if pending[i].at.Before(pending[next].at) {
+					next = i
 				}
 			}
-			q.routingTable.insert(n, *distance)
+			if d := time.Until(pending[next].at); d > 0 {
+				// Wait for the node's interval to elapse.
+				wait = time.After(d)
+				break
+			}
+			node := pending[next].node
+			pending = append(pending[:next], pending[next+1:]...)
+			target := make([]byte, 20)
+			if _, err := rand.Read(target); err != nil {
+				return fmt.Errorf("error generating target: %v", err)
+			}
+			inflight++
+			go func(node dht.Node) {
+				resp, err := q.dht.SampleInfohashesContext(ctx, node.Peer.UDPAddr, fmt.Sprintf("%x", target))
+				q.record(err)
+				results <- result{node, resp, err}
+			}(node)
+		}
+		if inflight == 0 && wait == nil {
+			break
+		}
+		var r result
+		select {
+		case r = <-results:
+			inflight--
+		case <-wait:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			log.Print(r.err)
+			continue
+		}
+		if r.resp.Mtype != "r" {
+			log.Printf("unexpected reply from %v: %v", &r.node.Peer.UDPAddr, r.resp)
+			continue
+		}
+		samples, err := r.resp.Samples()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		responded = true
+		node := r.node
+		if id, ok := r.resp.Response["id"].(string); ok && len(id) == 20 {
+			node = dht.Node{ID: []byte(id), Peer: node.Peer}
+			if q.security != SecurityRequire || node.Secure() {
+				q.tableFor(node).Insert(node)
+			}
+		}
+		fresh := false
+		for _, h := range samples.InfoHashes {
+			if found[h] {
+				continue
+			}
+			found[h] = true
+			fresh = true
+			if !visit(SampleResult{InfoHash: h, Node: node}) {
+				return nil
+			}
+		}
+		if fresh && samples.Num > int64(len(samples.InfoHashes)) {
+			pending = append(pending, scheduled{node, time.Now().Add(samples.Interval)})
+		}
+		nodes, err := q.nodes(r.resp)
+		if err != nil {
+			log.Print(err)
+			continue
 		}
+		add(nodes)
 	}
-	if ret == nil {
-		return nil, fmt.Errorf("could not successfully query any DHT nodes")
+	if !responded {
+		return fmt.Errorf("could not successfully query any DHT nodes")
 	}
-	return ret, nil
+	return nil
 }
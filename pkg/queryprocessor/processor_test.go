@@ -2,13 +2,20 @@ package queryprocessor
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
 	"github.com/jeanralphaviles/dhtcli/pkg/dht"
 	"github.com/zeebo/bencode"
 	"log"
+	"math"
 	"math/big"
 	"net"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
 var addr *net.UDPAddr
@@ -33,11 +40,26 @@ func init() {
 		defer server.Close()
 		buf := make([]byte, 1024)
 		for {
-			_, client, err := server.ReadFromUDP(buf)
+			n, client, err := server.ReadFromUDP(buf)
 			if err != nil {
 				log.Panic(err)
 			}
-			_, err = server.WriteTo(buffer.Bytes(), client)
+			// Answer with the canned response under the request's transaction id.
+			req := &dht.Message{}
+			resp := &dht.Message{}
+			if err := bencode.DecodeBytes(buf[:n], req); err != nil {
+				log.Panic(err)
+			}
+			if err := bencode.DecodeBytes(buffer.Bytes(), resp); err != nil {
+				buffer.Reset()
+				continue
+			}
+			resp.TransactionID = req.TransactionID
+			b, err := bencode.EncodeBytes(resp)
+			if err != nil {
+				log.Panic(err)
+			}
+			_, err = server.WriteTo(b, client)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -106,6 +128,7 @@ func TestFindNode(t *testing.T) {
 	}
 	q := &QueryProcessor{
 		dht: d,
+		k:   1,
 	}
 	cases := []struct {
 		bootstrap *dht.Node
@@ -158,14 +181,19 @@ func TestFindNode(t *testing.T) {
 		},
 	}
 	for n, c := range cases {
-		rt, err := newRoutingTable(1)
+		rt, err := NewRoutingTable(d.ID, 1)
 		if err != nil {
 			t.Fatalf("error creating routing table: %v", err)
 		}
+		rt6, err := NewRoutingTable(d.ID, 1)
+		if err != nil {
+			t.Fatalf("error creating routing table: %v", err)
+		}
+		q.table, q.table6 = rt, rt6
+		q.bootstrap = nil
 		if c.bootstrap != nil {
-			rt.insert(*c.bootstrap, *big.NewInt(1000))
+			q.bootstrap = []dht.Node{*c.bootstrap}
 		}
-		q.routingTable = rt
 		m := dht.NewResponse("", c.resp)
 		if err := bencode.NewEncoder(buffer).Encode(m); err != nil {
 			t.Errorf("case %d: error writing to buffer: %v", n, err)
@@ -177,11 +205,547 @@ func TestFindNode(t *testing.T) {
 			continue
 		}
 		if c.fail {
+			buffer.Reset()
 			continue
 		}
-		want := dht.NewResponse("", c.want)
+		want := dht.NewResponse(got.TransactionID, c.want)
 		if !reflect.DeepEqual(got, want) {
 			t.Errorf("case %d: got %v, want %v", n, got, want)
 		}
 	}
 }
+
+// newTestNetwork starts n dual-stack DHT servers on localhost that all know
+// each other by both their IPv4 and IPv6 loopback addresses and returns them.
+func newTestNetwork(t *testing.T, n int) []*dht.DHT {
+	t.Helper()
+	var nodes []*dht.DHT
+	var tables, tables6 []*RoutingTable
+	for i := 0; i < n; i++ {
+		d, err := dht.Listen(net.UDPAddr{})
+		if err != nil {
+			t.Fatalf("error creating DHT: %v", err)
+		}
+		t.Cleanup(func() { d.Close() })
+		rt, err := NewRoutingTable(d.ID, dht.K)
+		if err != nil {
+			t.Fatalf("error creating routing table: %v", err)
+		}
+		rt6, err := NewRoutingTable(d.ID, dht.K)
+		if err != nil {
+			t.Fatalf("error creating routing table: %v", err)
+		}
+		if _, err := dht.NewServer(d, rt, rt6); err != nil {
+			t.Fatalf("error creating server: %v", err)
+		}
+		nodes = append(nodes, d)
+		tables = append(tables, rt)
+		tables6 = append(tables6, rt6)
+	}
+	for i := range nodes {
+		for j, d := range nodes {
+			if i != j {
+				tables[i].Insert(dht.Node{ID: []byte(d.ID), Peer: &dht.Peer{UDPAddr: localAddr(d, "127.0.0.1")}})
+				tables6[i].Insert(dht.Node{ID: []byte(d.ID), Peer: &dht.Peer{UDPAddr: localAddr(d, "::1")}})
+			}
+		}
+	}
+	return nodes
+}
+
+// localAddr returns the address of d on the loopback interface with the given IP.
+func localAddr(d *dht.DHT, ip string) net.UDPAddr {
+	return net.UDPAddr{IP: net.ParseIP(ip), Port: d.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// announce announces port as a peer for infoHash from the DHT node from to the node at server.
+func announce(t *testing.T, from *dht.DHT, server net.UDPAddr, infoHash string, port int) {
+	t.Helper()
+	resp, err := from.GetPeers(server, infoHash)
+	if err != nil {
+		t.Fatalf("error issuing get_peers: %v", err)
+	}
+	token := fmt.Sprintf("%x", resp.Response["token"])
+	if _, err := from.AnnouncePeer(server, infoHash, token, port); err != nil {
+		t.Fatalf("error issuing announce_peer: %v", err)
+	}
+}
+
+func TestGetPeers(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	// Every node returns both peers, which must be deduplicated.
+	for i, n := range nodes {
+		from := nodes[(i+1)%len(nodes)]
+		announce(t, from, localAddr(n, "127.0.0.1"), infoHash, 1000)
+		announce(t, from, localAddr(n, "127.0.0.1"), infoHash, 2000)
+	}
+
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	got, err := q.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	ports := map[int]bool{}
+	for _, p := range got.Peers {
+		ports[p.UDPAddr.Port] = true
+	}
+	if len(got.Peers) != 2 || !ports[1000] || !ports[2000] {
+		t.Errorf("expected 2 deduplicated peers, got %v", got.Peers)
+	}
+	if len(got.Nodes) < dht.K {
+		t.Errorf("expected at least %d nodes to respond, got %d", dht.K, len(got.Nodes))
+	}
+	for i, n := range got.Nodes {
+		if n.Token == "" {
+			t.Errorf("node %x returned no token", n.Node.ID)
+		}
+		if i > 0 && n.distance.Cmp(got.Nodes[i-1].distance) < 0 {
+			t.Errorf("nodes are not sorted by distance to the info_hash")
+		}
+	}
+
+	if _, err := q.GetPeers("123"); err == nil {
+		t.Errorf("expected GetPeers with an invalid info_hash to error")
+	}
+}
+
+func TestAnnouncePeer(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	got, err := q.AnnouncePeer(infoHash, 7000)
+	if err != nil {
+		t.Fatalf("error issuing AnnouncePeer: %v", err)
+	}
+	if len(got.Accepted) != dht.K || len(got.Rejected) != 0 {
+		t.Errorf("expected %d nodes to accept the announce, got %v", dht.K, got)
+	}
+
+	peers, err := q.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	if len(peers.Peers) != 1 || peers.Peers[0].UDPAddr.Port != 7000 {
+		t.Errorf("expected announced peer to be found, got %v", peers.Peers)
+	}
+
+	if _, err := q.AnnouncePeer("123", 7000); err == nil {
+		t.Errorf("expected AnnouncePeer with an invalid info_hash to error")
+	}
+}
+
+func TestGetPeersFamilies(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	for i, n := range nodes {
+		from := nodes[(i+1)%len(nodes)]
+		announce(t, from, localAddr(n, "127.0.0.1"), infoHash, 4000)
+		announce(t, from, localAddr(n, "::1"), infoHash, 6000)
+	}
+	cases := []struct {
+		want  []string
+		peers []string
+	}{
+		{[]string{dht.WantIPv4}, []string{"127.0.0.1:4000"}},
+		{[]string{dht.WantIPv6}, []string{"[::1]:6000"}},
+		{[]string{dht.WantIPv4, dht.WantIPv6}, []string{"127.0.0.1:4000", "[::1]:6000"}},
+	}
+	for n, c := range cases {
+		q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+		if err != nil {
+			t.Fatalf("case %d: error creating QueryProcessor: %v", n, err)
+		}
+		defer q.Close()
+		if err := q.AddBootstrap(localAddr(nodes[0], "::1")); err != nil {
+			t.Fatalf("case %d: error adding IPv6 bootstrap node: %v", n, err)
+		}
+		q.SetWant(c.want)
+		got, err := q.GetPeers(infoHash)
+		if err != nil {
+			t.Fatalf("case %d: error issuing GetPeers: %v", n, err)
+		}
+		var peers []string
+		for _, p := range got.Peers {
+			peers = append(peers, p.UDPAddr.String())
+		}
+		sort.Strings(peers)
+		if !reflect.DeepEqual(peers, c.peers) {
+			t.Errorf("case %d: expected peers %v, got %v", n, c.peers, peers)
+		}
+		for _, node := range got.Nodes {
+			ipv6 := node.Node.Peer.IsIPv6()
+			if ipv6 && !q.wants(dht.WantIPv6) || !ipv6 && !q.wants(dht.WantIPv4) {
+				t.Errorf("case %d: lookup visited node of unwanted family: %v", n, node.Node.Peer)
+			}
+		}
+	}
+}
+
+func TestPutAndGet(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	item := &dht.Item{V: "Hello World!"}
+	target := "e5f96f6f38320f0f33959cb4d3d656452117aadb"
+
+	got, err := q.Get(target)
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	if got.Item != nil {
+		t.Errorf("expected no item before putting, got %v", got.Item)
+	}
+
+	put, err := q.Put(item)
+	if err != nil {
+		t.Fatalf("error issuing Put: %v", err)
+	}
+	if fmt.Sprintf("%x", put.Target) != target {
+		t.Errorf("expected target %v, got %x", target, put.Target)
+	}
+	if len(put.Accepted) != dht.K || len(put.Rejected) != 0 {
+		t.Errorf("expected %d nodes to accept the put, got %v", dht.K, put)
+	}
+
+	// A fresh lookup from another node finds the item.
+	q2, err := New(localAddr(nodes[len(nodes)-1], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q2.Close()
+	got, err = q2.Get(target)
+	if err != nil {
+		t.Fatalf("error issuing Get: %v", err)
+	}
+	if got.Item == nil || got.Item.V != item.V {
+		t.Errorf("expected item %v, got %v", item, got.Item)
+	}
+}
+
+func TestPutAndGetMutable(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	salt := []byte("config")
+
+	// Each put finds the current version and stores the next.
+	for seq, v := range []string{"first", "second"} {
+		put, err := q.PutMutable(v, key, salt)
+		if err != nil {
+			t.Fatalf("error issuing PutMutable: %v", err)
+		}
+		if put.Item.Seq != int64(seq) || len(put.Accepted) != dht.K {
+			t.Errorf("expected item with seq %d accepted by %d nodes, got %v", seq, dht.K, put)
+		}
+	}
+
+	// A stale compare-and-swap is rejected.
+	stale, err := dht.NewMutableItem("stale", key, salt, 5)
+	if err != nil {
+		t.Fatalf("error creating item: %v", err)
+	}
+	put, err := q.PutCAS(stale, 0)
+	if err != nil {
+		t.Fatalf("error issuing PutCAS: %v", err)
+	}
+	if len(put.Accepted) != 0 {
+		t.Errorf("expected stale compare-and-swap to be rejected, got %v", put)
+	}
+
+	q2, err := New(localAddr(nodes[len(nodes)-1], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q2.Close()
+	got, err := q2.GetMutable(pub, salt)
+	if err != nil {
+		t.Fatalf("error issuing GetMutable: %v", err)
+	}
+	if got.Item == nil || got.Item.V != "second" || got.Item.Seq != 1 {
+		t.Errorf("expected item \"second\" with seq 1, got %v", got.Item)
+	}
+	// The wrong salt doesn't find it.
+	got, err = q2.GetMutable(pub, []byte("other"))
+	if err != nil {
+		t.Fatalf("error issuing GetMutable: %v", err)
+	}
+	if got.Item != nil {
+		t.Errorf("expected no item under another salt, got %v", got.Item)
+	}
+}
+
+func TestSample(t *testing.T) {
+	nodes := newTestNetwork(t, 6)
+	want := map[string]bool{}
+	for i, n := range nodes {
+		infoHash := fmt.Sprintf("%040x", i+1)
+		announce(t, nodes[(i+1)%len(nodes)], localAddr(n, "127.0.0.1"), infoHash, 1000)
+		h, _ := dht.EncodeInfoHash(infoHash)
+		want[h] = true
+	}
+
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	got := map[string]bool{}
+	err = q.Sample(func(r SampleResult) bool {
+		if got[r.InfoHash] {
+			t.Errorf("info hash 0x%x visited twice", r.InfoHash)
+		}
+		got[r.InfoHash] = true
+		return true
+	})
+	if err != nil {
+		t.Fatalf("error issuing Sample: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected Sample to find %d info hashes, got %d", len(want), len(got))
+	}
+
+	// The walk stops once visit returns false.
+	n := 0
+	err = q.Sample(func(r SampleResult) bool {
+		n++
+		return n < 2
+	})
+	if err != nil || n != 2 {
+		t.Errorf("expected Sample to stop after 2 info hashes, got %d (%v)", n, err)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infoHash := "4142434445464748494A4B4C4D4E4F5051525354"
+	// Every node knows the same peer, which must be counted once.
+	for i, n := range nodes {
+		announce(t, nodes[(i+1)%len(nodes)], localAddr(n, "127.0.0.1"), infoHash, 1000)
+	}
+
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	got, err := q.Scrape(infoHash)
+	if err != nil {
+		t.Fatalf("error issuing Scrape: %v", err)
+	}
+	if s, p := math.Round(got.Seeds.Estimate()), math.Round(got.Peers.Estimate()); s != 0 || p != 1 {
+		t.Errorf("expected 0 seeds and 1 peer, got %v and %v", s, p)
+	}
+	if got.Nodes < dht.K {
+		t.Errorf("expected at least %d nodes to return filters, got %d", dht.K, got.Nodes)
+	}
+
+	if _, err := q.Scrape("123"); err == nil {
+		t.Errorf("expected Scrape with an invalid info_hash to error")
+	}
+}
+
+func TestLookupAlpha(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	q.SetAlpha(6)
+	q.SetTimeout(500 * time.Millisecond)
+	q.SetRetries(0)
+	// Unresponsive nodes are queried concurrently, so their timeouts overlap:
+	// those among the K closest at once, then those taking their place.
+	// Querying them one at a time would take 3s.
+	for _, n := range nodes[6:] {
+		n.Close()
+	}
+	start := time.Now()
+	got, err := q.GetPeers("4142434445464748494A4B4C4D4E4F5051525354")
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected lookup with alpha 6 to take under 2s, took %v", elapsed)
+	}
+	live := map[int]bool{}
+	for _, n := range nodes[:6] {
+		live[n.LocalAddr().(*net.UDPAddr).Port] = true
+	}
+	for _, n := range got.Nodes {
+		if !live[n.Node.Peer.UDPAddr.Port] {
+			t.Errorf("expected only responsive nodes in result, got %v", n.Node.Peer)
+		}
+	}
+	if len(got.Nodes) == 0 {
+		t.Errorf("expected responsive nodes to respond")
+	}
+}
+
+func TestLookupDeadClosest(t *testing.T) {
+	nodes := newTestNetwork(t, 10)
+	target := "4142434445464748494A4B4C4D4E4F5051525354"
+	tgt, _ := dht.EncodeInfoHash(target)
+	sort.Slice(nodes, func(i, j int) bool {
+		a, _ := distance([]byte(tgt), []byte(nodes[i].ID))
+		b, _ := distance([]byte(tgt), []byte(nodes[j].ID))
+		return a.Cmp(b) < 0
+	})
+	const k = 3
+	// Bootstrap from the furthest node.
+	q, err := New(localAddr(nodes[len(nodes)-1], "127.0.0.1"), k)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	q.SetTimeout(100 * time.Millisecond)
+	q.SetRetries(0)
+	// The closest nodes are dead, so the lookup must move on to the next.
+	// Those in the routing table, such as ones loaded from a state file, are
+	// evicted.
+	for _, n := range nodes[:k] {
+		q.Table().Insert(dht.Node{ID: []byte(n.ID), Peer: &dht.Peer{UDPAddr: localAddr(n, "127.0.0.1")}})
+		n.Close()
+	}
+	got, err := q.GetPeers(target)
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	for _, n := range nodes[:k] {
+		if _, ok := q.Table().LastSeen([]byte(n.ID)); ok {
+			t.Errorf("expected dead node 0x%x to be evicted from the routing table", n.ID)
+		}
+	}
+	var ports []int
+	for _, n := range got.Nodes {
+		ports = append(ports, n.Node.Peer.UDPAddr.Port)
+	}
+	for _, n := range nodes[k : 2*k] {
+		want := n.LocalAddr().(*net.UDPAddr).Port
+		found := false
+		for _, p := range ports {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("expected closest live node on port %d to respond, got %v", want, ports)
+		}
+	}
+}
+
+func TestLookupContext(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	// Unresponsive nodes would hold up the lookup far longer than ctx.
+	q.SetTimeout(time.Minute)
+	for _, n := range nodes[6:] {
+		n.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	got, err := q.GetPeersContext(ctx, "4142434445464748494A4B4C4D4E4F5051525354")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected lookup to stop once ctx is done, took %v", elapsed)
+	}
+	if got == nil || len(got.Nodes) == 0 {
+		t.Fatalf("expected the nodes found so far, got %v", got)
+	}
+	if _, err := q.FindNodeContext(ctx, "4142434445464748494A4B4C4D4E4F5051525354"); err != context.DeadlineExceeded {
+		t.Errorf("expected %v from FindNodeContext with a done ctx, got %v", context.DeadlineExceeded, err)
+	}
+	if got, err := q.AnnouncePeerContext(ctx, "invalid", 6881); got != nil || err == nil {
+		t.Errorf("expected only an error from AnnouncePeerContext with an invalid hash and a done ctx, got %v, %v", got, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	nodes := newTestNetwork(t, 8)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	q.SetTimeout(50 * time.Millisecond)
+	for _, n := range nodes[4:] {
+		n.Close()
+	}
+	peers, err := q.GetPeers("4142434445464748494A4B4C4D4E4F5051525354")
+	if err != nil {
+		t.Fatalf("error issuing GetPeers: %v", err)
+	}
+	s := q.Stats()
+	if s.Responded == 0 || s.TimedOut == 0 || s.Errors != 0 || s.Queried != s.Responded+s.TimedOut {
+		t.Errorf("expected both responses and timeouts, got %+v", s)
+	}
+	_, rejected, err := q.store(context.Background(), peers.Nodes, func(ctx context.Context, server net.UDPAddr, token string) (*dht.Message, error) {
+		return nil, &dht.KRPCError{Code: dht.ErrorProtocol, Message: "bad token"}
+	})
+	if err != nil {
+		t.Fatalf("error storing: %v", err)
+	}
+	if got := q.Stats(); got.Errors != len(rejected) || got.TimedOut != s.TimedOut || got.Queried != s.Queried+len(rejected) {
+		t.Errorf("expected %d errors counted apart from %d timeouts, got %+v", len(rejected), s.TimedOut, got)
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	peer := func(port int) dht.Peer {
+		return dht.Peer{UDPAddr: net.UDPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: port}}
+	}
+	v1 := &PeersResult{InfoHash: "aaaaaaaaaaaaaaaaaaaa", Peers: []dht.Peer{peer(1), peer(2)}}
+	v2 := &PeersResult{InfoHash: "bbbbbbbbbbbbbbbbbbbb", Peers: []dht.Peer{peer(2), peer(3)}}
+	r := MergePeers(v1, v2)
+	// Peers from a magnet link aren't attributed to either info hash.
+	if n := r.AddPeers([]dht.Peer{peer(3), peer(4)}); n != 1 {
+		t.Errorf("expected 1 new magnet link peer, got %d", n)
+	}
+	got := r.Peers()
+	want := []MergedPeer{
+		{Peer: peer(1), InfoHashes: []string{v1.InfoHash}},
+		{Peer: peer(2), InfoHashes: []string{v1.InfoHash, v2.InfoHash}},
+		{Peer: peer(3), InfoHashes: []string{v2.InfoHash}, Magnet: true},
+		{Peer: peer(4), InfoHashes: []string{}, Magnet: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	b, err := json.Marshal(&got[3])
+	if err != nil {
+		t.Fatalf("json.Marshal() returned error %v", err)
+	}
+	if want := `{"address":"10.0.0.1:4","info_hashes":[],"magnet":true}`; string(b) != want {
+		t.Errorf("expected %s, got %s", want, b)
+	}
+}
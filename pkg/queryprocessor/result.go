@@ -0,0 +1,424 @@
+package queryprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"math"
+	"math/big"
+)
+
+// PeersResult is the outcome of an iterative get_peers lookup.
+type PeersResult struct {
+	// 20 byte info_hash that was looked up.
+	InfoHash string
+	// Peers returned by any node, deduplicated by address.
+	Peers []dht.Peer
+	// Nodes that responded, closest to InfoHash first.
+	Nodes []TokenNode
+	// Outcomes of probing Peers, keyed by address, nil unless they were
+	// probed.
+	Probes map[string]Probe
+}
+
+// Probe is the outcome of probing a peer over the peer wire protocol.
+type Probe struct {
+	// What the peer told us, nil if probing it failed.
+	Info *dht.PeerInfo
+	// Why probing the peer failed, nil if it succeeded.
+	Err error
+}
+
+// MarshalJSON marshals a Probe into JSON.
+func (p *Probe) MarshalJSON() ([]byte, error) {
+	if p.Err != nil {
+		return json.Marshal(struct {
+			Error string `json:"error"`
+		}{p.Err.Error()})
+	}
+	return json.Marshal(p.Info)
+}
+
+// ProbedPeer is a peer along with the outcome of probing it, if it was.
+type ProbedPeer struct {
+	Peer  dht.Peer
+	Probe *Probe
+}
+
+// MarshalJSON marshals a ProbedPeer into JSON.
+func (p *ProbedPeer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		struct {
+			Peer  *dht.Peer `json:"address"`
+			Probe *Probe    `json:"probe,omitempty"`
+		}{
+			&p.Peer,
+			p.Probe,
+		})
+}
+
+// probe returns the outcome of probing the peer at address a in probes, nil
+// if it wasn't probed.
+func probe(probes map[string]Probe, a string) *Probe {
+	if p, ok := probes[a]; ok {
+		return &p
+	}
+	return nil
+}
+
+// TokenNode is a node that responded to a get_peers query along with the token
+// it returned.
+type TokenNode struct {
+	Node  dht.Node
+	Token string
+
+	distance *big.Int
+}
+
+// MarshalJSON marshals a TokenNode into JSON.
+func (n *TokenNode) MarshalJSON() ([]byte, error) {
+	var token string
+	if n.Token != "" {
+		token = fmt.Sprintf("0x%x", n.Token)
+	}
+	return json.Marshal(
+		struct {
+			ID     string    `json:"id"`
+			Peer   *dht.Peer `json:"address"`
+			Token  string    `json:"token,omitempty"`
+			Secure bool      `json:"secure"`
+		}{
+			fmt.Sprintf("0x%x", n.Node.ID),
+			n.Node.Peer,
+			token,
+			n.Node.Secure(),
+		})
+}
+
+// AddPeers adds peers found elsewhere, such as in a magnet link, to r,
+// skipping those already in it, and returns how many were added.
+func (r *PeersResult) AddPeers(peers []dht.Peer) int {
+	seen := make(map[string]bool)
+	for _, p := range r.Peers {
+		seen[p.UDPAddr.String()] = true
+	}
+	added := 0
+	for _, p := range peers {
+		if a := p.UDPAddr.String(); !seen[a] {
+			seen[a] = true
+			r.Peers = append(r.Peers, p)
+			added++
+		}
+	}
+	return added
+}
+
+// MarshalJSON marshals a PeersResult into JSON.
+//
+// Peers are marshalled as their addresses, or if they were probed as objects
+// of their address and what probing them found.
+func (r *PeersResult) MarshalJSON() ([]byte, error) {
+	var peers interface{} = r.Peers
+	if r.Probes != nil {
+		probed := []ProbedPeer{}
+		for _, p := range r.Peers {
+			probed = append(probed, ProbedPeer{p, probe(r.Probes, p.UDPAddr.String())})
+		}
+		peers = probed
+	} else if r.Peers == nil {
+		peers = []dht.Peer{}
+	}
+	return json.Marshal(
+		struct {
+			InfoHash string      `json:"info_hash"`
+			Peers    interface{} `json:"values"`
+			Nodes    []TokenNode `json:"nodes"`
+		}{
+			fmt.Sprintf("0x%x", r.InfoHash),
+			peers,
+			r.Nodes,
+		})
+}
+
+// MergedPeersResult is the outcome of get_peers lookups of every info hash of
+// a torrent, such as the v1 and truncated v2 info hashes of a hybrid torrent,
+// as defined in BEP 52.
+type MergedPeersResult struct {
+	// Results of each lookup.
+	Results []*PeersResult
+	// Peers found elsewhere, such as in a magnet link.
+	Magnet []dht.Peer
+	// Outcomes of probing the peers, keyed by address, nil unless they were
+	// probed.
+	Probes map[string]Probe
+}
+
+// MergePeers merges the results of get_peers lookups of info hashes of the
+// same torrent.
+func MergePeers(results ...*PeersResult) *MergedPeersResult {
+	return &MergedPeersResult{Results: results}
+}
+
+// AddPeers adds peers found elsewhere, such as in a magnet link, to r, and
+// returns how many weren't returned by any of its lookups.
+func (r *MergedPeersResult) AddPeers(peers []dht.Peer) int {
+	seen := make(map[string]bool)
+	for _, p := range r.Peers() {
+		seen[p.Peer.UDPAddr.String()] = true
+	}
+	added := 0
+	for _, p := range peers {
+		if a := p.UDPAddr.String(); !seen[a] {
+			seen[a] = true
+			added++
+		}
+	}
+	r.Magnet = append(r.Magnet, peers...)
+	return added
+}
+
+// MergedPeer is a peer returned by a MergedPeersResult's lookups along with
+// the info hashes it was returned for, whether it was found elsewhere, and the
+// outcome of probing it, if it was.
+type MergedPeer struct {
+	Peer       dht.Peer
+	InfoHashes []string
+	Magnet     bool
+	Probe      *Probe
+}
+
+// MarshalJSON marshals a MergedPeer into JSON.
+func (p *MergedPeer) MarshalJSON() ([]byte, error) {
+	hashes := make([]string, len(p.InfoHashes))
+	for i, h := range p.InfoHashes {
+		hashes[i] = fmt.Sprintf("0x%x", h)
+	}
+	return json.Marshal(
+		struct {
+			Peer       *dht.Peer `json:"address"`
+			InfoHashes []string  `json:"info_hashes"`
+			Magnet     bool      `json:"magnet,omitempty"`
+			Probe      *Probe    `json:"probe,omitempty"`
+		}{
+			&p.Peer,
+			hashes,
+			p.Magnet,
+			p.Probe,
+		})
+}
+
+// Peers returns the peers returned by any of r's lookups, then those found
+// elsewhere, deduplicated by address, in the order they were first found.
+func (r *MergedPeersResult) Peers() []MergedPeer {
+	peers := []MergedPeer{}
+	index := make(map[string]int)
+	add := func(p dht.Peer) *MergedPeer {
+		a := p.UDPAddr.String()
+		i, ok := index[a]
+		if !ok {
+			i = len(peers)
+			index[a] = i
+			peers = append(peers, MergedPeer{Peer: p, InfoHashes: []string{}, Probe: probe(r.Probes, a)})
+		}
+		return &peers[i]
+	}
+	for _, res := range r.Results {
+		for _, p := range res.Peers {
+			mp := add(p)
+			mp.InfoHashes = append(mp.InfoHashes, res.InfoHash)
+		}
+	}
+	for _, p := range r.Magnet {
+		add(p).Magnet = true
+	}
+	return peers
+}
+
+// MarshalJSON marshals a MergedPeersResult into JSON.
+func (r *MergedPeersResult) MarshalJSON() ([]byte, error) {
+	hashes := []string{}
+	nodes := make(map[string][]TokenNode)
+	for _, res := range r.Results {
+		h := fmt.Sprintf("0x%x", res.InfoHash)
+		hashes = append(hashes, h)
+		nodes[h] = res.Nodes
+		if nodes[h] == nil {
+			nodes[h] = []TokenNode{}
+		}
+	}
+	return json.Marshal(
+		struct {
+			InfoHashes []string               `json:"info_hashes"`
+			Peers      []MergedPeer           `json:"values"`
+			Nodes      map[string][]TokenNode `json:"nodes"`
+		}{
+			hashes,
+			r.Peers(),
+			nodes,
+		})
+}
+
+// ScrapeResult is the outcome of an iterative scrape, as defined in BEP 33.
+type ScrapeResult struct {
+	// 20 byte info_hash that was scraped.
+	InfoHash string
+	// Merged bloom filters of seeds and of other peers returned by all nodes.
+	Seeds *dht.BloomFilter
+	Peers *dht.BloomFilter
+	// Number of nodes that returned bloom filters.
+	Nodes int
+}
+
+// MarshalJSON marshals a ScrapeResult into JSON.
+func (r *ScrapeResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		struct {
+			InfoHash string `json:"info_hash"`
+			Seeders  int64  `json:"seeders"`
+			Leechers int64  `json:"leechers"`
+			Nodes    int    `json:"nodes"`
+		}{
+			fmt.Sprintf("0x%x", r.InfoHash),
+			int64(math.Round(r.Seeds.Estimate())),
+			int64(math.Round(r.Peers.Estimate())),
+			r.Nodes,
+		})
+}
+
+// AnnounceResult is the outcome of an iterative announce_peer.
+type AnnounceResult struct {
+	// 20 byte info_hash that was announced.
+	InfoHash string
+	// Port announced, zero if implied.
+	Port int
+	// Nodes that accepted the announce.
+	Accepted []dht.Node
+	// Nodes that rejected the announce or didn't respond.
+	Rejected []RejectedNode
+}
+
+// RejectedNode is a node that didn't accept an announce_peer query and why.
+type RejectedNode struct {
+	Node dht.Node
+	Err  error
+}
+
+// MarshalJSON marshals a RejectedNode into JSON.
+func (n *RejectedNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		struct {
+			ID    string    `json:"id"`
+			Peer  *dht.Peer `json:"address"`
+			Error string    `json:"error"`
+		}{
+			fmt.Sprintf("0x%x", n.Node.ID),
+			n.Node.Peer,
+			n.Err.Error(),
+		})
+}
+
+// MarshalJSON marshals an AnnounceResult into JSON.
+func (r *AnnounceResult) MarshalJSON() ([]byte, error) {
+	accepted, rejected := r.Accepted, r.Rejected
+	if accepted == nil {
+		accepted = []dht.Node{}
+	}
+	if rejected == nil {
+		rejected = []RejectedNode{}
+	}
+	return json.Marshal(
+		struct {
+			InfoHash string         `json:"info_hash"`
+			Port     int            `json:"port"`
+			Accepted []dht.Node     `json:"accepted"`
+			Rejected []RejectedNode `json:"rejected"`
+		}{
+			fmt.Sprintf("0x%x", r.InfoHash),
+			r.Port,
+			accepted,
+			rejected,
+		})
+}
+
+// ItemResult is the outcome of an iterative BEP 44 get.
+type ItemResult struct {
+	// 20 byte target that was looked up.
+	Target string
+	// Item stored under Target, nil if none was found.
+	Item *dht.Item
+	// Nodes that responded, closest to Target first.
+	Nodes []TokenNode
+}
+
+// MarshalJSON marshals an ItemResult into JSON.
+func (r *ItemResult) MarshalJSON() ([]byte, error) {
+	var v interface{}
+	if r.Item != nil {
+		v = r.Item
+	}
+	return json.Marshal(
+		struct {
+			Target string      `json:"target"`
+			Item   interface{} `json:"item"`
+			Nodes  []TokenNode `json:"nodes"`
+		}{
+			fmt.Sprintf("0x%x", r.Target),
+			v,
+			r.Nodes,
+		})
+}
+
+// PutResult is the outcome of an iterative BEP 44 put.
+type PutResult struct {
+	// 20 byte target the item was stored under.
+	Target string
+	// Item stored.
+	Item *dht.Item
+	// Nodes that stored the item.
+	Accepted []dht.Node
+	// Nodes that rejected the item or didn't respond.
+	Rejected []RejectedNode
+}
+
+// MarshalJSON marshals a PutResult into JSON.
+func (r *PutResult) MarshalJSON() ([]byte, error) {
+	accepted, rejected := r.Accepted, r.Rejected
+	if accepted == nil {
+		accepted = []dht.Node{}
+	}
+	if rejected == nil {
+		rejected = []RejectedNode{}
+	}
+	return json.Marshal(
+		struct {
+			Target   string         `json:"target"`
+			Item     *dht.Item      `json:"item"`
+			Accepted []dht.Node     `json:"accepted"`
+			Rejected []RejectedNode `json:"rejected"`
+		}{
+			fmt.Sprintf("0x%x", r.Target),
+			r.Item,
+			accepted,
+			rejected,
+		})
+}
+
+// SampleResult is an info hash discovered by a sample_infohashes walk.
+type SampleResult struct {
+	// 20 byte info hash.
+	InfoHash string
+	// Node that returned the info hash.
+	Node dht.Node
+}
+
+// MarshalJSON marshals a SampleResult into JSON.
+func (r *SampleResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		struct {
+			InfoHash string    `json:"info_hash"`
+			Node     *dht.Node `json:"node"`
+		}{
+			fmt.Sprintf("0x%x", r.InfoHash),
+			&r.Node,
+		})
+}
@@ -1,61 +1,275 @@
 package queryprocessor
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/jeanralphaviles/dhtcli/pkg/dht"
-	"math/big"
 	"sort"
+	"sync"
+	"time"
 )
 
-// routingTable maintains a list of known good nodes used as starting points
-// for queries into the DHT.
-type routingTable struct {
-	// Maximum number of nodes to maintain
-	size    int
-	entries []entry
+// idBits is the length of a node id in bits, and so the maximum number of
+// buckets in a RoutingTable.
+const idBits = 160
+
+// questionableAfter is how long a node may go unheard from before it is
+// considered questionable and may be replaced, as described in BEP 5.
+const questionableAfter = 15 * time.Minute
+
+// RoutingTable is a Kademlia routing table of good nodes keyed on our own node
+// id, as described in BEP 5.
+//
+// The id space is covered by up to 160 k-buckets. Bucket i holds nodes whose
+// ids share exactly i leading bits with ours, except for the last bucket,
+// which also holds every node closer to us. Only the last bucket, the one
+// containing our own id, is split when it fills up.
+//
+// A RoutingTable is safe for concurrent use.
+type RoutingTable struct {
+	mu      sync.Mutex
+	id      []byte
+	k       int
+	buckets [][]contact
+	now     func() time.Time
+	// If set, reports whether a questionable node still responds before it
+	// is replaced.
+	ping func(n dht.Node) bool
+	// Ids of the questionable nodes being pinged.
+	pinging map[string]bool
+	pings   sync.WaitGroup
 }
 
-type entry struct {
+// contact is a node in a RoutingTable along with when it was last heard from.
+type contact struct {
 	node     dht.Node
-	distance big.Int
+	lastSeen time.Time
 }
 
-func newRoutingTable(size int) (*routingTable, error) {
-	if size <= 0 {
-		return nil, fmt.Errorf("routing table size must be >= 1, got %d", size)
+// NewRoutingTable returns an empty RoutingTable for the 20 byte node id,
+// holding at most k nodes per bucket.
+func NewRoutingTable(id string, k int) (*RoutingTable, error) {
+	if len(id) != 20 {
+		return nil, fmt.Errorf("routing table id must be 20 bytes, got %d", len(id))
+	}
+	if k <= 0 {
+		return nil, fmt.Errorf("bucket size must be >= 1, got %d", k)
 	}
-	return &routingTable{
-		size: size,
+	return &RoutingTable{
+		id:      []byte(id),
+		k:       k,
+		buckets: make([][]contact, 1),
+		now:     time.Now,
+		pinging: make(map[string]bool),
 	}, nil
 }
 
-func (r *routingTable) insert(n dht.Node, distance big.Int) {
-	entry := entry{n, distance}
-	r.entries = append(r.entries, entry)
-	sort.Sort(r)
-	// Trim to size.
-	if len(r.entries) > r.size {
-		r.entries = r.entries[:r.size]
+// SetPing sets how the table checks whether a questionable node still
+// responds before replacing it, as described in BEP 5. ping is called without
+// holding the table's lock, and should report false only if the node failed
+// to respond.
+func (r *RoutingTable) SetPing(ping func(n dht.Node) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ping = ping
+}
+
+// Pinger returns a function for SetPing that pings nodes through d, reporting
+// false only if a ping times out.
+func Pinger(d *dht.DHT) func(n dht.Node) bool {
+	return func(n dht.Node) bool {
+		_, err := d.Ping(n.Peer.UDPAddr)
+		var terr *dht.TimeoutError
+		return !errors.As(err, &terr)
 	}
 }
 
-func (r *routingTable) pop() (dht.Node, error) {
-	if len(r.entries) == 0 {
-		return dht.Node{}, fmt.Errorf("pop() called on empty routing table")
+// commonPrefixLen returns the number of leading bits shared by a and b.
+func commonPrefixLen(a, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
 	}
-	var ret dht.Node
-	ret, r.entries = r.entries[0].node, r.entries[1:]
-	return ret, nil
+	return len(a) * 8
 }
 
-func (r *routingTable) Len() int {
-	return len(r.entries)
+// bucketIndex returns the index of the bucket that covers id.
+func (r *RoutingTable) bucketIndex(id []byte) int {
+	i := commonPrefixLen(r.id, id)
+	if last := len(r.buckets) - 1; i > last {
+		return last
+	}
+	return i
+}
+
+// split divides the last bucket in two, moving the nodes that share more
+// leading bits with our id into a new last bucket.
+func (r *RoutingTable) split() {
+	last := len(r.buckets) - 1
+	var stay, move []contact
+	for _, c := range r.buckets[last] {
+		if commonPrefixLen(r.id, c.node.ID) > last {
+			move = append(move, c)
+		} else {
+			stay = append(stay, c)
+		}
+	}
+	r.buckets[last] = stay
+	r.buckets = append(r.buckets, move)
 }
 
-func (r *routingTable) Less(i, j int) bool {
-	return r.entries[i].distance.Cmp(&r.entries[j].distance) < 0
+// Insert records that n has been heard from.
+//
+// Known nodes are moved to the tail of their bucket. New nodes are added if
+// their bucket has room, splitting the bucket containing our id if needed.
+// Otherwise, they replace the least recently seen node in the bucket if that
+// node has become questionable and, if SetPing was called, fails to respond
+// to a ping, which is sent in the background. They are dropped if not. Nodes
+// without a 20 byte id or contact information are ignored.
+func (r *RoutingTable) Insert(n dht.Node) {
+	r.insert(n, time.Time{})
+}
+
+// insert is like Insert, but records n as last heard from at seen if set.
+func (r *RoutingTable) insert(n dht.Node, seen time.Time) {
+	if len(n.ID) != 20 || n.Peer == nil || bytes.Equal(n.ID, r.id) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if seen.IsZero() {
+		seen = now
+	}
+	for {
+		i := r.bucketIndex(n.ID)
+		b := r.buckets[i]
+		for j, c := range b {
+			if bytes.Equal(c.node.ID, n.ID) {
+				b = append(b[:j], b[j+1:]...)
+				r.buckets[i] = append(b, contact{n, seen})
+				return
+			}
+		}
+		if len(b) < r.k {
+			r.buckets[i] = append(b, contact{n, seen})
+			return
+		}
+		if i == len(r.buckets)-1 && len(r.buckets) < idBits {
+			r.split()
+			continue
+		}
+		// Buckets are ordered least recently seen first.
+		old := b[0].node
+		if now.Sub(b[0].lastSeen) <= questionableAfter {
+			return
+		}
+		if r.ping == nil {
+			r.buckets[i] = append(b[1:], contact{n, seen})
+			return
+		}
+		if !r.pinging[string(old.ID)] {
+			r.pinging[string(old.ID)] = true
+			r.pings.Add(1)
+			go r.replace(old, n, seen)
+		}
+		return
+	}
+}
+
+// replace pings old, a questionable node, and replaces it with n if it fails
+// to respond, or marks it as heard from if it does.
+func (r *RoutingTable) replace(old, n dht.Node, seen time.Time) {
+	defer r.pings.Done()
+	ok := r.ping(old)
+	r.mu.Lock()
+	delete(r.pinging, string(old.ID))
+	r.mu.Unlock()
+	if ok {
+		r.Insert(old)
+		return
+	}
+	r.Remove(old.ID)
+	r.insert(n, seen)
 }
 
-func (r *routingTable) Swap(i, j int) {
-	r.entries[i], r.entries[j] = r.entries[j], r.entries[i]
+// Remove drops the node with the given id from the table.
+func (r *RoutingTable) Remove(id []byte) {
+	if len(id) != 20 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.bucketIndex(id)
+	for j, c := range r.buckets[i] {
+		if bytes.Equal(c.node.ID, id) {
+			r.buckets[i] = append(r.buckets[i][:j], r.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to k nodes in the table closest to the 20 byte target.
+func (r *RoutingTable) Closest(target string, k int) []dht.Node {
+	nodes := r.Nodes()
+	t := []byte(target)
+	if len(t) != 20 {
+		return nil
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, _ := distance(t, nodes[i].ID)
+		b, _ := distance(t, nodes[j].ID)
+		return a.Cmp(b) < 0
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// Nodes returns every node in the table.
+func (r *RoutingTable) Nodes() []dht.Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var nodes []dht.Node
+	for _, b := range r.buckets {
+		for _, c := range b {
+			nodes = append(nodes, c.node)
+		}
+	}
+	return nodes
+}
+
+// LastSeen returns when the node with the given id was last heard from, and
+// whether it is in the table.
+func (r *RoutingTable) LastSeen(id []byte) (time.Time, bool) {
+	if len(id) != 20 {
+		return time.Time{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.buckets[r.bucketIndex(id)] {
+		if bytes.Equal(c.node.ID, id) {
+			return c.lastSeen, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Len returns the number of nodes in the table.
+func (r *RoutingTable) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, b := range r.buckets {
+		n += len(b)
+	}
+	return n
 }
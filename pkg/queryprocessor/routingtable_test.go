@@ -1,57 +1,180 @@
 package queryprocessor
 
 import (
+	"bytes"
 	"github.com/jeanralphaviles/dhtcli/pkg/dht"
-	"math/big"
-	"sort"
+	"net"
 	"testing"
+	"time"
 )
 
+// idWithPrefix returns a 20 byte id that shares exactly n leading bits with
+// id, with its last byte set to b.
+func idWithPrefix(id []byte, n int, b byte) []byte {
+	ret := make([]byte, 20)
+	copy(ret, id)
+	ret[n/8] ^= 0x80 >> uint(n%8)
+	for i := n/8 + 1; i < 20; i++ {
+		ret[i] = 0
+	}
+	ret[19] = b
+	return ret
+}
+
+func testNode(id []byte) dht.Node {
+	return dht.Node{ID: id, Peer: &dht.Peer{UDPAddr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}}
+}
+
 func TestNewRoutingTable(t *testing.T) {
 	cases := []struct {
-		size int
+		id   string
+		k    int
 		fail bool
 	}{
-		{1, false},
-		{0, true},
+		{"ABCDEFGHIJKLMNOPQRST", 8, false},
+		{"ABCDEFGHIJKLMNOPQRST", 0, true},
+		{"ABC", 8, true},
 	}
 	for n, c := range cases {
-		if _, err := newRoutingTable(c.size); (err != nil) != c.fail {
-			t.Errorf("case %d: expected newRoutingTable(%d) to return error: %v, got %v", n, c.size, c.fail, err)
+		if _, err := NewRoutingTable(c.id, c.k); (err != nil) != c.fail {
+			t.Errorf("case %d: expected NewRoutingTable(%q, %d) to return error: %v, got %v", n, c.id, c.k, c.fail, err)
 		}
 	}
 }
 
-func TestInsert(t *testing.T) {
-	nodes := make([]dht.Node, 3)
-	rt, _ := newRoutingTable(2)
-	for i, n := range nodes {
-		// Decreasing priority to assure sort must run.
-		rt.insert(n, *big.NewInt(int64(3 - i)))
+func TestCommonPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b []byte
+		want int
+	}{
+		{[]byte{0xFF, 0xFF}, []byte{0xFF, 0xFF}, 16},
+		{[]byte{0xFF, 0xFF}, []byte{0x7F, 0xFF}, 0},
+		{[]byte{0xFF, 0xFF}, []byte{0xFF, 0xFE}, 15},
+		{[]byte{0x00, 0x00}, []byte{0x00, 0x20}, 10},
 	}
-	if rt.Len() != 2 {
-		t.Errorf("routing table should contain 2 entries, has %d", rt.Len())
+	for n, c := range cases {
+		if got := commonPrefixLen(c.a, c.b); got != c.want {
+			t.Errorf("case %d: commonPrefixLen(0x%x, 0x%x) = %d, want %d", n, c.a, c.b, got, c.want)
+		}
 	}
-	if !sort.IsSorted(rt) {
-		t.Errorf("routing table should be sorted")
+}
+
+func TestRoutingTableInsert(t *testing.T) {
+	id := []byte("ABCDEFGHIJKLMNOPQRST")
+	rt, _ := NewRoutingTable(string(id), 2)
+
+	// Invalid nodes and our own id are ignored.
+	rt.Insert(dht.Node{ID: []byte("short"), Peer: &dht.Peer{}})
+	rt.Insert(dht.Node{ID: idWithPrefix(id, 0, 1)})
+	rt.Insert(testNode(id))
+	if rt.Len() != 0 {
+		t.Fatalf("expected invalid nodes to be ignored, table has %d", rt.Len())
+	}
+
+	// Far nodes fill the first bucket; a third is dropped once it no longer
+	// contains our id.
+	for i := byte(0); i < 3; i++ {
+		rt.Insert(testNode(idWithPrefix(id, 0, i)))
+	}
+	// Nodes close to us split the bucket containing our id.
+	for i := byte(0); i < 2; i++ {
+		rt.Insert(testNode(idWithPrefix(id, 10, i)))
+		rt.Insert(testNode(idWithPrefix(id, 100, i)))
+	}
+	if rt.Len() != 6 {
+		t.Errorf("expected 6 nodes in table, got %d", rt.Len())
+	}
+	if len(rt.buckets) != 12 {
+		t.Errorf("expected 12 buckets, got %d", len(rt.buckets))
+	}
+	if _, ok := rt.LastSeen(idWithPrefix(id, 0, 2)); ok {
+		t.Errorf("expected node inserted into a full bucket to be dropped")
+	}
+
+	// Reinserting a node moves it to the tail of its bucket.
+	rt.Insert(testNode(idWithPrefix(id, 0, 0)))
+	if b := rt.buckets[0]; !bytes.Equal(b[len(b)-1].node.ID, idWithPrefix(id, 0, 0)) {
+		t.Errorf("expected reinserted node at the tail of its bucket")
 	}
 }
 
-func TestPop(t *testing.T) {
-	cases := []struct {
-		nodes []dht.Node
-		fail  bool
-	}{
-		{[]dht.Node{dht.Node{}}, false},
-		{[]dht.Node{}, true},
+func TestRoutingTableReplacesQuestionable(t *testing.T) {
+	id := []byte("ABCDEFGHIJKLMNOPQRST")
+	rt, _ := NewRoutingTable(string(id), 1)
+	now := time.Now()
+	rt.now = func() time.Time { return now }
+	rt.Insert(testNode(idWithPrefix(id, 0, 0)))
+	rt.Insert(testNode(idWithPrefix(id, 5, 0)))
+	rt.Insert(testNode(idWithPrefix(id, 0, 1)))
+	if _, ok := rt.LastSeen(idWithPrefix(id, 0, 1)); ok {
+		t.Errorf("expected good node not to be replaced")
 	}
-	for n, c := range cases {
-		rt, _ := newRoutingTable(1)
-		for i, n := range c.nodes {
-			rt.insert(n, *big.NewInt(int64(i)))
+	now = now.Add(questionableAfter + time.Second)
+	rt.Insert(testNode(idWithPrefix(id, 0, 1)))
+	if _, ok := rt.LastSeen(idWithPrefix(id, 0, 1)); !ok {
+		t.Errorf("expected questionable node to be replaced")
+	}
+	if _, ok := rt.LastSeen(idWithPrefix(id, 0, 0)); ok {
+		t.Errorf("expected questionable node to be removed")
+	}
+}
+
+func TestRoutingTablePingsQuestionable(t *testing.T) {
+	id := []byte("ABCDEFGHIJKLMNOPQRST")
+	for _, responds := range []bool{true, false} {
+		rt, _ := NewRoutingTable(string(id), 1)
+		now := time.Now()
+		rt.now = func() time.Time { return now }
+		var pinged []dht.Node
+		rt.SetPing(func(n dht.Node) bool {
+			pinged = append(pinged, n)
+			return responds
+		})
+		old, n := testNode(idWithPrefix(id, 0, 0)), testNode(idWithPrefix(id, 0, 1))
+		rt.Insert(old)
+		rt.Insert(testNode(idWithPrefix(id, 5, 0)))
+		now = now.Add(questionableAfter + time.Second)
+		rt.Insert(n)
+		rt.pings.Wait()
+		if len(pinged) != 1 || !bytes.Equal(pinged[0].ID, old.ID) {
+			t.Errorf("expected questionable node to be pinged, pinged %v", pinged)
+		}
+		_, kept := rt.LastSeen(old.ID)
+		_, added := rt.LastSeen(n.ID)
+		if kept != responds || added == responds {
+			t.Errorf("with ping responding %v, expected questionable node kept %v, got kept %v and replaced %v", responds, responds, kept, added)
 		}
-		if _, err := rt.pop(); (err != nil) != c.fail {
-			t.Errorf("case %d: expected rt.Pop to return error %v, got %v", n, c.fail, err)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	id := []byte("ABCDEFGHIJKLMNOPQRST")
+	rt, _ := NewRoutingTable(string(id), 8)
+	for _, n := range []int{0, 50, 3, 120, 8} {
+		rt.Insert(testNode(idWithPrefix(id, n, 0)))
+	}
+	got := rt.Closest(string(id), 3)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 nodes, got %d", len(got))
+	}
+	for i, n := range []int{120, 50, 8} {
+		if want := idWithPrefix(id, n, 0); !bytes.Equal(got[i].ID, want) {
+			t.Errorf("Closest()[%d] = %x, want %x", i, got[i].ID, want)
 		}
 	}
+	if got := rt.Closest("short", 3); got != nil {
+		t.Errorf("expected no nodes for an invalid target, got %v", got)
+	}
+}
+
+func TestRoutingTableRemove(t *testing.T) {
+	id := []byte("ABCDEFGHIJKLMNOPQRST")
+	rt, _ := NewRoutingTable(string(id), 8)
+	n := testNode(idWithPrefix(id, 4, 0))
+	rt.Insert(n)
+	rt.Remove(n.ID)
+	rt.Remove([]byte("short"))
+	if rt.Len() != 0 {
+		t.Errorf("expected empty table, got %d nodes", rt.Len())
+	}
 }
@@ -0,0 +1,93 @@
+package queryprocessor
+
+import (
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"math/big"
+	"sort"
+)
+
+// shortlist maintains the nodes heard of during a lookup, sorted by distance
+// to the target, along with whether each has been queried.
+//
+// Only the size closest nodes are queried. Nodes that fail to respond are
+// removed, letting the next closest take their place, so that the shortlist
+// converges on the closest nodes that do.
+type shortlist struct {
+	// Number of closest nodes to query
+	size    int
+	entries []entry
+	// If set, nodes for which demote returns true are sorted after all
+	// others, and so are queried last.
+	demote func(n dht.Node) bool
+}
+
+type entry struct {
+	node     dht.Node
+	distance big.Int
+	demoted  bool
+	queried  bool
+}
+
+func newShortlist(size int) (*shortlist, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("shortlist size must be >= 1, got %d", size)
+	}
+	return &shortlist{
+		size: size,
+	}, nil
+}
+
+func (s *shortlist) insert(n dht.Node, distance big.Int) {
+	entry := entry{n, distance, s.demote != nil && s.demote(n), false}
+	s.entries = append(s.entries, entry)
+	sort.Sort(s)
+}
+
+// pop returns the closest node that hasn't been queried yet, among the size
+// closest nodes, and marks it as queried.
+func (s *shortlist) pop() (dht.Node, error) {
+	for i := range s.entries {
+		if i == s.size {
+			break
+		}
+		if !s.entries[i].queried {
+			s.entries[i].queried = true
+			return s.entries[i].node, nil
+		}
+	}
+	return dht.Node{}, fmt.Errorf("pop() called on shortlist without unqueried nodes")
+}
+
+// remove drops n, a node that failed to respond, from the shortlist.
+func (s *shortlist) remove(n dht.Node) {
+	for i := range s.entries {
+		if sameNode(s.entries[i].node, n) {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// sameNode reports whether a and b have the same id and address.
+func sameNode(a, b dht.Node) bool {
+	if string(a.ID) != string(b.ID) || (a.Peer == nil) != (b.Peer == nil) {
+		return false
+	}
+	return a.Peer == nil || a.Peer.UDPAddr.String() == b.Peer.UDPAddr.String()
+}
+
+func (s *shortlist) Len() int {
+	return len(s.entries)
+}
+
+func (s *shortlist) Less(i, j int) bool {
+	if a, b := s.entries[i].demoted, s.entries[j].demoted; a != b {
+		return b
+	}
+	return s.entries[i].distance.Cmp(&s.entries[j].distance) < 0
+}
+
+func (s *shortlist) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
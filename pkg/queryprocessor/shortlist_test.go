@@ -0,0 +1,116 @@
+package queryprocessor
+
+import (
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+func TestNewShortlist(t *testing.T) {
+	cases := []struct {
+		size int
+		fail bool
+	}{
+		{1, false},
+		{0, true},
+	}
+	for n, c := range cases {
+		if _, err := newShortlist(c.size); (err != nil) != c.fail {
+			t.Errorf("case %d: expected newShortlist(%d) to return error: %v, got %v", n, c.size, c.fail, err)
+		}
+	}
+}
+
+func TestShortlistInsert(t *testing.T) {
+	nodes := make([]dht.Node, 3)
+	s, _ := newShortlist(2)
+	for i, n := range nodes {
+		// Decreasing priority to assure sort must run.
+		s.insert(n, *big.NewInt(int64(3 - i)))
+	}
+	// Every node is kept, but only the 2 closest are queried.
+	if s.Len() != 3 {
+		t.Errorf("shortlist should contain 3 entries, has %d", s.Len())
+	}
+	if !sort.IsSorted(s) {
+		t.Errorf("shortlist should be sorted")
+	}
+	s.pop()
+	s.pop()
+	if _, err := s.pop(); err == nil {
+		t.Errorf("expected pop() to error once the 2 closest nodes are queried")
+	}
+}
+
+func TestShortlistDemote(t *testing.T) {
+	s, _ := newShortlist(2)
+	s.demote = func(n dht.Node) bool { return n.ID[0] == 'd' }
+	s.insert(dht.Node{ID: []byte("d1")}, *big.NewInt(1))
+	s.insert(dht.Node{ID: []byte("a3")}, *big.NewInt(3))
+	s.insert(dht.Node{ID: []byte("a4")}, *big.NewInt(4))
+	// The demoted node is queried last despite being closest.
+	for _, want := range []string{"a3", "a4"} {
+		n, err := s.pop()
+		if err != nil || string(n.ID) != want {
+			t.Errorf("expected pop() to return %v, got %v (%v)", want, string(n.ID), err)
+		}
+	}
+}
+
+func TestShortlistPop(t *testing.T) {
+	cases := []struct {
+		nodes []dht.Node
+		fail  bool
+	}{
+		{[]dht.Node{dht.Node{}}, false},
+		{[]dht.Node{}, true},
+	}
+	for n, c := range cases {
+		s, _ := newShortlist(1)
+		for i, n := range c.nodes {
+			s.insert(n, *big.NewInt(int64(i)))
+		}
+		if _, err := s.pop(); (err != nil) != c.fail {
+			t.Errorf("case %d: expected s.pop to return error %v, got %v", n, c.fail, err)
+		}
+	}
+}
+
+func TestShortlistRemove(t *testing.T) {
+	s, _ := newShortlist(3)
+	for i, id := range []string{"a1", "a2", "a3"} {
+		s.insert(dht.Node{ID: []byte(id)}, *big.NewInt(int64(i)))
+	}
+	// Popped nodes stay in the shortlist until removed.
+	n, _ := s.pop()
+	if string(n.ID) != "a1" || s.Len() != 3 {
+		t.Errorf("expected pop() to return a1 and keep 3 entries, got %v and %d", string(n.ID), s.Len())
+	}
+	s.remove(n)
+	s.remove(dht.Node{ID: []byte("a9")})
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries after remove, got %d", s.Len())
+	}
+	// A node inserted after others were queried is queried next if closer.
+	s.pop()
+	s.insert(dht.Node{ID: []byte("a0")}, *big.NewInt(0))
+	for _, want := range []string{"a0", "a3"} {
+		n, err := s.pop()
+		if err != nil || string(n.ID) != want {
+			t.Errorf("expected pop() to return %v, got %v (%v)", want, string(n.ID), err)
+		}
+	}
+	if _, err := s.pop(); err == nil {
+		t.Errorf("expected pop() to error once every node is queried")
+	}
+	// Removing a node lets the next closest be queried.
+	s.insert(dht.Node{ID: []byte("a4")}, *big.NewInt(4))
+	if _, err := s.pop(); err == nil {
+		t.Errorf("expected pop() to skip nodes beyond the 3 closest")
+	}
+	s.remove(dht.Node{ID: []byte("a0")})
+	if n, err := s.pop(); err != nil || string(n.ID) != "a4" {
+		t.Errorf("expected pop() to return a4, got %v (%v)", string(n.ID), err)
+	}
+}
@@ -0,0 +1,191 @@
+package queryprocessor
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// State is a snapshot of a QueryProcessor's node id and routing tables, to
+// seed the lookups of a later QueryProcessor with.
+type State struct {
+	ID    string
+	Nodes []StateNode
+}
+
+// StateNode is a routing table node in a State, along with how responsive it
+// has been.
+type StateNode struct {
+	Node     dht.Node
+	LastSeen time.Time
+	RTT      dht.RTT
+}
+
+// stateNode is the JSON encoding of a StateNode.
+type stateNode struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"last_seen"`
+	SRTT     string    `json:"srtt,omitempty"`
+	RTTVar   string    `json:"rttvar,omitempty"`
+	Dead     bool      `json:"dead,omitempty"`
+}
+
+// State returns a snapshot of the QueryProcessor's node id and routing
+// tables.
+//
+// If the node id isn't derived from our external IP address as last reported
+// by a node, as defined in BEP 42, e.g. as it was restored from a state saved
+// elsewhere, one that is is saved instead for the next QueryProcessor to use.
+// Nodes that failed to respond to their last query and haven't been heard
+// from in a while are left out.
+func (q *QueryProcessor) State() *State {
+	s := &State{ID: q.dht.ID}
+	q.mu.Lock()
+	ip := q.external
+	q.mu.Unlock()
+	if ip != nil && !dht.SecureIDValid([]byte(s.ID), ip) {
+		if id, err := dht.SecureID(ip); err == nil {
+			s.ID = id
+		}
+	}
+	for _, t := range []*RoutingTable{q.table, q.table6} {
+		now := t.now()
+		for _, n := range t.Nodes() {
+			seen, ok := t.LastSeen(n.ID)
+			if !ok {
+				continue
+			}
+			rtt, _ := q.dht.NodeRTT(n.Peer.UDPAddr)
+			if rtt.Dead && now.Sub(seen) > questionableAfter {
+				continue
+			}
+			s.Nodes = append(s.Nodes, StateNode{Node: n, LastSeen: seen, RTT: rtt})
+		}
+	}
+	return s
+}
+
+// NewFromState returns a new DHT QueryProcessor with the node id and routing
+// tables saved in s. Unlike New, no bootstrap node is required, though one
+// may be added with AddBootstrap should the saved nodes be unreachable.
+func NewFromState(s *State, k int) (*QueryProcessor, error) {
+	d, err := dht.New()
+	if err != nil {
+		return nil, fmt.Errorf("error creating DHT object: %v", err)
+	}
+	return NewFromStateWithDHT(s, d, k)
+}
+
+// NewFromStateWithDHT is like NewFromState but issues queries through d, whose
+// node id is replaced by the saved one. The QueryProcessor takes ownership of
+// d as with NewWithDHT.
+func NewFromStateWithDHT(s *State, d *dht.DHT, k int) (*QueryProcessor, error) {
+	d.ID = s.ID
+	q, err := newQueryProcessor(d, k)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	nodes := make([]StateNode, len(s.Nodes))
+	copy(nodes, s.Nodes)
+	// Buckets are ordered least recently seen first.
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].LastSeen.Before(nodes[j].LastSeen)
+	})
+	for _, n := range nodes {
+		if n.Node.Peer == nil {
+			continue
+		}
+		q.tableFor(n.Node).insert(n.Node, n.LastSeen)
+		d.SetNodeRTT(n.Node.Peer.UDPAddr, n.RTT)
+	}
+	return q, nil
+}
+
+// MarshalJSON marshals a State into JSON.
+func (s *State) MarshalJSON() ([]byte, error) {
+	nodes := make([]stateNode, 0, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if n.Node.Peer == nil {
+			continue
+		}
+		e := stateNode{
+			ID:       fmt.Sprintf("0x%x", n.Node.ID),
+			Address:  n.Node.Peer.UDPAddr.String(),
+			LastSeen: n.LastSeen,
+			Dead:     n.RTT.Dead,
+		}
+		if n.RTT.SRTT != 0 {
+			e.SRTT = n.RTT.SRTT.String()
+			e.RTTVar = n.RTT.RTTVar.String()
+		}
+		nodes = append(nodes, e)
+	}
+	return json.Marshal(
+		struct {
+			ID    string      `json:"id"`
+			Nodes []stateNode `json:"nodes"`
+		}{
+			fmt.Sprintf("0x%x", s.ID),
+			nodes,
+		})
+}
+
+// ParseState returns the State encoded in b by State.MarshalJSON.
+func ParseState(b []byte) (*State, error) {
+	var v struct {
+		ID    string      `json:"id"`
+		Nodes []stateNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("error parsing state: %v", err)
+	}
+	id, err := parseID(v.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing state node id: %v", err)
+	}
+	s := &State{ID: string(id)}
+	for _, e := range v.Nodes {
+		id, err := parseID(e.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing id of node %v: %v", e.Address, err)
+		}
+		addr, err := net.ResolveUDPAddr("udp", e.Address)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing address of node 0x%x: %v", id, err)
+		}
+		n := StateNode{
+			Node:     dht.Node{ID: id, Peer: &dht.Peer{UDPAddr: *addr}},
+			LastSeen: e.LastSeen,
+			RTT:      dht.RTT{Dead: e.Dead},
+		}
+		if e.SRTT != "" {
+			if n.RTT.SRTT, err = time.ParseDuration(e.SRTT); err != nil {
+				return nil, fmt.Errorf("error parsing srtt of node 0x%x: %v", id, err)
+			}
+			if n.RTT.RTTVar, err = time.ParseDuration(e.RTTVar); err != nil {
+				return nil, fmt.Errorf("error parsing rttvar of node 0x%x: %v", id, err)
+			}
+		}
+		s.Nodes = append(s.Nodes, n)
+	}
+	return s, nil
+}
+
+// parseID decodes a 20 byte id written as 0x prefixed hex.
+func parseID(s string) ([]byte, error) {
+	id, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if len(id) != 20 {
+		return nil, fmt.Errorf("id must be 20 bytes, got %d", len(id))
+	}
+	return id, nil
+}
@@ -0,0 +1,180 @@
+package queryprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jeanralphaviles/dhtcli/pkg/dht"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []*State{
+		{ID: "abcdefghij0123456789"},
+		{ID: "abcdefghij0123456789", Nodes: []StateNode{
+			{
+				Node:     dht.Node{ID: []byte("0123456789abcdefghij"), Peer: &dht.Peer{UDPAddr: net.UDPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 6881}}},
+				LastSeen: seen,
+				RTT:      dht.RTT{SRTT: 150 * time.Millisecond, RTTVar: 20 * time.Millisecond},
+			},
+			{
+				Node:     dht.Node{ID: []byte("klmnopqrst0123456789"), Peer: &dht.Peer{UDPAddr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}}},
+				LastSeen: seen,
+				RTT:      dht.RTT{Dead: true},
+			},
+		}},
+	}
+	for n, c := range cases {
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Errorf("case %d: error marshalling state: %v", n, err)
+			continue
+		}
+		got, err := ParseState(b)
+		if err != nil {
+			t.Errorf("case %d: error parsing state %s: %v", n, b, err)
+			continue
+		}
+		again, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("case %d: error marshalling parsed state: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(again, b) {
+			t.Errorf("case %d: expected %s, got %s", n, b, again)
+		}
+	}
+	for _, b := range []string{
+		``,
+		`{"id": "0x1234"}`,
+		`{"id": "0x6162636465666768696a30313233343536373839", "nodes": [{"id": "0x6162636465666768696a30313233343536373839", "address": "nowhere"}]}`,
+		`{"id": "0x6162636465666768696a30313233343536373839", "nodes": [{"id": "0x6162636465666768696a30313233343536373839", "address": "1.2.3.4:5", "srtt": "soon"}]}`,
+	} {
+		if _, err := ParseState([]byte(b)); err == nil {
+			t.Errorf("expected ParseState(%q) to return error", b)
+		}
+	}
+}
+
+func TestNewFromState(t *testing.T) {
+	nodes := newTestNetwork(t, 8)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	q.SetWant([]string{dht.WantIPv4})
+	target := "4142434445464748494A4B4C4D4E4F5051525354"
+	if _, err := q.FindNode(target); err != nil {
+		t.Fatalf("error issuing FindNode: %v", err)
+	}
+	s := q.State()
+	q.Close()
+	if len(s.Nodes) != q.Table().Len() {
+		t.Fatalf("expected state of %d nodes, got %d", q.Table().Len(), len(s.Nodes))
+	}
+
+	restored, err := NewFromState(s, dht.K)
+	if err != nil {
+		t.Fatalf("error restoring QueryProcessor: %v", err)
+	}
+	defer restored.Close()
+	if restored.ID() != s.ID {
+		t.Errorf("expected id 0x%x, got 0x%x", s.ID, restored.ID())
+	}
+	for _, n := range s.Nodes {
+		seen, ok := restored.Table().LastSeen(n.Node.ID)
+		if !ok || !seen.Equal(n.LastSeen) {
+			t.Errorf("expected node 0x%x last seen at %v, got %v, %v", n.Node.ID, n.LastSeen, seen, ok)
+		}
+		if rtt, _ := restored.dht.NodeRTT(n.Node.Peer.UDPAddr); rtt != n.RTT {
+			t.Errorf("expected node 0x%x to have rtt %+v, got %+v", n.Node.ID, n.RTT, rtt)
+		}
+	}
+	// No bootstrap node is needed to look up from the restored tables.
+	restored.SetWant([]string{dht.WantIPv4})
+	if _, err := restored.FindNode(target); err != nil {
+		t.Errorf("error issuing FindNode from restored state: %v", err)
+	}
+}
+
+func TestStateDropsDeadNodes(t *testing.T) {
+	d, err := dht.New()
+	if err != nil {
+		t.Fatalf("error calling dht.New(): %v", err)
+	}
+	q, err := newQueryProcessor(d, dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	now := time.Now()
+	cases := []struct {
+		id   string
+		seen time.Time
+		dead bool
+		keep bool
+	}{
+		{"alive...............", now.Add(-time.Hour), false, true},
+		{"recently dead.......", now.Add(-time.Minute), true, true},
+		{"dead................", now.Add(-time.Hour), true, false},
+	}
+	for i, c := range cases {
+		n := dht.Node{ID: []byte(c.id), Peer: &dht.Peer{UDPAddr: net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881}}}
+		q.table.insert(n, c.seen)
+		d.SetNodeRTT(n.Peer.UDPAddr, dht.RTT{Dead: c.dead})
+	}
+	kept := map[string]bool{}
+	for _, n := range q.State().Nodes {
+		kept[string(n.Node.ID)] = true
+	}
+	for _, c := range cases {
+		if kept[c.id] != c.keep {
+			t.Errorf("expected node %q with dead %v kept in state: %v, got %v", c.id, c.dead, c.keep, kept[c.id])
+		}
+	}
+}
+
+func TestLookupFallsBackToBootstrap(t *testing.T) {
+	nodes := newTestNetwork(t, 4)
+	q, err := New(localAddr(nodes[0], "127.0.0.1"), dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	q.SetWant([]string{dht.WantIPv4})
+	q.SetTimeout(50 * time.Millisecond)
+	// Replace the routing table with a node that no longer responds.
+	q.table.Remove([]byte(nodes[0].ID))
+	stale := dht.Node{ID: bytes.Repeat([]byte{1}, 20), Peer: &dht.Peer{UDPAddr: localAddr(nodes[3], "127.0.0.1")}}
+	nodes[3].Close()
+	q.table.Insert(stale)
+	if _, err := q.FindNode("4142434445464748494A4B4C4D4E4F5051525354"); err != nil {
+		t.Errorf("expected lookup to fall back to the bootstrap node, got %v", err)
+	}
+}
+
+func TestStateSecureID(t *testing.T) {
+	d, err := dht.New()
+	if err != nil {
+		t.Fatalf("error calling dht.New(): %v", err)
+	}
+	q, err := newQueryProcessor(d, dht.K)
+	if err != nil {
+		t.Fatalf("error creating QueryProcessor: %v", err)
+	}
+	defer q.Close()
+	ip := net.ParseIP("124.31.75.21").To4()
+	q.dht.ID = "abcdefghij0123456789"
+	if got := q.State().ID; got != q.dht.ID {
+		t.Errorf("expected id 0x%x to be saved before our address is known, got 0x%x", q.dht.ID, got)
+	}
+	q.observe(&dht.Message{IP: string(append(ip, 0x1a, 0xe1))})
+	if got := q.State().ID; !dht.SecureIDValid([]byte(got), ip) {
+		t.Errorf("expected id derived from %v to be saved, got 0x%x", ip, got)
+	}
+	if q.dht.ID != "abcdefghij0123456789" {
+		t.Errorf("expected id in use to be kept, got 0x%x", q.dht.ID)
+	}
+}